@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"google.golang.org/api/option"
+)
+
+// Service account key files or secret references, whose daily quotas are pooled or which
+// publish the URLs of the sites they are mapped to, e.g. example.com=/keys/example.json
+var (
+	credentialsPool = os.Getenv("CREDENTIALS_POOL")
+	siteCredentials = os.Getenv("SITE_CREDENTIALS")
+)
+
+// quotaAccount is a service account with a daily quota of its own
+type quotaAccount struct {
+	key    string
+	client *indexingClient
+	// hosts are the sites the account publishes the URLs of, none for pooled accounts
+	hosts []string
+}
+
+// loadAccounts creates a client for every key in CREDENTIALS_POOL and SITE_CREDENTIALS. The
+// sent file must store the key column, which the daily usage of every account is counted from.
+func loadAccounts() ([]quotaAccount, error) {
+	if credentialsPool == "" && siteCredentials == "" {
+		return nil, nil
+	}
+	if schema.column("key") < 0 {
+		return nil, fmt.Errorf("the key column is not stored in the sent file, add it to STATE_COLUMNS")
+	}
+
+	var accounts []quotaAccount
+	index := map[string]int{}
+	add := func(location, host string) error {
+		data, err := readKey(location)
+		if err != nil {
+			return err
+		}
+		key := parseServiceAccountKey(data).id()
+		if key == "" {
+			return fmt.Errorf("%s is not a service account key", location)
+		}
+		if i, ok := index[key]; ok {
+			// One account may own several sites, but not both sites and the pool
+			if host == "" || len(accounts[i].hosts) == 0 {
+				return fmt.Errorf("%s is listed twice", key)
+			}
+			accounts[i].hosts = append(accounts[i].hosts, host)
+			return nil
+		}
+		opt := option.WithCredentialsJSON(data)
+		if apiReplayDir != "" {
+			opt = option.WithoutAuthentication()
+		}
+		client, err := newIndexingClient(nil, opt)
+		if err != nil {
+			return fmt.Errorf("creating indexing service of %s: %w", key, err)
+		}
+		account := quotaAccount{key: key, client: client}
+		if host != "" {
+			account.hosts = []string{host}
+		}
+		index[key] = len(accounts)
+		accounts = append(accounts, account)
+		return nil
+	}
+
+	for _, location := range strings.Split(credentialsPool, ",") {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+		err := add(location, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pair := range strings.Split(siteCredentials, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		host, location, ok := strings.Cut(pair, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid SITE_CREDENTIALS entry %q, expected host=key", pair)
+		}
+		err := add(strings.TrimSpace(location), host)
+		if err != nil {
+			return nil, fmt.Errorf("loading credentials of %s: %w", host, err)
+		}
+	}
+	return accounts, nil
+}
+
+// accountQuota is the quota left today of an account during a run
+type accountQuota struct {
+	quotaAccount
+	remaining int
+}
+
+// accountPool holds the accounts a run publishes through
+type accountPool struct {
+	accounts []*accountQuota
+	// current is the account the URLs of unmapped sites are published through
+	current *accountQuota
+}
+
+// newAccountPool returns the accounts of the rate limits with the quota they have left
+// today, along with the number of URLs sent today. Without CREDENTIALS_POOL, the client
+// is the account of the URLs of sites not in SITE_CREDENTIALS. Without any of them, every
+// URL sent today counts against its quota.
+func newAccountPool(client *indexingClient, limits rateLimits, sentFile string) (*accountPool, int, error) {
+	defaultAccount := quotaAccount{key: limits.key, client: client}
+	if len(limits.accounts) == 0 {
+		sent, _, err := storeFor(sentFile).SentToday()
+		if err != nil {
+			return nil, 0, err
+		}
+		return &accountPool{accounts: []*accountQuota{{defaultAccount, limits.perDay - sent}}}, sent, nil
+	}
+
+	_, sentByKey, err := storeFor(sentFile).SentToday()
+	if err != nil {
+		return nil, 0, err
+	}
+	accounts := limits.accounts
+	if !limits.pooled() {
+		accounts = append([]quotaAccount{defaultAccount}, accounts...)
+	}
+	pool := &accountPool{}
+	total := 0
+	for _, account := range accounts {
+		sent := sentByKey[account.key]
+		total += sent
+		pool.accounts = append(pool.accounts, &accountQuota{account, limits.perDay - sent})
+	}
+	return pool, total, nil
+}
+
+// forUrl returns the account a URL is published through: the one its site is mapped to,
+// otherwise the current pooled account until its batch is full. It is nil if the pooled
+// accounts are used up.
+func (p *accountPool) forUrl(url string) *accountQuota {
+	if account := p.siteAccount(url); account != nil {
+		return account
+	}
+	if p.current == nil || p.current.remaining <= 0 {
+		p.current = p.next()
+	}
+	return p.current
+}
+
+// siteAccount returns the account mapped to the host of a URL or a parent domain of it,
+// the most specific mapping wins
+func (p *accountPool) siteAccount(rawUrl string) *accountQuota {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	var match *accountQuota
+	matched := ""
+	for _, account := range p.accounts {
+		for _, h := range account.hosts {
+			if (host == h || strings.HasSuffix(host, "."+h)) && len(h) > len(matched) {
+				match, matched = account, h
+			}
+		}
+	}
+	return match
+}
+
+// next returns the pooled account with the most quota left, so the accounts are used in
+// turn, or nil if they are all used up
+func (p *accountPool) next() *accountQuota {
+	var best *accountQuota
+	for _, account := range p.accounts {
+		if len(account.hosts) == 0 && account.remaining > 0 && (best == nil || account.remaining > best.remaining) {
+			best = account
+		}
+	}
+	return best
+}
+
+// rotate moves on from an account after its batch is full, so the next batch goes through
+// the pooled account with the most quota left
+func (p *accountPool) rotate(account *accountQuota) {
+	if p.current == account {
+		p.current = nil
+	}
+}
+
+// remaining returns the quota left today over all accounts
+func (p *accountPool) remaining() int {
+	total := 0
+	for _, account := range p.accounts {
+		total += max(account.remaining, 0)
+	}
+	return total
+}
+
+// reset gives every account a new day's quota
+func (p *accountPool) reset(perDay int) {
+	for _, account := range p.accounts {
+		account.remaining = perDay
+	}
+}
+
+// pooled checks if the rate limits have accounts for the URLs of unmapped sites
+func (l rateLimits) pooled() bool {
+	for _, account := range l.accounts {
+		if len(account.hosts) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dailyQuota returns the number of URLs which may be sent per day over all accounts
+func (l rateLimits) dailyQuota() int {
+	accounts := len(l.accounts)
+	if !l.pooled() {
+		// The default credentials publish the URLs of unmapped sites
+		accounts++
+	}
+	return l.perDay * accounts
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountPoolCountsToday(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	c := useFakeClock(t, now)
+	store := newMemoryStore()
+	store.MarkSent(sentRecord{Url: "https://example.com/a", Time: now.Add(-24 * time.Hour)})
+	store.MarkSent(sentRecord{Url: "https://example.com/b", Time: now.Add(-time.Hour)})
+	path := useMemoryStore(t, store)
+
+	pool, sent, err := newAccountPool(nil, rateLimits{perDay: 10}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || pool.remaining() != 9 {
+		t.Errorf("pool has sent %d with %d left, want 1 with 9 left", sent, pool.remaining())
+	}
+
+	// The quota is back on the next day
+	c.advance(24 * time.Hour)
+	pool, sent, err = newAccountPool(nil, rateLimits{perDay: 10}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 || pool.remaining() != 10 {
+		t.Errorf("pool on the next day has sent %d with %d left, want 0 with 10 left", sent, pool.remaining())
+	}
+}
+
+func TestAccountPoolRotatesAccounts(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+	store := newMemoryStore()
+	for i := 0; i < 3; i++ {
+		store.MarkSent(sentRecord{Url: "https://example.com/a", Time: now, Key: "k1"})
+	}
+	path := useMemoryStore(t, store)
+
+	limits := rateLimits{perDay: 5, accounts: []quotaAccount{{key: "k1"}, {key: "k2"}}}
+	pool, sent, err := newAccountPool(nil, limits, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 3 || pool.remaining() != 7 {
+		t.Fatalf("pool has sent %d with %d left, want 3 with 7 left", sent, pool.remaining())
+	}
+
+	// Every batch goes through the account with the most quota left
+	var used []string
+	for pool.remaining() > 0 {
+		account := pool.forUrl("https://example.com/b")
+		if account == nil {
+			t.Fatal("no account while quota is left")
+		}
+		account.remaining--
+		used = append(used, account.key)
+		pool.rotate(account)
+	}
+	want := []string{"k2", "k2", "k2", "k1", "k2", "k1", "k2"}
+	if len(used) != len(want) {
+		t.Fatalf("accounts used %v, want %v", used, want)
+	}
+	for i := range want {
+		if used[i] != want[i] {
+			t.Fatalf("accounts used %v, want %v", used, want)
+		}
+	}
+	if account := pool.forUrl("https://example.com/c"); account != nil {
+		t.Errorf("account %s returned with the quota used up", account.key)
+	}
+
+	pool.reset(limits.perDay)
+	if pool.remaining() != 10 {
+		t.Errorf("pool has %d left after the reset, want 10", pool.remaining())
+	}
+}
+
+func TestAccountPoolSiteAccounts(t *testing.T) {
+	useFakeClock(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local))
+	path := useMemoryStore(t, newMemoryStore())
+
+	limits := rateLimits{perDay: 5, key: "default", accounts: []quotaAccount{
+		{key: "shop", hosts: []string{"shop.example.com"}},
+		{key: "example", hosts: []string{"example.com"}},
+	}}
+	pool, _, err := newAccountPool(nil, limits, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"https://shop.example.com/a": "shop",
+		"https://blog.example.com/a": "example",
+		"https://EXAMPLE.com/a":      "example",
+		"https://other.org/a":        "default",
+	}
+	for url, want := range tests {
+		account := pool.forUrl(url)
+		if account == nil || account.key != want {
+			t.Errorf("forUrl(%s) = %v, want %s", url, account, want)
+		}
+	}
+}
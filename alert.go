@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert settings
+var (
+	alertWebhookUrls    = os.Getenv("ALERT_WEBHOOK_URLS")
+	alertRepeatInterval = os.Getenv("ALERT_REPEAT_INTERVAL")
+)
+
+var (
+	alertMu   sync.Mutex
+	lastAlert = map[string]time.Time{}
+)
+
+// alert reports a condition which needs the attention of an operator to the log and
+// the notification channels. Alerts with the same name are sent at most once per
+// ALERT_REPEAT_INTERVAL.
+func alert(name, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logMessage(severityError, map[string]string{"alert": name}, "ALERT: %s", message)
+
+	repeat, err := parseDurationDefault(alertRepeatInterval, time.Hour)
+	if err != nil {
+		logError("Error parsing ALERT_REPEAT_INTERVAL: %v", err)
+		repeat = time.Hour
+	}
+
+	alertMu.Lock()
+	last, ok := lastAlert[name]
+	if ok && time.Since(last) < repeat {
+		alertMu.Unlock()
+		return
+	}
+	lastAlert[name] = time.Now()
+	alertMu.Unlock()
+
+	for _, url := range strings.Split(alertWebhookUrls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		err := sendWebhookAlert(url, name, message)
+		if err != nil {
+			logError("Error sending alert to webhook: %v", err)
+		}
+	}
+}
+
+// sendWebhookAlert posts an alert as JSON. The text field makes it work with Slack
+// and compatible incoming webhooks.
+func sendWebhookAlert(url, name, message string) error {
+	host, _ := os.Hostname()
+	payload, err := json.Marshal(map[string]string{
+		"text":  "[indexapi] " + message,
+		"alert": name,
+		"host":  host,
+		"time":  time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with status code %d", res.StatusCode)
+	}
+	return nil
+}
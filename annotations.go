@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+)
+
+// urlTypesFile is a sidecar CSV file with url,type rows which set the notification type
+// of URLs from any source, e.g. to delete pages listed in an XML sitemap
+var urlTypesFile = os.Getenv("URL_TYPES_FILE")
+
+// urlTypes are the notification types of the sidecar file by normalized URL
+type urlTypes struct {
+	types map[string]string
+	used  map[string]struct{}
+}
+
+// loadUrlTypes reads the sidecar file, rows without a type are ignored
+func loadUrlTypes(filePath string) (*urlTypes, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &urlTypes{types: map[string]string{}, used: map[string]struct{}{}}
+	for _, annotated := range parseTextList(data) {
+		if annotated.Type != "" {
+			t.types[normalizeUrl(annotated.Loc)] = annotated.Type
+		}
+	}
+	return t, nil
+}
+
+// apply sets the type of a URL which was loaded from a source and kept by the filters
+func (t *urlTypes) apply(url *Url) {
+	typ, ok := t.types[url.Loc]
+	if !ok {
+		return
+	}
+	url.Type = typ
+	t.used[url.Loc] = struct{}{}
+}
+
+// logIgnored logs the number of URLs of the sidecar file which weren't loaded
+func (t *urlTypes) logIgnored() {
+	if ignored := len(t.types) - len(t.used); ignored > 0 {
+		logInfo("Ignored the types of %d URLs which aren't in the sources or were filtered out", ignored)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot archive settings
+var (
+	snapshotArchiveDir = os.Getenv("SNAPSHOT_ARCHIVE_DIR")
+	snapshotRetention  = os.Getenv("SNAPSHOT_RETENTION")
+)
+
+// Archive file names are the UTC time of the snapshot
+const (
+	archiveTimeFormat = "20060102T150405Z"
+	archiveExt        = ".csv.gz"
+)
+
+// archiveDirPath returns the archive directory, which defaults to snapshots next to the sent file
+func archiveDirPath(sentFile string) string {
+	if snapshotArchiveDir != "" {
+		return snapshotArchiveDir
+	}
+	return filepath.Join(filepath.Dir(sentFile), "snapshots")
+}
+
+// archiveSnapshot stores a gzipped copy of the snapshot in the archive and removes archives past retention
+func archiveSnapshot(snapshotPath, archiveDir string) error {
+	retention, err := parseDurationDefault(snapshotRetention, 90*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(archiveDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	now := time.Now().UTC()
+	archivePath := filepath.Join(archiveDir, now.Format(archiveTimeFormat)+archiveExt)
+	tmpPath := archivePath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, archivePath)
+	if err != nil {
+		return err
+	}
+
+	if retention <= 0 {
+		return nil
+	}
+	archives, err := listArchives(archiveDir)
+	if err != nil {
+		return err
+	}
+	for _, a := range archives {
+		if now.Sub(a.Time) > retention {
+			err = os.Remove(a.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotArchive is an archived sitemap snapshot
+type snapshotArchive struct {
+	Path string
+	Time time.Time
+}
+
+// listArchives returns the archived snapshots, oldest first
+func listArchives(archiveDir string) ([]snapshotArchive, error) {
+	files, err := os.ReadDir(archiveDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []snapshotArchive
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, archiveExt) {
+			continue
+		}
+		t, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(name, archiveExt))
+		if err != nil {
+			continue
+		}
+		archives = append(archives, snapshotArchive{Path: filepath.Join(archiveDir, name), Time: t})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Time.Before(archives[j].Time)
+	})
+	return archives, nil
+}
+
+// readArchive reads an archived snapshot
+func readArchive(filePath string) (map[string]snapshotEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return parseSnapshot(zr)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/indexing/v3"
+	"google.golang.org/api/option"
+)
+
+// publishBatchSize is the number of notifications sent per batch request
+var publishBatchSize = os.Getenv("PUBLISH_BATCH_SIZE")
+
+// apiEndpoint replaces the base URL of the Index API, e.g. with a mock server in tests
+var apiEndpoint = os.Getenv("API_ENDPOINT")
+
+// maxPublishBatchSize is the number of calls the API accepts in a batch request
+const maxPublishBatchSize = 100
+
+// indexingClient is the Index API service along with its authenticated HTTP client,
+// which is needed for batch requests as the generated client doesn't support them
+type indexingClient struct {
+	*indexing.Service
+	http *http.Client
+}
+
+// newIndexingClient creates the Index API service and keeps its HTTP client. Without an
+// HTTP client given, it creates one authenticated by the options, which connects through
+// the shared transport of apiTransport, as do token requests, and calls API_ENDPOINT if set.
+func newIndexingClient(httpClient *http.Client, opts ...option.ClientOption) (*indexingClient, error) {
+	ctx := context.Background()
+	opts = append([]option.ClientOption{option.WithScopes(indexing.IndexingScope)}, opts...)
+	if httpClient == nil {
+		if apiEndpoint != "" {
+			endpoint, err := parseApiEndpoint(apiEndpoint)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, option.WithEndpoint(endpoint))
+		}
+		base, err := apiTransport()
+		if err != nil {
+			return nil, err
+		}
+		recorded, err := withRecordReplay(base)
+		if err != nil {
+			return nil, err
+		}
+		// Token requests aren't logged or recorded, as their bodies are all credentials
+		httpClient, err = newAuthenticatedClient(withDebugLogging(recorded), opts...)
+		if err != nil {
+			return nil, err
+		}
+	} else if apiDebug == "true" || apiRecordDir != "" || apiReplayDir != "" {
+		recorded, err := withRecordReplay(httpClient.Transport)
+		if err != nil {
+			return nil, err
+		}
+		wrapped := *httpClient
+		wrapped.Transport = withDebugLogging(recorded)
+		httpClient = &wrapped
+	}
+	service, err := indexing.NewService(ctx, append(opts, option.WithHTTPClient(httpClient))...)
+	if err != nil {
+		return nil, err
+	}
+	return &indexingClient{Service: service, http: httpClient}, nil
+}
+
+// parseApiEndpoint checks API_ENDPOINT is an http(s) URL. The API paths are resolved
+// relative to it, so it gets a trailing slash to keep a path prefix.
+func parseApiEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing API_ENDPOINT: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("API_ENDPOINT must be an absolute http(s) URL, got %q", endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+// loadBatchSize reads PUBLISH_BATCH_SIZE, a batch never holds more calls than the per minute rate allows
+func loadBatchSize(perMinute int) (int, error) {
+	size, err := parseIntDefault(publishBatchSize, maxPublishBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("parsing PUBLISH_BATCH_SIZE: %w", err)
+	}
+	if size < 1 || size > maxPublishBatchSize {
+		return 0, fmt.Errorf("PUBLISH_BATCH_SIZE must be between 1 and %d", maxPublishBatchSize)
+	}
+	if perMinute > 0 && size > perMinute {
+		size = perMinute
+	}
+	return size, nil
+}
+
+// publishOutcome is the response to one notification of a batch
+type publishOutcome struct {
+	res *indexing.PublishUrlNotificationResponse
+	err error
+}
+
+// publishBatch publishes notifications in a single multipart batch request. The error is
+// set when the request as a whole failed, otherwise every notification has its own outcome.
+// A single notification is published with a plain request.
+func publishBatch(ctx context.Context, client *indexingClient, items []indexing.UrlNotification) ([]publishOutcome, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	outcomes := make([]publishOutcome, len(items))
+	if len(items) == 1 {
+		res, err := client.UrlNotifications.Publish(&items[0]).Context(ctx).Do()
+		outcomes[0] = publishOutcome{res: res, err: err}
+		return outcomes, nil
+	}
+
+	base, err := url.Parse(client.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	publishPath := strings.TrimSuffix(base.Path, "/") + "/v3/urlNotifications:publish"
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, item := range items {
+		data, err := json.Marshal(&item)
+		if err != nil {
+			return nil, err
+		}
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<item" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(part, "POST %s HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", publishPath, len(data))
+		part.Write(data)
+	}
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(client.BasePath, "/")+"/batch", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	res, err := client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	err = googleapi.CheckResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected batch response of type %q", res.Header.Get("Content-Type"))
+	}
+
+	answered := make([]bool, len(items))
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Notifications without a response fail below and are retried
+			logWarning("Error reading batch response: %v", err)
+			break
+		}
+		// Responses are matched to notifications by Content-ID, or by their order without one
+		index := i
+		id := strings.TrimSuffix(strings.TrimPrefix(part.Header.Get("Content-ID"), "<response-item"), ">")
+		if n, err := strconv.Atoi(id); err == nil {
+			index = n
+		}
+		if index < 0 || index >= len(items) {
+			continue
+		}
+		outcomes[index] = readPublishResponse(part, req)
+		answered[index] = true
+	}
+	for i := range outcomes {
+		if !answered[i] {
+			outcomes[i].err = fmt.Errorf("no response to %s in batch", items[i].Url)
+		}
+	}
+	return outcomes, nil
+}
+
+// readPublishResponse parses the HTTP response to a publish call embedded in a batch response
+func readPublishResponse(r io.Reader, req *http.Request) publishOutcome {
+	res, err := http.ReadResponse(bufio.NewReader(r), req)
+	if err != nil {
+		return publishOutcome{err: fmt.Errorf("reading batch response: %w", err)}
+	}
+	defer res.Body.Close()
+	err = googleapi.CheckResponse(res)
+	if err != nil {
+		return publishOutcome{err: err}
+	}
+	ret := &indexing.PublishUrlNotificationResponse{
+		ServerResponse: googleapi.ServerResponse{Header: res.Header, HTTPStatusCode: res.StatusCode},
+	}
+	err = json.NewDecoder(res.Body).Decode(ret)
+	if err != nil {
+		return publishOutcome{err: err}
+	}
+	return publishOutcome{res: ret}
+}
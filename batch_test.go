@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/indexing/v3"
+	"google.golang.org/api/option"
+)
+
+// batchTestServer serves a canned batch response and passes the batch request to inspect
+func batchTestServer(t *testing.T, contentType string, status int, body string, inspect func(*http.Request)) *indexingClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inspect != nil {
+			inspect(r)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	client, err := newIndexingClient(&http.Client{}, option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// batchResponsePart is a part of a batch response with the given Content-ID header, if any
+func batchResponsePart(contentID, status, body string) string {
+	part := "--batch_b\r\nContent-Type: application/http\r\n"
+	if contentID != "" {
+		part += "Content-ID: " + contentID + "\r\n"
+	}
+	return part + "\r\nHTTP/1.1 " + status + "\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n" + body + "\r\n"
+}
+
+// publishedBody is the response body of a published notification of url
+func publishedBody(url string) string {
+	return fmt.Sprintf(`{"urlNotificationMetadata":{"url":%q,"latestUpdate":{"url":%q,"type":"URL_UPDATED"}}}`, url, url)
+}
+
+func testBatchItems(n int) []indexing.UrlNotification {
+	var items []indexing.UrlNotification
+	for i := 0; i < n; i++ {
+		items = append(items, indexing.UrlNotification{Url: fmt.Sprintf("https://example.com/%d", i), Type: "URL_UPDATED"})
+	}
+	return items
+}
+
+func TestPublishBatchRequest(t *testing.T) {
+	items := testBatchItems(3)
+	var requests []*http.Request
+	response := batchResponsePart("<response-item0>", "200 OK", publishedBody(items[0].Url)) +
+		batchResponsePart("<response-item1>", "200 OK", publishedBody(items[1].Url)) +
+		batchResponsePart("<response-item2>", "200 OK", publishedBody(items[2].Url)) + "--batch_b--\r\n"
+
+	client := batchTestServer(t, "multipart/mixed; boundary=batch_b", http.StatusOK, response, func(r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/batch" {
+			t.Errorf("batch request is %s %s, want POST /batch", r.Method, r.URL.Path)
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("batch request has Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for i := 0; ; i++ {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				if i != len(items) {
+					t.Errorf("batch request has %d parts, want %d", i, len(items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := part.Header.Get("Content-ID"), fmt.Sprintf("<item%d>", i); got != want {
+				t.Errorf("part %d has Content-ID %s, want %s", i, got, want)
+			}
+			if got := part.Header.Get("Content-Type"); got != "application/http" {
+				t.Errorf("part %d has Content-Type %s, want application/http", i, got)
+			}
+			call, err := http.ReadRequest(bufio.NewReader(part))
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests = append(requests, call)
+			var n indexing.UrlNotification
+			err = json.NewDecoder(call.Body).Decode(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Url != items[i].Url || n.Type != items[i].Type {
+				t.Errorf("part %d publishes %s %s, want %s %s", i, n.Type, n.Url, items[i].Type, items[i].Url)
+			}
+		}
+	})
+
+	outcomes, err := publishBatch(context.Background(), client, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range requests {
+		if call.Method != http.MethodPost || call.URL.Path != "/v3/urlNotifications:publish" {
+			t.Errorf("batched call is %s %s, want POST /v3/urlNotifications:publish", call.Method, call.URL.Path)
+		}
+	}
+	for i, outcome := range outcomes {
+		if outcome.err != nil {
+			t.Errorf("item %d failed: %v", i, outcome.err)
+		}
+	}
+}
+
+func TestPublishBatchResponses(t *testing.T) {
+	items := testBatchItems(3)
+	ok := func(i int) string { return publishedBody(items[i].Url) }
+	quota := `{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED"}}`
+	invalid := `{"error":{"code":400,"message":"Invalid URL","status":"INVALID_ARGUMENT"}}`
+
+	// want is the outcome of every item: 200 if it was published, the status code of a
+	// part-level API error, or -1 for any other error
+	tests := []struct {
+		name string
+		body string
+		want []int
+	}{
+		{
+			name: "published",
+			body: batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				batchResponsePart("<response-item1>", "200 OK", ok(1)) +
+				batchResponsePart("<response-item2>", "200 OK", ok(2)) + "--batch_b--\r\n",
+			want: []int{200, 200, 200},
+		},
+		{
+			name: "out of order",
+			body: batchResponsePart("<response-item2>", "200 OK", ok(2)) +
+				batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				batchResponsePart("<response-item1>", "200 OK", ok(1)) + "--batch_b--\r\n",
+			want: []int{200, 200, 200},
+		},
+		{
+			name: "part errors",
+			body: batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				batchResponsePart("<response-item1>", "429 Too Many Requests", quota) +
+				batchResponsePart("<response-item2>", "400 Bad Request", invalid) + "--batch_b--\r\n",
+			want: []int{200, 429, 400},
+		},
+		{
+			name: "missing Content-ID",
+			body: batchResponsePart("", "200 OK", ok(0)) +
+				batchResponsePart("", "200 OK", ok(1)) +
+				batchResponsePart("", "429 Too Many Requests", quota) + "--batch_b--\r\n",
+			want: []int{200, 200, 429},
+		},
+		{
+			name: "garbled Content-ID",
+			body: batchResponsePart("<response-itemx>", "200 OK", ok(0)) +
+				batchResponsePart("response-item1", "200 OK", ok(1)) +
+				batchResponsePart("<response-item7>", "200 OK", ok(2)) + "--batch_b--\r\n",
+			want: []int{200, 200, -1},
+		},
+		{
+			name: "missing response",
+			body: batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				batchResponsePart("<response-item2>", "200 OK", ok(2)) + "--batch_b--\r\n",
+			want: []int{200, -1, 200},
+		},
+		{
+			name: "truncated",
+			body: batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				"--batch_b\r\nContent-Type: application/http\r\nContent-ID: <response-item1>\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n{\"urlNotificationMeta",
+			want: []int{200, -1, -1},
+		},
+		{
+			name: "garbled part",
+			body: batchResponsePart("<response-item0>", "200 OK", ok(0)) +
+				"--batch_b\r\nContent-Type: application/http\r\nContent-ID: <response-item1>\r\n\r\nnot a response\r\n" +
+				batchResponsePart("<response-item2>", "200 OK", "not json") + "--batch_b--\r\n",
+			want: []int{200, -1, -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := batchTestServer(t, "multipart/mixed; boundary=batch_b", http.StatusOK, tt.body, nil)
+			outcomes, err := publishBatch(context.Background(), client, items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				outcome := outcomes[i]
+				switch {
+				case want == 200:
+					if outcome.err != nil {
+						t.Errorf("item %d failed: %v", i, outcome.err)
+					} else if outcome.res.UrlNotificationMetadata.Url != items[i].Url {
+						t.Errorf("item %d got the response for %s", i, outcome.res.UrlNotificationMetadata.Url)
+					}
+				case outcome.err == nil:
+					t.Errorf("item %d succeeded, want an error", i)
+				case want > 0:
+					var apiErr *googleapi.Error
+					if !errors.As(outcome.err, &apiErr) || apiErr.Code != want {
+						t.Errorf("item %d failed with %v, want status %d", i, outcome.err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPublishBatchFailedRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+	}{
+		{"error status", "application/json", http.StatusServiceUnavailable, `{"error":{"code":503,"message":"Unavailable"}}`},
+		{"not multipart", "application/json", http.StatusOK, `{}`},
+		{"no content type", "", http.StatusOK, strings.Repeat("x", 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := batchTestServer(t, tt.contentType, tt.status, tt.body, nil)
+			_, err := publishBatch(context.Background(), client, testBatchItems(2))
+			if err == nil {
+				t.Error("publishBatch succeeded, want an error")
+			}
+		})
+	}
+}
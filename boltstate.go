@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFile is the path of the database with STATE_BACKEND=bolt
+var boltFile = os.Getenv("BOLT_FILE")
+
+// Buckets of the bolt database. Sent records and failed notifications are kept in the order
+// they were added, the latest record of every URL and type and the records of every URL,
+// in a bucket per URL under the keys of the sent bucket, are kept for lookups. Indexed URLs
+// are keys without values.
+var (
+	boltSentBucket    = []byte("sent")
+	boltLatestBucket  = []byte("latest")
+	boltUrlsBucket    = []byte("urls")
+	boltIndexedBucket = []byte("indexed")
+)
+
+var (
+	boltOnce sync.Once
+	boltDB   *bolt.DB
+	boltErr  error
+)
+
+// boltFilePath returns the path of the database, which defaults to state.bolt next to the sent file
+func boltFilePath(sentFile string) string {
+	if boltFile != "" {
+		return boltFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "state.bolt")
+}
+
+// openBolt opens the database once per run and creates its buckets. The file is locked while
+// open, so another process waits up to 10 seconds for it and then fails. In read-only mode
+// the database is shared with other readers and is nil if it doesn't exist yet.
+func openBolt() (*bolt.DB, error) {
+	boltOnce.Do(func() {
+		path := boltFilePath(sentFile)
+		opts := &bolt.Options{Timeout: 10 * time.Second}
+		if readOnly == "true" {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return
+			}
+			opts.ReadOnly = true
+		}
+		db, err := bolt.Open(path, 0644, opts)
+		if err != nil {
+			boltErr = fmt.Errorf("opening %s: %w", path, err)
+			return
+		}
+		if readOnly != "true" {
+			err = db.Update(func(tx *bolt.Tx) error {
+				for _, name := range [][]byte{boltSentBucket, boltLatestBucket, boltIndexedBucket, []byte(queueDeadLetter), []byte(queueRetry)} {
+					if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+						return err
+					}
+				}
+				if tx.Bucket(boltUrlsBucket) != nil {
+					return nil
+				}
+				// Databases of older versions get the records of every URL indexed once
+				byUrl, err := tx.CreateBucket(boltUrlsBucket)
+				if err != nil {
+					return err
+				}
+				return tx.Bucket(boltSentBucket).ForEach(func(k, v []byte) error {
+					var rec sentRecord
+					if err := json.Unmarshal(v, &rec); err != nil {
+						return err
+					}
+					return boltIndexUrl(byUrl, rec.Url, k, v)
+				})
+			})
+			if err != nil {
+				db.Close()
+				boltErr = fmt.Errorf("creating the buckets of %s: %w", path, err)
+				return
+			}
+		}
+		boltDB = db
+	})
+	return boltDB, boltErr
+}
+
+// boltAppend adds a value to a bucket under the next sequence number and returns its key
+func boltAppend(b *bolt.Bucket, data []byte) ([]byte, error) {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key, b.Put(key, data)
+}
+
+// boltIndexUrl adds a sent record to the bucket of its URL under its key in the sent bucket
+func boltIndexUrl(byUrl *bolt.Bucket, url string, key, data []byte) error {
+	url = normalizeUrl(url)
+	if url == "" {
+		return nil
+	}
+	b, err := byUrl.CreateBucketIfNotExists([]byte(url))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// boltRecord decodes a sent record
+func boltRecord(data []byte) (sentRecord, error) {
+	var rec sentRecord
+	err := json.Unmarshal(data, &rec)
+	rec.Url = normalizeUrl(rec.Url)
+	return rec, err
+}
+
+// boltStore keeps the state in the buckets of a bbolt file
+type boltStore struct{}
+
+// Get reads the buckets of the URLs in the urls bucket
+func (s boltStore) Get(urls ...string) ([]sentRecord, error) {
+	db, err := openBolt()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	type keyed struct {
+		key string
+		rec sentRecord
+	}
+	var found []keyed
+	indexed := true
+	err = db.View(func(tx *bolt.Tx) error {
+		byUrl := tx.Bucket(boltUrlsBucket)
+		if byUrl == nil {
+			indexed = false
+			return nil
+		}
+		for _, url := range urls {
+			b := byUrl.Bucket([]byte(url))
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				rec, err := boltRecord(v)
+				found = append(found, keyed{string(k), rec})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		// Databases of older versions opened read-only have no urls bucket yet
+		records, err := s.Sent()
+		return recordsOf(records, urls), err
+	}
+
+	// The keys of the sent bucket keep the order the records were added in
+	sort.Slice(found, func(i, j int) bool { return found[i].key < found[j].key })
+	records := make([]sentRecord, len(found))
+	for i, f := range found {
+		records[i] = f.rec
+	}
+	return records, nil
+}
+
+// Latest reads the latest bucket
+func (boltStore) Latest() ([]sentRecord, error) {
+	db, err := openBolt()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	var records []sentRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLatestBucket).ForEach(func(_, v []byte) error {
+			rec, err := boltRecord(v)
+			records = append(records, rec)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latestRecords(records), nil
+}
+
+// SentSince reads the sent bucket backwards from the newest record, as records are added
+// in the order they are sent
+func (boltStore) SentSince(t time.Time) ([]sentRecord, error) {
+	db, err := openBolt()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	var records []sentRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSentBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			rec, err := boltRecord(v)
+			if err != nil {
+				return err
+			}
+			if rec.Time.Before(t) {
+				break
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+	slices.Reverse(records)
+	return records, err
+}
+
+func (boltStore) Sent() ([]sentRecord, error) {
+	db, err := openBolt()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	var records []sentRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSentBucket).ForEach(func(_, v []byte) error {
+			rec, err := boltRecord(v)
+			records = append(records, rec)
+			return err
+		})
+	})
+	return records, err
+}
+
+// MarkSent adds a record to the sent bucket and the bucket of its URL and makes it the
+// latest of its URL and type
+func (boltStore) MarkSent(rec sentRecord) error {
+	db, err := openBolt()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		key, err := boltAppend(tx.Bucket(boltSentBucket), data)
+		if err != nil {
+			return err
+		}
+		err = boltIndexUrl(tx.Bucket(boltUrlsBucket), rec.Url, key, data)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltLatestBucket).Put([]byte(sentKey(rec.Url, rec.Type)), data)
+	})
+}
+
+func (boltStore) Indexed() (map[string]struct{}, error) {
+	urls := map[string]struct{}{}
+	db, err := openBolt()
+	if err != nil {
+		return nil, err
+	}
+	if db != nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltIndexedBucket).ForEach(func(k, _ []byte) error {
+				urls[normalizeUrl(string(k))] = struct{}{}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return withIndexedFile(urls)
+}
+
+func (boltStore) MarkIndexed(url string) error {
+	db, err := openBolt()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexedBucket).Put([]byte(url), nil)
+	})
+}
+
+func (boltStore) Failures(queue string) ([]failedNotification, error) {
+	db, err := openBolt()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	var failures []failedNotification
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(queue)).ForEach(func(_, v []byte) error {
+			var f failedNotification
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			f.Url = normalizeUrl(f.Url)
+			failures = append(failures, f)
+			return nil
+		})
+	})
+	return failures, err
+}
+
+func (boltStore) MarkFailed(queue string, f failedNotification) error {
+	db, err := openBolt()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := boltAppend(tx.Bucket([]byte(queue)), data)
+		return err
+	})
+}
+
+func (s boltStore) SentToday() (int, map[string]int, error) {
+	return sentToday(s)
+}
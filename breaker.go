@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker settings
+var (
+	breakerThreshold = os.Getenv("BREAKER_THRESHOLD")
+	breakerCooldown  = os.Getenv("BREAKER_COOLDOWN")
+	abortAfter       = os.Getenv("ABORT_AFTER_FAILURES")
+)
+
+// circuitBreaker pauses submissions after consecutive transport or server errors,
+// so an API outage doesn't use up all retries and fill the dead letter file
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+}
+
+// newCircuitBreaker creates a breaker from environment variables, a threshold of 0 disables it
+func newCircuitBreaker() (*circuitBreaker, error) {
+	threshold, err := parseIntDefault(breakerThreshold, 5)
+	if err != nil {
+		return nil, fmt.Errorf("parsing BREAKER_THRESHOLD: %w", err)
+	}
+	cooldown, err := parseDurationDefault(breakerCooldown, 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("parsing BREAKER_COOLDOWN: %w", err)
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}, nil
+}
+
+// wait blocks for the cooldown while the breaker is open, or until ctx is done. The next
+// call is a probe: if it fails the breaker stays open, if it succeeds the breaker closes.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	if !b.isOpen() {
+		return nil
+	}
+	state := runStateOf(ctx)
+	state.log.warning("Circuit breaker is open, pausing submissions for %s", b.cooldown)
+	state.status.setNext("probe the API after the circuit breaker cooldown", clock.Now().Add(b.cooldown))
+	err := sleepContext(ctx, b.cooldown)
+	if err != nil {
+		return err
+	}
+	state.log.info("Circuit breaker probing the API")
+	return nil
+}
+
+// isOpen checks if submissions are paused
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// record updates the breaker with the outcome of an API call
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || classifyError(err) != errRetryable {
+		// The API answered, so it is up
+		if b.open {
+			logInfo("Circuit breaker closed, the API is available again")
+			alert("breaker_closed", "Google Index API is available again, submissions resumed")
+		}
+		b.failures = 0
+		b.open = false
+		return
+	}
+
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		b.open = true
+		alert("breaker_open", "Circuit breaker opened after %d consecutive API failures, last error: %v", b.failures, err)
+	}
+}
+
+// failureStreak aborts a run after consecutive publishes failed for good, e.g. because the
+// property isn't verified, instead of producing the same error for every remaining URL.
+// It isn't safe for concurrent use.
+type failureStreak struct {
+	threshold  int
+	count      int
+	categories map[string]int
+}
+
+// newFailureStreak reads the threshold from ABORT_AFTER_FAILURES, 0 disables aborting
+func newFailureStreak() (*failureStreak, error) {
+	threshold, err := parseIntDefault(abortAfter, 25)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ABORT_AFTER_FAILURES: %w", err)
+	}
+	return &failureStreak{threshold: threshold, categories: map[string]int{}}, nil
+}
+
+// record counts the outcome of a publish and returns an error once the streak reaches the threshold
+func (s *failureStreak) record(category errorCategory, cause error) error {
+	if cause == nil {
+		s.count = 0
+		s.categories = map[string]int{}
+		return nil
+	}
+	s.count++
+	s.categories[string(category)]++
+	if s.threshold <= 0 || s.count != s.threshold {
+		return nil
+	}
+
+	var summary []string
+	for _, c := range sortedKeys(s.categories) {
+		summary = append(summary, fmt.Sprintf("%d %s", s.categories[c], c))
+	}
+	alert("run_aborted", "Run aborted after %d consecutive failed publishes (%s), last error: %v",
+		s.count, strings.Join(summary, ", "), cause)
+	return fmt.Errorf("aborting run after %d consecutive failed publishes (%s), last error: %w",
+		s.count, strings.Join(summary, ", "), cause)
+}
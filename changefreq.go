@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// changefreqResubmit re-submits sent URLs on the cadence of their sitemap changefreq
+var changefreqResubmit = os.Getenv("CHANGEFREQ_RESUBMIT")
+
+// changefreqIntervals are the resubmission intervals of the sitemap changefreq values,
+// always is treated as hourly and never is never resubmitted
+var changefreqIntervals = map[string]time.Duration{
+	"always":  time.Hour,
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// resubmitDue checks if a sent URL is due for resubmission by its changefreq
+func resubmitDue(changefreq string, lastSent time.Time) bool {
+	if changefreqResubmit != "true" {
+		return false
+	}
+	interval, ok := changefreqIntervals[strings.ToLower(strings.TrimSpace(changefreq))]
+	return ok && clock.Now().Sub(lastSent) >= interval
+}
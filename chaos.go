@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// chaosRates are the shares of fake API requests which fail with each kind of fault
+type chaosRates struct {
+	timeout   float64
+	quota     float64
+	server    float64
+	malformed float64
+}
+
+// parseChaos reads a fault spec like "timeout=0.02,429=0.05,5xx=0.05,malformed=0.02"
+func parseChaos(spec string) (chaosRates, error) {
+	var rates chaosRates
+	if spec == "" {
+		return rates, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return rates, fmt.Errorf("invalid chaos fault %q, expected name=rate", item)
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return rates, fmt.Errorf("invalid rate in chaos fault %q, expected 0-1", item)
+		}
+		switch name {
+		case "timeout":
+			rates.timeout = rate
+		case "429":
+			rates.quota = rate
+		case "5xx":
+			rates.server = rate
+		case "malformed":
+			rates.malformed = rate
+		default:
+			return rates, fmt.Errorf("unknown chaos fault %q, use timeout, 429, 5xx or malformed", name)
+		}
+	}
+	if rates.timeout+rates.quota+rates.server+rates.malformed > 1 {
+		return rates, fmt.Errorf("chaos fault rates add up to more than 1")
+	}
+	return rates, nil
+}
+
+// injectFault fails the request with one of the configured faults and reports if it did
+func (f *fakeAPI) injectFault(w http.ResponseWriter, r *http.Request) bool {
+	p := rand.Float64()
+	switch {
+	case p < f.chaos.timeout:
+		// Hang until the client gives up
+		<-r.Context().Done()
+	case p < f.chaos.timeout+f.chaos.quota:
+		w.Header().Set("Retry-After", "1")
+		writeFakeError(w, http.StatusTooManyRequests,
+			"Quota exceeded for quota metric 'Publish requests' and limit 'Publish requests per minute'.")
+	case p < f.chaos.timeout+f.chaos.quota+f.chaos.server:
+		codes := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+		code := codes[rand.Intn(len(codes))]
+		writeFakeError(w, code, http.StatusText(code))
+	case p < f.chaos.timeout+f.chaos.quota+f.chaos.server+f.chaos.malformed:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"urlNotificationMetadata": {"url": `))
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestParseChaos(t *testing.T) {
+	rates, err := parseChaos("timeout=0.1, 429=0.2,5xx=0.3,malformed=0.05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := chaosRates{timeout: 0.1, quota: 0.2, server: 0.3, malformed: 0.05}
+	if rates != want {
+		t.Errorf("parseChaos = %+v, want %+v", rates, want)
+	}
+
+	for _, spec := range []string{"5xx", "5xx=2", "404=0.1", "429=0.6,5xx=0.6"} {
+		if _, err := parseChaos(spec); err == nil {
+			t.Errorf("parseChaos(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+// submitWithChaos publishes URLs to the fake API with injected faults, on the fake clock so
+// retries and pauses don't take real time, and returns the stats and the state
+func submitWithChaos(t *testing.T, spec string, urls int) (runStats, *memoryStore, error) {
+	t.Helper()
+	useFakeClock(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local))
+	store := newMemoryStore()
+	path := useMemoryStore(t, store)
+	prevBatchSize := publishBatchSize
+	publishBatchSize = "5"
+	t.Cleanup(func() { publishBatchSize = prevBatchSize })
+
+	chaos, err := parseChaos(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newFakeAPI(0, 0)
+	api.chaos = chaos
+	server := api.start()
+	t.Cleanup(server.Close)
+	client, err := newIndexingClient(&http.Client{}, option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notifications []notification
+	for i := 0; i < urls; i++ {
+		notifications = append(notifications, notification{Url: fmt.Sprintf("https://example.com/%d", i), Type: "URL_UPDATED"})
+	}
+	limits := rateLimits{perDay: 200, perMinute: 600, concurrency: 2}
+	stats, err := submitUrls(context.Background(), client, notifications, path, "test", limits)
+	return stats, store, err
+}
+
+func TestSubmitWithChaos(t *testing.T) {
+	stats, store, err := submitWithChaos(t, "429=0.2,5xx=0.2,malformed=0.1", 30)
+	if err != nil {
+		t.Logf("run aborted: %v", err)
+	}
+
+	// Every attempted URL is either sent or queued for a later run, whatever failed
+	if stats.Sent+stats.Failed != stats.Attempted {
+		t.Errorf("sent %d and failed %d of %d attempted URLs", stats.Sent, stats.Failed, stats.Attempted)
+	}
+	sent, _ := store.Sent()
+	if len(sent) != stats.Sent {
+		t.Errorf("state has %d sent records, want %d", len(sent), stats.Sent)
+	}
+	retry, _ := store.Failures(queueRetry)
+	dead, _ := store.Failures(queueDeadLetter)
+	if len(retry)+len(dead) != stats.Failed {
+		t.Errorf("state has %d failures, want %d", len(retry)+len(dead), stats.Failed)
+	}
+	if len(dead) != 0 {
+		t.Errorf("%d transient failures were dead-lettered", len(dead))
+	}
+}
+
+func TestSubmitDuringOutage(t *testing.T) {
+	stats, store, err := submitWithChaos(t, "5xx=1", 50)
+
+	// The breaker's failed probes abort the run instead of retrying until it ends
+	if err == nil {
+		t.Fatalf("run during an outage succeeded, sent %d", stats.Sent)
+	}
+	if stats.Sent != 0 {
+		t.Errorf("sent %d URLs during an outage", stats.Sent)
+	}
+	if stats.Attempted == 50 {
+		t.Errorf("all URLs were attempted during an outage")
+	}
+	retry, _ := store.Failures(queueRetry)
+	if len(retry) != stats.Failed {
+		t.Errorf("retry queue has %d URLs, want %d", len(retry), stats.Failed)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(sentFile), "*")); len(matches) != 0 {
+		t.Errorf("the memory store wrote files: %v", matches)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkResult compares the last notification sent for a URL with what Google received
+type checkResult struct {
+	Url        string
+	Type       string
+	SentAt     time.Time
+	NotifyTime string
+	// Status is "registered", "missing" if Google never received a notification of the
+	// type, "stale" if the one it received is older than the send, or "error"
+	Status string
+}
+
+// runCheck calls getMetadata for every URL of the sent file and writes a report of the
+// notify times, flagging URLs whose last publish apparently never registered with Google.
+// It uses the metadata rate limit and cache like sync.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	out := fs.String("out", "-", "Path of the report file to write, - for stdout")
+	tolerance := fs.Duration("tolerance", time.Minute, "Allowed difference between the sent time and Google's notify time")
+	force := fs.Bool("force", false, "Call getMetadata even for URLs fetched within METADATA_CACHE_TTL")
+	fs.Parse(args)
+
+	client, err := newIndexingService()
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+	ctx := interruptContext()
+
+	perMinute, err := parseIntDefault(metadataRateLimit, 180)
+	if err != nil {
+		log.Fatal("Error converting metadata rate limit per minute to integer:", err)
+		return
+	}
+	concurrency, err := parseIntDefault(metadataConcurrency, 10)
+	if err != nil {
+		log.Fatal("Error converting metadata concurrency to integer:", err)
+		return
+	}
+
+	records, err := stateStore.Latest()
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+	// Only the last notification of a URL is expected to be Google's latest
+	last := map[string]sentRecord{}
+	for _, rec := range records {
+		if prev, ok := last[rec.Url]; !ok || !rec.Time.Before(prev.Time) {
+			last[rec.Url] = rec
+		}
+	}
+	urls := sortedKeys(last)
+
+	cache, err := newMetadataCache(sentFile)
+	if err != nil {
+		log.Fatal("Error reading metadata file:", err)
+		return
+	}
+
+	logInfo("Checking metadata of %d sent URLs, rate: %d per minute, concurrency: %d", len(urls), perMinute, concurrency)
+	metadataLimiter := newLimiter(perMinute, concurrency)
+	results := make([]checkResult, len(urls))
+	var mu sync.Mutex
+	counts := map[string]int{}
+	for i, url := range urls {
+		metadataLimiter.acquire()
+		go func(i int, rec sentRecord) {
+			defer metadataLimiter.release()
+			// A cached response from before the send can't show whether it registered
+			meta, err := cache.lookup(ctx, client, metadataLimiter, rec.Url, *force || !cache.checkedSince(rec.Url, rec.Time))
+			result := checkResult{Url: rec.Url, Type: rec.Type, SentAt: rec.Time}
+			if result.Type == "" {
+				result.Type = "URL_UPDATED"
+			}
+			if err != nil {
+				logURL(severityError, rec.Url, "Error getting metadata of %s: %v", rec.Url, err)
+				result.Status = "error"
+			} else {
+				result.NotifyTime = meta.LatestUpdate
+				if result.Type == "URL_DELETED" {
+					result.NotifyTime = meta.LatestRemove
+				}
+				result.Status = registrationStatus(result.NotifyTime, rec.Time, *tolerance)
+				if result.Status != "registered" {
+					logURL(severityWarning, rec.Url, "%s of %s sent at %s is %s at Google", result.Type, rec.Url, rec.Time.Format(time.RFC3339), result.Status)
+				}
+			}
+			results[i] = result
+			mu.Lock()
+			counts[result.Status]++
+			mu.Unlock()
+		}(i, last[url])
+	}
+	metadataLimiter.drain()
+
+	err = cache.save()
+	if err != nil {
+		log.Fatal("Error writing metadata file:", err)
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal("Error creating report file:", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+	err = writeCheckReport(bw, results)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatal("Error writing report:", err)
+		return
+	}
+	logInfo("Finish. Checked %d URLs: %d registered, %d missing, %d stale, %d failed",
+		len(urls), counts["registered"], counts["missing"], counts["stale"], counts["error"])
+}
+
+// registrationStatus checks if Google's notify time shows the notification sent at sentAt
+// was received. Google timestamps the notification when it arrives, which is slightly
+// before the sent file records it, so notify times within tolerance of the send count.
+func registrationStatus(notifyTime string, sentAt time.Time, tolerance time.Duration) string {
+	if notifyTime == "" {
+		return "missing"
+	}
+	t, err := time.Parse(time.RFC3339Nano, notifyTime)
+	if err != nil || t.Before(sentAt.Add(-tolerance)) {
+		return "stale"
+	}
+	return "registered"
+}
+
+// writeCheckReport writes the check results as CSV
+func writeCheckReport(w io.Writer, results []checkResult) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"url", "type", "sent_at", "notify_time", "status"})
+	for _, r := range results {
+		writer.Write([]string{r.Url, r.Type, r.SentAt.UTC().Format(time.RFC3339), r.NotifyTime, r.Status})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/indexing/v3"
+)
+
+var canaryUrl = os.Getenv("CANARY_URL")
+
+// runCheckAuth confirms the service account may submit URLs of the site before a real run.
+// By default it makes a getMetadata call, which doesn't use the publish quota. With
+// -canary it publishes the canary URL, which proves publishing itself works.
+func runCheckAuth(args []string) {
+	fs := flag.NewFlagSet("check-auth", flag.ExitOnError)
+	url := fs.String("url", "", "URL to check, Default: the first sitemap URL")
+	canary := fs.Bool("canary", false, "Publish CANARY_URL instead of calling getMetadata")
+	fs.Parse(args)
+
+	client, err := newIndexingService()
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+
+	email := credentialsEmail()
+	if email != "" {
+		fmt.Println("Service account:", email)
+	}
+
+	if *canary {
+		if canaryUrl == "" {
+			log.Fatal("CANARY_URL is not set")
+			return
+		}
+		fmt.Println("Publishing canary URL:", canaryUrl)
+		_, err = client.UrlNotifications.Publish(&indexing.UrlNotification{Url: canaryUrl, Type: "URL_UPDATED"}).Do()
+		reportAuthCheck(err, email)
+		return
+	}
+
+	if *url == "" {
+		urls, err := parseSitemap(sitemapFile)
+		if err != nil {
+			log.Fatal("Error parsing sitemap:", err)
+			return
+		}
+		if len(urls) == 0 {
+			log.Fatal("The sitemap has no URLs, use -url")
+			return
+		}
+		*url = urls[0].Loc
+	}
+
+	fmt.Println("Checking URL:", *url)
+	_, err = client.UrlNotifications.GetMetadata().Url(normalizeUrl(*url)).Do()
+	// Not found only means Google never received a notification for the URL
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		err = nil
+	}
+	reportAuthCheck(err, email)
+}
+
+// reportAuthCheck prints the outcome of the check and exits with an error if it failed
+func reportAuthCheck(err error, email string) {
+	if err == nil {
+		fmt.Println("OK: the credentials are valid and the service account is an owner of the site")
+		return
+	}
+
+	switch classifyError(err) {
+	case errAuth, errOwnership:
+		account := "the service account"
+		if email != "" {
+			account = email
+		}
+		log.Fatalf("FAILED: %v\nAdd %s as an Owner of the property in Search Console (Settings > Users and permissions)", err, account)
+	default:
+		log.Fatalf("FAILED: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Clock is the source of time for the rate limiter, the scheduler and the daily
+// quota window, so their timing can be controlled in tests
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// clock is the Clock in use, the wall clock unless replaced
+var clock Clock = realClock{}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when something sleeps or waits, by the time
+// slept, so tests of pacing and daily quotas run instantly and deterministically
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock replaces the clock with a fake one starting at start until the test ends
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: start}
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.advance(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.advance(d)
+	return ch
+}
+
+// advance moves the time forward by d and returns the new time
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return c.now
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+
+	clock.Sleep(time.Minute)
+	if got := clock.Now(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Now after Sleep = %s, want %s", got, start.Add(time.Minute))
+	}
+	if got := <-clock.After(time.Hour); !got.Equal(start.Add(time.Hour + time.Minute)) {
+		t.Errorf("After fired at %s, want %s", got, start.Add(time.Hour+time.Minute))
+	}
+	clock.Sleep(-time.Second)
+	if got := c.Now(); !got.Equal(start.Add(time.Hour + time.Minute)) {
+		t.Errorf("negative Sleep moved the time to %s", got)
+	}
+}
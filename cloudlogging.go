@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+)
+
+// cloudLoggingSink ships log entries to Google Cloud Logging in batches
+type cloudLoggingSink struct {
+	service *logging.Service
+	logName string
+
+	mu      sync.Mutex
+	entries []*logging.LogEntry
+}
+
+// newCloudLoggingSink creates a sink using the Google credentials of the indexing client
+func newCloudLoggingSink() (*cloudLoggingSink, error) {
+	project, err := credentialsProject()
+	if err != nil {
+		return nil, err
+	}
+
+	opt, err := credentialsOption(logging.LoggingWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAuthenticatedClient(nil, opt, option.WithScopes(logging.LoggingWriteScope))
+	if err != nil {
+		return nil, err
+	}
+	service, err := logging.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &cloudLoggingSink{service: service, logName: "projects/" + project + "/logs/indexapi"}
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			sink.flush()
+		}
+	}()
+	return sink, nil
+}
+
+func (s *cloudLoggingSink) write(entry logEntry) {
+	payload := map[string]string{"message": entry.Message}
+	for k, v := range entry.Fields {
+		payload[k] = v
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.entries = append(s.entries, &logging.LogEntry{
+		Timestamp:   entry.Time.UTC().Format(time.RFC3339Nano),
+		Severity:    entry.Severity,
+		Labels:      entry.Labels,
+		JsonPayload: data,
+	})
+	full := len(s.entries) >= 100
+	s.mu.Unlock()
+
+	if full {
+		go s.flush()
+	}
+}
+
+func (s *cloudLoggingSink) flush() {
+	s.mu.Lock()
+	entries := s.entries
+	s.entries = nil
+	s.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	req := &logging.WriteLogEntriesRequest{
+		LogName:  s.logName,
+		Resource: &logging.MonitoredResource{Type: "global"},
+		Entries:  entries,
+	}
+	_, err := s.service.Entries.Write(req).Do()
+	if err != nil {
+		// Not logged through logMessage to avoid a loop
+		fmt.Fprintln(os.Stderr, "Error writing to Cloud Logging:", err)
+	}
+}
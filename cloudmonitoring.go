@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+// Cloud Monitoring settings
+var (
+	cloudMonitoring = os.Getenv("CLOUD_MONITORING")
+	gcpProject      = os.Getenv("GOOGLE_CLOUD_PROJECT")
+)
+
+// cloudMonitoringPusher writes metrics as custom metrics to Google Cloud Monitoring
+type cloudMonitoringPusher struct {
+	service *monitoring.Service
+	project string
+	start   time.Time
+	labels  map[string]string
+}
+
+// newCloudMonitoringPusher creates a pusher using the Google credentials of the indexing client
+func newCloudMonitoringPusher() (*cloudMonitoringPusher, error) {
+	project, err := credentialsProject()
+	if err != nil {
+		return nil, err
+	}
+
+	opt, err := credentialsOption(monitoring.MonitoringWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAuthenticatedClient(nil, opt, option.WithScopes(monitoring.MonitoringWriteScope))
+	if err != nil {
+		return nil, err
+	}
+	service, err := monitoring.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	if host, err := os.Hostname(); err == nil {
+		labels["host"] = host
+	}
+
+	return &cloudMonitoringPusher{service: service, project: project, start: time.Now(), labels: labels}, nil
+}
+
+// credentialsProject returns GOOGLE_CLOUD_PROJECT or the project of the service account key
+func credentialsProject() (string, error) {
+	if gcpProject != "" {
+		return gcpProject, nil
+	}
+
+	data, err := readCredentials()
+	if err != nil {
+		return "", fmt.Errorf("reading credentials: %w", err)
+	}
+	var key struct {
+		ProjectID string `json:"project_id"`
+	}
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return "", fmt.Errorf("parsing credentials: %w", err)
+	}
+	if key.ProjectID == "" {
+		return "", fmt.Errorf("no project_id in credentials, set GOOGLE_CLOUD_PROJECT")
+	}
+	return key.ProjectID, nil
+}
+
+func (p *cloudMonitoringPusher) push(s metricsSnapshot) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	resource := &monitoring.MonitoredResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": p.project},
+	}
+
+	var series []*monitoring.TimeSeries
+	add := func(name, kind string, value int64, startTime string) {
+		series = append(series, &monitoring.TimeSeries{
+			Metric: &monitoring.Metric{
+				Type:   "custom.googleapis.com/indexapi/" + name,
+				Labels: p.labels,
+			},
+			Resource:   resource,
+			MetricKind: kind,
+			ValueType:  "INT64",
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{StartTime: startTime, EndTime: now},
+				Value:    &monitoring.TypedValue{Int64Value: &value},
+			}},
+		})
+	}
+
+	start := p.start.UTC().Format(time.RFC3339Nano)
+	for _, name := range sortedKeys(s.counters) {
+		add(name, "CUMULATIVE", s.counters[name], start)
+	}
+	for _, name := range sortedKeys(s.gauges) {
+		add(name, "GAUGE", s.gauges[name], "")
+	}
+
+	req := &monitoring.CreateTimeSeriesRequest{TimeSeries: series}
+	_, err := p.service.Projects.TimeSeries.Create("projects/"+p.project, req).Do()
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// sitemapChange is a difference between two sitemap snapshots
+type sitemapChange struct {
+	Change      string
+	Url         string
+	FromLastmod string
+	ToLastmod   string
+}
+
+// runCompare reports URLs added, removed or with a changed lastmod between two archived snapshots
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	from := fs.String("from", "", "Date of the first snapshot, YYYY-MM-DD or RFC3339")
+	to := fs.String("to", "", "Date of the second snapshot, YYYY-MM-DD or RFC3339, Default: the latest snapshot")
+	format := fs.String("format", "text", "Output format: text or csv")
+	fs.Parse(args)
+
+	if *from == "" {
+		log.Fatal("The -from date is required")
+		return
+	}
+
+	archives, err := listArchives(archiveDirPath(sentFile))
+	if err != nil {
+		log.Fatal("Error listing snapshot archive:", err)
+		return
+	}
+
+	fromArchive, err := archiveAt(archives, *from)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	toArchive, err := archiveAt(archives, *to)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	fromSnapshot, err := readArchive(fromArchive.Path)
+	if err != nil {
+		log.Fatal("Error reading snapshot:", err)
+		return
+	}
+	toSnapshot, err := readArchive(toArchive.Path)
+	if err != nil {
+		log.Fatal("Error reading snapshot:", err)
+		return
+	}
+	changes := compareSnapshots(fromSnapshot, toSnapshot)
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	switch *format {
+	case "text":
+		fmt.Fprintf(w, "Comparing snapshot %s with %s\n", fromArchive.Time.Format(time.RFC3339), toArchive.Time.Format(time.RFC3339))
+		counts := map[string]int{}
+		for _, c := range changes {
+			counts[c.Change]++
+		}
+		for _, c := range changes {
+			switch c.Change {
+			case "added":
+				fmt.Fprintf(w, "+ %s\n", c.Url)
+			case "removed":
+				fmt.Fprintf(w, "- %s\n", c.Url)
+			case "lastmod":
+				fmt.Fprintf(w, "~ %s (%s -> %s)\n", c.Url, c.FromLastmod, c.ToLastmod)
+			}
+		}
+		fmt.Fprintf(w, "%d added, %d removed, %d with changed lastmod\n", counts["added"], counts["removed"], counts["lastmod"])
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"change", "url", "from_lastmod", "to_lastmod"})
+		for _, c := range changes {
+			cw.Write([]string{c.Change, c.Url, c.FromLastmod, c.ToLastmod})
+		}
+		cw.Flush()
+	default:
+		log.Fatalf("Unknown compare format %q", *format)
+	}
+}
+
+// archiveAt returns the latest archive taken on or before the given date, or the latest archive if date is empty
+func archiveAt(archives []snapshotArchive, date string) (snapshotArchive, error) {
+	if len(archives) == 0 {
+		return snapshotArchive{}, fmt.Errorf("no archived snapshots found")
+	}
+	if date == "" {
+		return archives[len(archives)-1], nil
+	}
+
+	// A plain date includes the whole day
+	until, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		day, dayErr := time.Parse("2006-01-02", date)
+		if dayErr != nil {
+			return snapshotArchive{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC3339", date)
+		}
+		until = day.Add(24*time.Hour - time.Second)
+	}
+
+	for i := len(archives) - 1; i >= 0; i-- {
+		if !archives[i].Time.After(until) {
+			return archives[i], nil
+		}
+	}
+	return snapshotArchive{}, fmt.Errorf("no snapshot archived on or before %s", date)
+}
+
+// compareSnapshots lists added, removed and changed lastmod URLs sorted by URL
+func compareSnapshots(from, to map[string]snapshotEntry) []sitemapChange {
+	var changes []sitemapChange
+	for url, entry := range to {
+		prev, ok := from[url]
+		if !ok {
+			changes = append(changes, sitemapChange{Change: "added", Url: url, ToLastmod: entry.Lastmod})
+		} else if prev.Lastmod != entry.Lastmod {
+			changes = append(changes, sitemapChange{Change: "lastmod", Url: url, FromLastmod: prev.Lastmod, ToLastmod: entry.Lastmod})
+		}
+	}
+	for url, entry := range from {
+		if _, ok := to[url]; !ok {
+			changes = append(changes, sitemapChange{Change: "removed", Url: url, FromLastmod: entry.Lastmod})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Url < changes[j].Url
+	})
+	return changes
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenControlSocket listens on a unix socket which only the owner can connect to. The
+// socket is created with a umask which leaves it 0600, so there is no moment in which
+// other users could connect before it is chmodded.
+func listenControlSocket(path string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
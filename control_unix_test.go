@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestControlSocketIsPrivate(t *testing.T) {
+	prev := controlSocket
+	controlSocket = filepath.Join(t.TempDir(), "indexapi.sock")
+	t.Cleanup(func() { controlSocket = prev })
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+
+	stop, err := startControlSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	info, err := os.Stat(controlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("control socket has mode %o, want 600", mode)
+	}
+	if restored := syscall.Umask(umask); restored != umask {
+		t.Errorf("umask is %o after starting the control socket, want %o", restored, umask)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// listenControlSocket listens on a unix socket. Windows has no file modes for it to set,
+// the socket is as accessible as the directory it is created in.
+func listenControlSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Crawler settings
+var (
+	crawlMaxDepth = os.Getenv("CRAWL_MAX_DEPTH")
+	crawlMaxPages = os.Getenv("CRAWL_MAX_PAGES")
+	crawlDelay    = os.Getenv("CRAWL_DELAY")
+)
+
+// crawlPrefix marks a source location as a site to crawl, e.g. crawl:https://example.com/
+const crawlPrefix = "crawl:"
+
+// crawlUserAgent is the robots.txt user agent obeyed by the crawler, besides *
+const crawlUserAgent = "indexapi"
+
+// crawlTarget is a page queued by the crawler with its distance from the root
+type crawlTarget struct {
+	url   string
+	depth int
+}
+
+// crawlSite discovers the pages of a site by following its internal links from the
+// root, for sites without a sitemap. Only pages on the root's host are visited, the
+// robots.txt rules are obeyed, and pages with noindex or a canonical URL pointing
+// elsewhere are followed but not returned.
+func crawlSite(root string) ([]Url, error) {
+	maxDepth, err := parseIntDefault(crawlMaxDepth, 3)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRAWL_MAX_DEPTH: %w", err)
+	}
+	maxPages, err := parseIntDefault(crawlMaxPages, 1000)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRAWL_MAX_PAGES: %w", err)
+	}
+	delay, err := parseDurationDefault(crawlDelay, 200*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRAWL_DELAY: %w", err)
+	}
+
+	base, err := url.Parse(root)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid crawl root %q", root)
+	}
+	robots, err := fetchRobotsRules(base)
+	if err != nil {
+		return nil, err
+	}
+	if robots.delay > delay {
+		delay = robots.delay
+	}
+
+	var urls []Url
+	start := normalizeUrl(root)
+	queue := []crawlTarget{{url: start}}
+	visited := map[string]struct{}{start: {}}
+	fetched := 0
+	for len(queue) > 0 && fetched < maxPages {
+		target := queue[0]
+		queue = queue[1:]
+
+		page, err := url.Parse(target.url)
+		if err != nil || !robots.allowed(page.RequestURI()) {
+			continue
+		}
+		if fetched > 0 {
+			clock.Sleep(delay)
+		}
+		fetched++
+
+		result, err := crawlPage(target.url)
+		if err != nil {
+			logURL(severityWarning, target.url, "Error crawling %s: %v", target.url, err)
+			continue
+		}
+		if result.index {
+			urls = append(urls, Url{Loc: target.url, Lastmod: result.lastmod})
+		}
+		if target.depth >= maxDepth && result.redirect == "" {
+			continue
+		}
+
+		links := result.links
+		depth := target.depth + 1
+		if result.redirect != "" {
+			// A redirect leads to the same page, so it doesn't count as a level
+			links, depth = []string{result.redirect}, target.depth
+		}
+		for _, link := range links {
+			ref, err := url.Parse(link)
+			if err != nil {
+				continue
+			}
+			next := page.ResolveReference(ref)
+			if (next.Scheme != "http" && next.Scheme != "https") || !strings.EqualFold(next.Host, base.Host) {
+				continue
+			}
+			loc := normalizeUrl(next.String())
+			if !contains(visited, loc) {
+				visited[loc] = struct{}{}
+				queue = append(queue, crawlTarget{url: loc, depth: depth})
+			}
+		}
+	}
+	logInfo("Crawled %d pages of %s, found %d indexable URLs", fetched, root, len(urls))
+	return urls, nil
+}
+
+// crawlResult is what the crawler learned from a page
+type crawlResult struct {
+	// index is set for HTML pages which may be submitted
+	index   bool
+	lastmod string
+	links   []string
+	// redirect is the target of a redirect response
+	redirect string
+}
+
+// crawlPage fetches a page without following redirects and extracts its links
+func crawlPage(pageUrl string) (crawlResult, error) {
+	var result crawlResult
+	res, err := preflightClient.Get(pageUrl)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 && res.StatusCode < 400 {
+		result.redirect = res.Header.Get("Location")
+		return result, nil
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return result, nil
+	}
+
+	noindex, nofollow := robotsDirectives(res.Header.Get("X-Robots-Tag"))
+	links, canonical, metaNoindex, metaNofollow := parsePageLinks(io.LimitReader(res.Body, maxPreflightBody))
+	result.index = !noindex && !metaNoindex
+	if !nofollow && !metaNofollow {
+		result.links = links
+	}
+	if canonical != "" {
+		ref, err := url.Parse(canonical)
+		if err == nil && normalizeUrl(res.Request.URL.ResolveReference(ref).String()) != pageUrl {
+			// The canonical page is submitted instead, if it's on the same host
+			result.index = false
+			result.links = append(result.links, canonical)
+		}
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		result.lastmod = t.UTC().Format(time.RFC3339)
+	}
+	return result, nil
+}
+
+// parsePageLinks returns the links of an HTML page, its canonical URL and the
+// noindex and nofollow directives of its robots meta tag. Links with rel=nofollow are left out.
+func parsePageLinks(r io.Reader) (links []string, canonical string, noindex, nofollow bool) {
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "a":
+				href := strings.TrimSpace(attr(token, "href"))
+				if href != "" && !hasToken(attr(token, "rel"), "nofollow") {
+					links = append(links, href)
+				}
+			case "link":
+				if hasToken(attr(token, "rel"), "canonical") && canonical == "" {
+					canonical = strings.TrimSpace(attr(token, "href"))
+				}
+			case "meta":
+				name := strings.ToLower(attr(token, "name"))
+				if name == "robots" || name == crawlUserAgent {
+					i, f := robotsDirectives(attr(token, "content"))
+					noindex, nofollow = noindex || i, nofollow || f
+				}
+			}
+		}
+	}
+}
+
+// robotsDirectives parses the noindex and nofollow directives of a robots meta tag or X-Robots-Tag header
+func robotsDirectives(value string) (noindex, nofollow bool) {
+	for _, directive := range strings.Split(strings.ToLower(value), ",") {
+		switch strings.TrimSpace(directive) {
+		case "noindex":
+			noindex = true
+		case "nofollow":
+			nofollow = true
+		case "none":
+			noindex, nofollow = true, true
+		}
+	}
+	return noindex, nofollow
+}
+
+// hasToken checks if a space separated attribute value contains a token
+func hasToken(value, token string) bool {
+	for _, field := range strings.Fields(value) {
+		if strings.EqualFold(field, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// robotsRule is an Allow or Disallow rule of robots.txt
+type robotsRule struct {
+	allow   bool
+	length  int
+	pattern *regexp.Regexp
+}
+
+// robotsRules are the robots.txt rules which apply to the crawler
+type robotsRules struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+// fetchRobotsRules reads the robots.txt of a site. A missing robots.txt allows
+// everything, a server error stops the crawl as the site may not want to be crawled.
+func fetchRobotsRules(base *url.URL) (robotsRules, error) {
+	robotsUrl := base.ResolveReference(&url.URL{Path: "/robots.txt"}).String()
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(robotsUrl)
+	if err != nil {
+		return robotsRules{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 && res.StatusCode < 500 {
+		return robotsRules{}, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return robotsRules{}, fmt.Errorf("fetching %s: status code %d", robotsUrl, res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxPreflightBody))
+	if err != nil {
+		return robotsRules{}, err
+	}
+	return parseRobotsRules(data, crawlUserAgent), nil
+}
+
+// parseRobotsRules returns the rules of the group for the user agent, or of the * group if there is none
+func parseRobotsRules(data []byte, agent string) robotsRules {
+	groups := map[string]*robotsRules{}
+	var current []string
+	inRules := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+
+		switch name {
+		case "user-agent":
+			if inRules {
+				current, inRules = nil, false
+			}
+			ua := strings.ToLower(value)
+			current = append(current, ua)
+			if groups[ua] == nil {
+				groups[ua] = &robotsRules{}
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: name == "allow", length: len(value), pattern: robotsPattern(value)}
+			for _, ua := range current {
+				groups[ua].rules = append(groups[ua].rules, rule)
+			}
+		case "crawl-delay":
+			inRules = true
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			for _, ua := range current {
+				groups[ua].delay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	if rules, ok := groups[strings.ToLower(agent)]; ok {
+		return *rules
+	}
+	if rules, ok := groups["*"]; ok {
+		return *rules
+	}
+	return robotsRules{}
+}
+
+// robotsPattern converts a robots.txt path pattern, where * matches any characters
+// and a trailing $ anchors the end, to a regular expression
+func robotsPattern(value string) *regexp.Regexp {
+	anchored := strings.HasSuffix(value, "$")
+	value = strings.TrimSuffix(value, "$")
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// allowed checks if a path may be crawled, the longest matching rule wins and Allow wins ties
+func (r robotsRules) allowed(path string) bool {
+	best := robotsRule{allow: true, length: -1}
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > best.length || rule.length == best.length && rule.allow {
+			best = rule
+		}
+	}
+	return best.allow
+}
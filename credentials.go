@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// credentialsJSON is the service account key itself or a reference to a secret holding it,
+// for containers where no key file can be mounted. It takes precedence over
+// GOOGLE_APPLICATION_CREDENTIALS.
+var credentialsJSON = os.Getenv("GOOGLE_CREDENTIALS_JSON")
+
+// Service account to impersonate through the IAM Credentials API, so operators can run with
+// their own identity instead of a key file, and the chain of accounts to delegate through
+var (
+	impersonateServiceAccount = os.Getenv("IMPERSONATE_SERVICE_ACCOUNT")
+	impersonateDelegates      = os.Getenv("IMPERSONATE_DELEGATES")
+)
+
+// readCredentials returns the content of GOOGLE_CREDENTIALS_JSON, which may be base64
+// encoded as CI secrets often are or fetched from a secret manager, or of the file in
+// GOOGLE_APPLICATION_CREDENTIALS
+func readCredentials() ([]byte, error) {
+	if credentialsJSON == "" {
+		return os.ReadFile(credentialsFile)
+	}
+	if isSecretRef(credentialsJSON) {
+		return fetchSecret(credentialsJSON)
+	}
+	data := bytes.TrimSpace([]byte(credentialsJSON))
+	if bytes.HasPrefix(data, []byte("{")) {
+		return data, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("GOOGLE_CREDENTIALS_JSON is neither JSON nor base64: %w", err)
+	}
+	return decoded, nil
+}
+
+// credentialsOption returns the client option authenticating with GOOGLE_CREDENTIALS_JSON
+// or the file in GOOGLE_APPLICATION_CREDENTIALS, which falls back to the application default
+// credentials if unset. With IMPERSONATE_SERVICE_ACCOUNT, those credentials only obtain
+// short-lived tokens of that service account for the scopes. A user logged in with
+// OAUTH_CLIENT_FILE is authenticated by their own token, which has fixed scopes.
+func credentialsOption(scopes ...string) (option.ClientOption, error) {
+	if oauthClientFile != "" {
+		ts, err := oauthTokenSource()
+		if err != nil {
+			return nil, err
+		}
+		return option.WithTokenSource(ts), nil
+	}
+
+	base := option.WithCredentialsFile(credentialsFile)
+	if credentialsJSON != "" {
+		data, err := readCredentials()
+		if err != nil {
+			return nil, err
+		}
+		base = option.WithCredentialsJSON(data)
+	}
+	if impersonateServiceAccount == "" {
+		return base, nil
+	}
+
+	config := impersonate.CredentialsConfig{TargetPrincipal: impersonateServiceAccount, Scopes: scopes}
+	for _, delegate := range strings.Split(impersonateDelegates, ",") {
+		if delegate = strings.TrimSpace(delegate); delegate != "" {
+			config.Delegates = append(config.Delegates, delegate)
+		}
+	}
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), config, base)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %w", impersonateServiceAccount, err)
+	}
+	return option.WithTokenSource(ts), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"sync/atomic"
+)
+
+// apiDebug logs the full requests and responses of API calls when "true"
+var apiDebug = os.Getenv("API_DEBUG")
+
+// redactedHeaders and redactedParams match credentials in dumped requests
+var (
+	redactedHeaders = regexp.MustCompile(`(?im)^((?:Proxy-)?Authorization|X-Goog-Api-Key):.*$`)
+	redactedParams  = regexp.MustCompile(`([?&](?:key|access_token)=)[^&\s]+`)
+)
+
+// debugTransport logs every request and response passing through it with credentials
+// redacted. A request and its response share a number, as concurrent calls interleave.
+type debugTransport struct {
+	base http.RoundTripper
+	seq  atomic.Int64
+}
+
+// withDebugLogging wraps a transport in a debugTransport if API_DEBUG is set
+func withDebugLogging(base http.RoundTripper) http.RoundTripper {
+	if apiDebug != "true" {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &debugTransport{base: base}
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := t.seq.Add(1)
+	dump, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		logDebug("API request #%d: dumping failed: %v", n, err)
+	} else {
+		logDebug("API request #%d:\n%s", n, redact(dump))
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		logDebug("API response #%d: %v", n, err)
+		return nil, err
+	}
+	dump, err = httputil.DumpResponse(res, true)
+	if err != nil {
+		logDebug("API response #%d: dumping failed: %v", n, err)
+	} else {
+		logDebug("API response #%d:\n%s", n, redact(dump))
+	}
+	return res, nil
+}
+
+// redact replaces credentials in a dumped request or response
+func redact(dump []byte) string {
+	dump = redactedHeaders.ReplaceAll(dump, []byte("$1: REDACTED"))
+	dump = redactedParams.ReplaceAll(dump, []byte("${1}REDACTED"))
+	return string(dump)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Decay policy settings
+var (
+	decayHorizon = os.Getenv("DECAY_HORIZON")
+	decayFile    = os.Getenv("DECAY_FILE")
+)
+
+// lastmodLayouts are the W3C datetime formats allowed in sitemaps
+var lastmodLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseLastmod parses a sitemap lastmod date
+func parseLastmod(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range lastmodLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// decayFilePath returns the path of the file of decayed URLs, which defaults to decayed.csv next to the sent file
+func decayFilePath(sentFile string) string {
+	if decayFile != "" {
+		return decayFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "decayed.csv")
+}
+
+// decayNotifications drops URL_UPDATED notifications of URLs which decayed. A URL decays
+// when its lastmod, or the time it was first seen in the sitemap if it has none, is
+// older than DECAY_HORIZON. Decayed URLs are recorded in the decay file and never
+// considered again, even if the horizon changes.
+func decayNotifications(notifications []notification, sentFile string) ([]notification, error) {
+	path := decayFilePath(sentFile)
+	decayed, err := readCsv(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var horizon time.Duration
+	var firstSeen map[string]snapshotEntry
+	if decayHorizon != "" {
+		horizon, err = time.ParseDuration(decayHorizon)
+		if err != nil {
+			return nil, fmt.Errorf("parsing DECAY_HORIZON: %w", err)
+		}
+		firstSeen, err = readSnapshot(snapshotFilePath(sentFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var kept []notification
+	var newlyDecayed [][]string
+	now := clock.Now()
+	for _, n := range notifications {
+		if n.Type != "URL_UPDATED" {
+			kept = append(kept, n)
+			continue
+		}
+		if contains(decayed, n.Url) {
+			continue
+		}
+		if horizon > 0 {
+			age, reason := time.Time{}, ""
+			if t, ok := parseLastmod(n.Lastmod); ok {
+				age, reason = t, "lastmod "+n.Lastmod
+			} else if entry, ok := firstSeen[n.Url]; ok && !entry.FirstSeen.IsZero() {
+				age, reason = entry.FirstSeen, "first seen "+entry.FirstSeen.Format(time.RFC3339)
+			}
+			if !age.IsZero() && now.Sub(age) > horizon {
+				logURL(severityInfo, n.Url, "URL %s decayed, %s is older than %s", n.Url, reason, horizon)
+				decayed[n.Url] = struct{}{}
+				newlyDecayed = append(newlyDecayed, []string{n.Url, now.Format(time.RFC3339), reason})
+				continue
+			}
+		}
+		kept = append(kept, n)
+	}
+
+	if len(newlyDecayed) == 0 || readOnly == "true" {
+		return kept, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	writer.WriteAll(newlyDecayed)
+	return kept, writer.Error()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+// runDelete sends URL_DELETED for the URLs given as arguments or listed in a file
+// and records the deletions in the sent file. A deleted URL which comes back to the
+// sitemap later is submitted again as URL_UPDATED.
+func runDelete(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	file := fs.String("file", "", "Path of a file with one URL per line to delete")
+	force := fs.Bool("force", false, "Delete URLs again which were already deleted")
+	fs.Parse(args)
+
+	source := "delete"
+	urls := fs.Args()
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatal("Error reading URLs to delete:", err)
+			return
+		}
+		for _, url := range parseTextList(data) {
+			urls = append(urls, url.Loc)
+		}
+		source = "delete:" + *file
+	}
+	if len(urls) == 0 {
+		log.Fatal("Usage: indexapi delete [-file urls.txt] [<url>...]")
+		return
+	}
+
+	lastSent, err := lastSentTimes(sentFile)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+
+	var notifications []notification
+	queued := map[string]struct{}{}
+	for _, arg := range urls {
+		url := normalizeUrl(arg)
+		if contains(queued, url) {
+			continue
+		}
+		queued[url] = struct{}{}
+		if isDeleted(lastSent, url) && !*force {
+			logURL(severityInfo, url, "Skipping already deleted URL %s", url)
+			continue
+		}
+		notifications = append(notifications, notification{Url: url, Type: "URL_DELETED", Source: source, Reason: "delete command"})
+	}
+
+	client, limits, cleanup, err := setupSubmission()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	defer cleanup()
+
+	run := startRun("delete")
+	setLogLabel("run_id", run.ID)
+	logInfo("Run ID: %s", run.ID)
+	stats, submitErr := submitUrls(interruptContext(), client, notifications, sentFile, run.ID, limits)
+	err = finishRun(runsFilePath(sentFile), run, stats)
+	if err != nil {
+		logError("Error recording run: %v", err)
+	}
+	checkpointState()
+	if submitErr != nil {
+		log.Fatal("Error submitting URLs:", submitErr)
+		return
+	}
+	logInfo("Finish. Deleted %d URLs from Google Index API", stats.Sent)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Error handling settings
+var (
+	maxRetries     = os.Getenv("MAX_RETRIES")
+	retryDelay     = os.Getenv("RETRY_DELAY")
+	retryBackoff   = os.Getenv("RETRY_BACKOFF")
+	retryMaxDelay  = os.Getenv("RETRY_MAX_DELAY")
+	retryJitter    = os.Getenv("RETRY_JITTER")
+	quotaPause     = os.Getenv("QUOTA_PAUSE")
+	retryBudget    = os.Getenv("RETRY_BUDGET")
+	deadLetterFile = os.Getenv("DEAD_LETTER_FILE")
+	retryQueueFile = os.Getenv("RETRY_QUEUE_FILE")
+)
+
+// errorCategory decides how a failed API call is handled
+type errorCategory string
+
+const (
+	// errRetryable are transport errors and server errors, the call is retried
+	errRetryable errorCategory = "retryable"
+	// errQuota means the API quota is exhausted, submissions pause before retrying
+	errQuota errorCategory = "quota"
+	// errAuth means the credentials don't work, the run is aborted
+	errAuth errorCategory = "auth"
+	// errInvalidInput means the request was rejected, the URL is dead-lettered
+	errInvalidInput errorCategory = "invalid-input"
+	// errOwnership means the service account doesn't own the URL's property, the URL is dead-lettered
+	errOwnership errorCategory = "ownership"
+)
+
+// permanent checks if a call failing with the category fails the same way when it's repeated
+func (c errorCategory) permanent() bool {
+	return c == errInvalidInput || c == errOwnership
+}
+
+// classifyError maps an error of an API call to a category
+func classifyError(err error) errorCategory {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return errAuth
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		// Transport errors like timeouts and connection resets
+		return errRetryable
+	}
+
+	message := strings.ToLower(apiErr.Message)
+	reasons := ""
+	for _, item := range apiErr.Errors {
+		reasons += " " + strings.ToLower(item.Reason)
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests,
+		strings.Contains(reasons, "ratelimitexceeded"),
+		strings.Contains(reasons, "quotaexceeded"),
+		strings.Contains(message, "quota exceeded"):
+		return errQuota
+	case apiErr.Code == http.StatusForbidden && strings.Contains(message, "ownership"):
+		return errOwnership
+	case apiErr.Code == http.StatusUnauthorized, apiErr.Code == http.StatusForbidden:
+		return errAuth
+	case apiErr.Code == http.StatusRequestTimeout, apiErr.Code >= 500:
+		return errRetryable
+	default:
+		return errInvalidInput
+	}
+}
+
+// retryAfter returns the delay the API asked for before the next call, from the Retry-After
+// header or the RetryInfo error detail
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if value := apiErr.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(value); err == nil {
+			return max(t.Sub(clock.Now()), 0), true
+		}
+	}
+	for _, detail := range apiErr.Details {
+		info, ok := detail.(map[string]interface{})
+		if !ok || !strings.HasSuffix(fmt.Sprint(info["@type"]), "google.rpc.RetryInfo") {
+			continue
+		}
+		delay, ok := info["retryDelay"].(string)
+		if !ok {
+			continue
+		}
+		if d, err := time.ParseDuration(delay); err == nil {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// retryPolicy describes how failed API calls are retried
+type retryPolicy struct {
+	maxRetries int
+	retryDelay time.Duration
+	// backoff multiplies the retry delay after every retry, up to maxDelay
+	backoff  float64
+	maxDelay time.Duration
+	// jitter is the fraction by which a retry delay is randomly shortened or lengthened
+	jitter     float64
+	quotaPause time.Duration
+	// budget is the number of retries a run may make, or with budgetPercent the
+	// percentage of its requests, -1 means unlimited
+	budget        int
+	budgetPercent bool
+}
+
+// loadRetryPolicy reads the retry policy from environment variables
+func loadRetryPolicy() (retryPolicy, error) {
+	var p retryPolicy
+	var err error
+	p.maxRetries, err = parseIntDefault(maxRetries, 3)
+	if err != nil {
+		return p, fmt.Errorf("parsing MAX_RETRIES: %w", err)
+	}
+	p.retryDelay, err = parseDurationDefault(retryDelay, 10*time.Second)
+	if err != nil {
+		return p, fmt.Errorf("parsing RETRY_DELAY: %w", err)
+	}
+	p.backoff, err = parseFloatDefault(retryBackoff, 2)
+	if err != nil {
+		return p, fmt.Errorf("parsing RETRY_BACKOFF: %w", err)
+	}
+	if p.backoff < 1 {
+		return p, fmt.Errorf("RETRY_BACKOFF must be at least 1")
+	}
+	p.maxDelay, err = parseDurationDefault(retryMaxDelay, 5*time.Minute)
+	if err != nil {
+		return p, fmt.Errorf("parsing RETRY_MAX_DELAY: %w", err)
+	}
+	p.jitter, err = parseFloatDefault(retryJitter, 0.2)
+	if err != nil {
+		return p, fmt.Errorf("parsing RETRY_JITTER: %w", err)
+	}
+	if p.jitter < 0 || p.jitter > 1 {
+		return p, fmt.Errorf("RETRY_JITTER must be between 0 and 1")
+	}
+	p.quotaPause, err = parseDurationDefault(quotaPause, time.Minute)
+	if err != nil {
+		return p, fmt.Errorf("parsing QUOTA_PAUSE: %w", err)
+	}
+	p.budgetPercent = strings.HasSuffix(retryBudget, "%")
+	p.budget, err = parseIntDefault(strings.TrimSuffix(retryBudget, "%"), -1)
+	if err != nil {
+		return p, fmt.Errorf("parsing RETRY_BUDGET: %w", err)
+	}
+	return p, nil
+}
+
+// delay returns how long to wait before a retry of a call which failed with the category
+// after the given number of retries. Retry delays grow exponentially with random jitter,
+// so calls which failed together don't all retry at the same moment.
+func (p retryPolicy) delay(category errorCategory, retries int) time.Duration {
+	if category == errQuota {
+		return p.quotaPause
+	}
+	delay := float64(p.retryDelay) * math.Pow(p.backoff, float64(retries))
+	if p.maxDelay > 0 && delay > float64(p.maxDelay) {
+		delay = float64(p.maxDelay)
+	}
+	delay *= 1 + p.jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// retryLimiter counts the retries of a run against the retry budget, so a systemic
+// failure doesn't turn every request into several doomed API calls
+type retryLimiter struct {
+	mu        sync.Mutex
+	remaining int
+	exhausted bool
+}
+
+// newRetryLimiter creates the retry budget of a run which makes the given number of requests
+func newRetryLimiter(p retryPolicy, requests int) *retryLimiter {
+	remaining := p.budget
+	if p.budgetPercent && requests < 0 {
+		remaining = 0
+	} else if p.budgetPercent {
+		remaining = (requests*p.budget + 99) / 100
+	}
+	return &retryLimiter{remaining: remaining}
+}
+
+// take uses one retry of the budget, returning false if it is used up
+func (r *retryLimiter) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remaining < 0 {
+		return true
+	}
+	if r.remaining == 0 {
+		if !r.exhausted {
+			r.exhausted = true
+			logWarning("Retry budget of the run is used up, failed API calls are no longer retried")
+		}
+		return false
+	}
+	r.remaining--
+	return true
+}
+
+// String describes the remaining budget for logs
+func (r *retryLimiter) String() string {
+	if r.remaining < 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(r.remaining)
+}
+
+// deadLetterFilePath returns the path of the dead letter file, which defaults to dead_letter.csv next to the sent file
+func deadLetterFilePath(sentFile string) string {
+	if deadLetterFile != "" {
+		return deadLetterFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "dead_letter.csv")
+}
+
+// retryQueueFilePath returns the path of the retry queue, which defaults to retry_queue.csv next to the sent file
+func retryQueueFilePath(sentFile string) string {
+	if retryQueueFile != "" {
+		return retryQueueFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "retry_queue.csv")
+}
+
+// appendFailure records a notification which can't be sent without manual intervention in
+// the dead letter file. The retry queue has the same format and records notifications
+// which failed with transient errors.
+func appendFailure(filePath string, f failedNotification) error {
+	return appendCsvRow(filePath, ',', []string{f.Url, f.Time.Format(time.RFC3339), f.Type, string(f.Category), f.Error, f.RunID})
+}
+
+// failedNotification is a row of the dead letter file or the retry queue
+type failedNotification struct {
+	Url      string
+	Time     time.Time
+	Type     string
+	Category errorCategory
+	Error    string
+	RunID    string
+}
+
+// failure describes a notification which failed with an error
+func failure(n notification, category errorCategory, runID string, cause error) failedNotification {
+	return failedNotification{Url: n.Url, Time: clock.Now(), Type: n.Type, Category: category, Error: cause.Error(), RunID: runID}
+}
+
+// readFailures reads the dead letter file or the retry queue, which is empty if it doesn't exist
+func readFailures(filePath string) ([]failedNotification, error) {
+	file, err := readState(filePath, false)
+	if err != nil {
+		return nil, err
+	}
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	failures := make([]failedNotification, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 6 {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, row[1])
+		failures = append(failures, failedNotification{Url: normalizeUrl(row[0]), Time: t, Type: row[2],
+			Category: errorCategory(row[3]), Error: row[4], RunID: row[5]})
+	}
+	return failures, nil
+}
+
+// applyFailures drops pending notifications which failed permanently, so they aren't
+// retried until they are removed from the dead letter file, and queues notifications
+// which failed with transient errors and weren't sent since, e.g. ones from a plan
+// or a deletion which no sitemap brings back
+func applyFailures(pending []notification, sentFile string, lastSent map[string]time.Time) ([]notification, error) {
+	store := storeFor(sentFile)
+	deadLetters, err := store.Failures(queueDeadLetter)
+	if err != nil {
+		return nil, fmt.Errorf("reading dead letter file: %w", err)
+	}
+	retryQueue, err := store.Failures(queueRetry)
+	if err != nil {
+		return nil, fmt.Errorf("reading retry queue: %w", err)
+	}
+
+	dead := map[string]failedNotification{}
+	for _, f := range deadLetters {
+		dead[sentKey(f.Url, f.Type)] = f
+	}
+	var kept []notification
+	queued := map[string]struct{}{}
+	for _, n := range pending {
+		key := sentKey(n.Url, n.Type)
+		if f, ok := dead[key]; ok {
+			logURL(severityInfo, n.Url, "Skipping %s %s, it failed permanently (%s): %s", n.Type, n.Url, f.Category, f.Error)
+			continue
+		}
+		queued[key] = struct{}{}
+		kept = append(kept, n)
+	}
+	if skipped := len(pending) - len(kept); skipped > 0 {
+		logInfo("Skipped %d URLs in the dead letter file", skipped)
+	}
+
+	for _, f := range retryQueue {
+		key := sentKey(f.Url, f.Type)
+		_, isDead := dead[key]
+		if contains(queued, key) || isDead || lastSent[key].After(f.Time) {
+			continue
+		}
+		queued[key] = struct{}{}
+		kept = append(kept, notification{Url: f.Url, Type: f.Type, Priority: 0.5,
+			Reason: fmt.Sprintf("failed with a transient error (%s) in run %s", f.Category, f.RunID)})
+	}
+	return kept, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sectionEstimate is the projected progress of one section of the backlog
+type sectionEstimate struct {
+	urls      int
+	completes time.Time
+}
+
+// runEstimate projects when the current backlog will be fully submitted, overall
+// and per section, from the daily quota and the interval between runs
+func runEstimate(args []string) {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	every := fs.Duration("every", 24*time.Hour, "Interval between scheduled runs")
+	by := fs.String("by", "section", "Group the backlog by section, the first path segment, or by locale")
+	fs.Parse(args)
+
+	if *every <= 0 {
+		log.Fatal("The interval between runs must be positive")
+		return
+	}
+	if *by != "section" && *by != "locale" {
+		log.Fatalf("Unknown grouping %q, use section or locale", *by)
+		return
+	}
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if limits.perDay <= 0 {
+		log.Fatal("RATE_LIMIT_PER_DAY must be positive to estimate the backlog")
+		return
+	}
+	notifications, _, err := loadPending()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	todayAlreadySent, _, err := stateStore.SentToday()
+	if err != nil {
+		log.Fatal("Error reading today's sent URLs:", err)
+		return
+	}
+
+	// Runs send in backlog order until the day's quota is used up
+	used := map[string]int{clock.Now().Format("2006-01-02"): todayAlreadySent}
+	sections := map[string]*sectionEstimate{}
+	var done time.Time
+	runAt := clock.Now()
+	for i := 0; i < len(notifications); runAt = runAt.Add(*every) {
+		date := runAt.Format("2006-01-02")
+		for ; i < len(notifications) && used[date] < limits.dailyQuota(); i++ {
+			used[date]++
+			name := notifications[i].Locale
+			if *by == "section" {
+				name = urlSection(notifications[i].Url)
+			}
+			if sections[name] == nil {
+				sections[name] = &sectionEstimate{}
+			}
+			sections[name].urls++
+			sections[name].completes = runAt
+			done = runAt
+		}
+	}
+
+	fmt.Printf("Backlog:     %d URLs\n", len(notifications))
+	fmt.Printf("Daily quota: %d (%d left today)\n", limits.perDay, max(limits.perDay-todayAlreadySent, 0))
+	if len(notifications) == 0 {
+		return
+	}
+	fmt.Printf("Completes:   %s (in %d days)\n", done.Format("2006-01-02"), daysBetween(clock.Now(), done))
+
+	fmt.Printf("\n%-40s %8s %s\n", strings.ToUpper(*by), "URLS", "COMPLETES")
+	for _, name := range sortedKeys(sections) {
+		s := sections[name]
+		fmt.Printf("%-40s %8d %s\n", name, s.urls, s.completes.Format("2006-01-02"))
+	}
+}
+
+// urlSection returns the first path segment of a URL, e.g. /blog
+func urlSection(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "/"
+	}
+	segment, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	return "/" + segment
+}
+
+// daysBetween counts the calendar days from one time to another
+func daysBetween(from, to time.Time) int {
+	y, m, d := from.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	y, m, d = to.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
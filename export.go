@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// exportRecord is a sent record in the export formats
+type exportRecord struct {
+	Url            string    `json:"url"`
+	Time           time.Time `json:"time"`
+	RunID          string    `json:"run_id"`
+	Type           string    `json:"type"`
+	Source         string    `json:"source"`
+	Lastmod        string    `json:"lastmod"`
+	Status         int       `json:"status"`
+	ResponseTimeMs int64     `json:"response_time_ms"`
+	Title          string    `json:"title"`
+	Canonical      string    `json:"canonical"`
+	Published      string    `json:"published"`
+	H1             string    `json:"h1"`
+	Locale         string    `json:"locale"`
+	Key            string    `json:"key"`
+	Images         int       `json:"images"`
+	Videos         int       `json:"videos"`
+	NotifyTime     string    `json:"notify_time"`
+	LatestUpdate   string    `json:"latest_update"`
+	LatestRemove   string    `json:"latest_remove"`
+}
+
+// runExport writes the submission history in CSV, JSON Lines or Parquet format
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "Export format: csv, jsonl or parquet")
+	out := fs.String("out", "-", "Path of the file to write, - for stdout")
+	fs.Parse(args)
+
+	records, err := readSentHistory(sentFile)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal("Error creating export file:", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+
+	switch *format {
+	case "csv":
+		err = exportCsv(bw, records)
+	case "jsonl":
+		err = exportJsonl(bw, records)
+	case "parquet":
+		err = exportParquet(bw, records)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatal("Error exporting sent URLs:", err)
+		return
+	}
+}
+
+func toExportRecord(rec sentRecord) exportRecord {
+	return exportRecord{
+		Url:            rec.Url,
+		Time:           rec.Time,
+		RunID:          rec.RunID,
+		Type:           rec.Type,
+		Source:         rec.Source,
+		Lastmod:        rec.Lastmod,
+		Status:         rec.Status,
+		ResponseTimeMs: rec.ResponseTime.Milliseconds(),
+		Title:          rec.Title,
+		Canonical:      rec.Canonical,
+		Published:      rec.Published,
+		H1:             rec.H1,
+		Locale:         rec.Locale,
+		Key:            rec.Key,
+		Images:         rec.Images,
+		Videos:         rec.Videos,
+		NotifyTime:     rec.NotifyTime,
+		LatestUpdate:   rec.LatestUpdate,
+		LatestRemove:   rec.LatestRemove,
+	}
+}
+
+func exportCsv(w io.Writer, records []sentRecord) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"url", "time", "run_id", "type", "source", "lastmod", "status", "response_time_ms", "title", "canonical", "published", "h1", "locale", "key", "images", "videos", "notify_time", "latest_update", "latest_remove"})
+	for _, rec := range records {
+		r := toExportRecord(rec)
+		writer.Write([]string{
+			r.Url,
+			r.Time.Format(time.RFC3339),
+			r.RunID,
+			r.Type,
+			r.Source,
+			r.Lastmod,
+			strconv.Itoa(r.Status),
+			strconv.FormatInt(r.ResponseTimeMs, 10),
+			r.Title,
+			r.Canonical,
+			r.Published,
+			r.H1,
+			r.Locale,
+			r.Key,
+			strconv.Itoa(r.Images),
+			strconv.Itoa(r.Videos),
+			r.NotifyTime,
+			r.LatestUpdate,
+			r.LatestRemove,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func exportJsonl(w io.Writer, records []sentRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, rec := range records {
+		err := encoder.Encode(toExportRecord(rec))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportParquet(w io.Writer, records []sentRecord) error {
+	pw := newParquetWriter(
+		&parquetColumn{Name: "url", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "time", Type: parquetInt64, ConvertedType: parquetTimestampMillis},
+		&parquetColumn{Name: "run_id", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "type", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "source", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "lastmod", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "status", Type: parquetInt32, ConvertedType: -1},
+		&parquetColumn{Name: "response_time_ms", Type: parquetInt64, ConvertedType: -1},
+		&parquetColumn{Name: "title", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "canonical", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "published", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "h1", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "locale", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "key", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "images", Type: parquetInt32, ConvertedType: -1},
+		&parquetColumn{Name: "videos", Type: parquetInt32, ConvertedType: -1},
+		&parquetColumn{Name: "notify_time", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "latest_update", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "latest_remove", Type: parquetByteArray, ConvertedType: parquetUTF8},
+	)
+	for _, rec := range records {
+		r := toExportRecord(rec)
+		pw.add(r.Url, r.Time.UnixMilli(), r.RunID, r.Type, r.Source, r.Lastmod, int32(r.Status), r.ResponseTimeMs, r.Title, r.Canonical, r.Published, r.H1, r.Locale, r.Key, int32(r.Images), int32(r.Videos), r.NotifyTime, r.LatestUpdate, r.LatestRemove)
+	}
+	return pw.writeTo(w)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/indexing/v3"
+)
+
+// fakeAPI is an in-process imitation of Google Index API used for simulations
+type fakeAPI struct {
+	// latency is the average response time, the actual one varies by ±50%
+	latency time.Duration
+	// errorRate is the share of requests failing with a 500 error
+	errorRate float64
+	// chaos are the rates of injected faults, see parseChaos
+	chaos chaosRates
+
+	mu       sync.Mutex
+	metadata map[string]*indexing.UrlNotificationMetadata
+}
+
+// newFakeAPI creates a fake API with the given latency and error rate
+func newFakeAPI(latency time.Duration, errorRate float64) *fakeAPI {
+	return &fakeAPI{
+		latency:   latency,
+		errorRate: errorRate,
+		metadata:  map[string]*indexing.UrlNotificationMetadata{},
+	}
+}
+
+// start runs the fake API on a local port, the caller must close the server
+func (f *fakeAPI) start() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/urlNotifications:publish", f.publish)
+	mux.HandleFunc("/v3/urlNotifications/metadata", f.getMetadata)
+	mux.HandleFunc("/batch", f.batch)
+	return httptest.NewServer(mux)
+}
+
+// delay sleeps for a random time around the configured latency
+func (f *fakeAPI) delay() {
+	if f.latency > 0 {
+		time.Sleep(f.latency/2 + time.Duration(rand.Int63n(int64(f.latency))))
+	}
+}
+
+func (f *fakeAPI) publish(w http.ResponseWriter, r *http.Request) {
+	f.delay()
+	f.handlePublish(w, r)
+}
+
+// handlePublish answers a publish call, without the latency so batches only add it once
+func (f *fakeAPI) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeFakeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if f.injectFault(w, r) {
+		return
+	}
+	if rand.Float64() < f.errorRate {
+		writeFakeError(w, http.StatusInternalServerError, "Internal error encountered.")
+		return
+	}
+
+	var n indexing.UrlNotification
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err != nil || n.Url == "" {
+		writeFakeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if n.Type != "URL_UPDATED" && n.Type != "URL_DELETED" {
+		writeFakeError(w, http.StatusBadRequest, "Invalid value at 'url_notification.type'")
+		return
+	}
+	n.NotifyTime = time.Now().UTC().Format(time.RFC3339Nano)
+
+	f.mu.Lock()
+	meta, ok := f.metadata[n.Url]
+	if !ok {
+		meta = &indexing.UrlNotificationMetadata{Url: n.Url}
+		f.metadata[n.Url] = meta
+	}
+	if n.Type == "URL_UPDATED" {
+		meta.LatestUpdate = &n
+	} else {
+		meta.LatestRemove = &n
+	}
+	res := indexing.PublishUrlNotificationResponse{UrlNotificationMetadata: meta}
+	data, err := json.Marshal(res)
+	f.mu.Unlock()
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (f *fakeAPI) getMetadata(w http.ResponseWriter, r *http.Request) {
+	f.delay()
+	if f.injectFault(w, r) {
+		return
+	}
+	if rand.Float64() < f.errorRate {
+		writeFakeError(w, http.StatusInternalServerError, "Internal error encountered.")
+		return
+	}
+
+	f.mu.Lock()
+	meta, ok := f.metadata[r.URL.Query().Get("url")]
+	var data []byte
+	var err error
+	if ok {
+		data, err = json.Marshal(meta)
+	}
+	f.mu.Unlock()
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// batch answers a multipart batch request by handling each publish call it contains
+func (f *fakeAPI) batch(w http.ResponseWriter, r *http.Request) {
+	f.delay()
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		writeFakeError(w, http.StatusBadRequest, "Invalid batch request")
+		return
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Invalid batch request")
+			return
+		}
+		call, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Invalid batch request")
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		if call.URL.Path == "/v3/urlNotifications:publish" {
+			f.handlePublish(rec, call.WithContext(r.Context()))
+		} else {
+			writeFakeError(rec, http.StatusNotFound, "Not found")
+		}
+		res := rec.Result()
+		res.ContentLength = int64(rec.Body.Len())
+		id := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		out, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<response-" + id + ">"},
+		})
+		if err != nil {
+			writeFakeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res.Write(out)
+	}
+	writer.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.Write(body.Bytes())
+}
+
+// writeFakeError writes an error in the format of Google APIs
+func writeFakeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  http.StatusText(code),
+		},
+	})
+}
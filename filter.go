@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// URL filter settings
+var (
+	urlInclude = os.Getenv("URL_INCLUDE")
+	urlExclude = os.Getenv("URL_EXCLUDE")
+)
+
+// urlFilter keeps the URLs matching any include rule, or all URLs if there are none,
+// unless they match an exclude rule
+type urlFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// loadUrlFilter compiles the rules of URL_INCLUDE and URL_EXCLUDE
+func loadUrlFilter() (*urlFilter, error) {
+	include, err := parseFilterRules(urlInclude)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL_INCLUDE: %w", err)
+	}
+	exclude, err := parseFilterRules(urlExclude)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL_EXCLUDE: %w", err)
+	}
+	return &urlFilter{include: include, exclude: exclude}, nil
+}
+
+// parseFilterRules compiles comma separated rules. A rule with the re: prefix is a
+// regular expression matched against the full URL. Other rules are globs where * matches
+// any characters; globs starting with / are matched against the path and query,
+// others against the full URL.
+func parseFilterRules(value string) ([]*regexp.Regexp, error) {
+	var rules []*regexp.Regexp
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if expr, ok := strings.CutPrefix(rule, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, re)
+			continue
+		}
+
+		expr := strings.ReplaceAll(regexp.QuoteMeta(rule), `\*`, ".*")
+		if strings.HasPrefix(rule, "/") {
+			// Matched against the URL without scheme and host
+			expr = `^[a-zA-Z][a-zA-Z0-9+.-]*://[^/?#]*` + expr + "$"
+		} else {
+			expr = "^" + expr + "$"
+		}
+		rules = append(rules, regexp.MustCompile(expr))
+	}
+	return rules, nil
+}
+
+// keep checks if a URL passes the filter
+func (f *urlFilter) keep(rawUrl string) bool {
+	if len(f.include) > 0 && !matchesAny(f.include, rawUrl) {
+		return false
+	}
+	return !matchesAny(f.exclude, rawUrl)
+}
+
+func matchesAny(rules []*regexp.Regexp, rawUrl string) bool {
+	for _, rule := range rules {
+		if rule.MatchString(rawUrl) {
+			return true
+		}
+	}
+	return false
+}
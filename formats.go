@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input limits, which protect against hostile or broken sitemaps
+var (
+	sitemapMaxSize      = os.Getenv("SITEMAP_MAX_SIZE")
+	sitemapMaxUrls      = os.Getenv("SITEMAP_MAX_URLS")
+	sitemapFetchTimeout = os.Getenv("SITEMAP_FETCH_TIMEOUT")
+)
+
+// maxIndexDepth limits how deep sitemap indexes may reference other indexes
+const maxIndexDepth = 3
+
+// maxGzipLayers limits how many times a document may be gzipped
+const maxGzipLayers = 2
+
+// maxXMLDepth limits the element nesting of XML documents, sitemaps and feeds need far less
+const maxXMLDepth = 32
+
+// inputLimits are the limits applied to every parsed document
+type inputLimits struct {
+	maxSize int64
+	maxUrls int
+}
+
+// loadInputLimits reads the input limits, which default to the limits of the sitemap protocol
+func loadInputLimits() (inputLimits, error) {
+	maxSize, err := parseIntDefault(sitemapMaxSize, 50*1024*1024)
+	if err != nil {
+		return inputLimits{}, fmt.Errorf("parsing SITEMAP_MAX_SIZE: %w", err)
+	}
+	maxUrls, err := parseIntDefault(sitemapMaxUrls, 50000)
+	if err != nil {
+		return inputLimits{}, fmt.Errorf("parsing SITEMAP_MAX_URLS: %w", err)
+	}
+	return inputLimits{maxSize: int64(maxSize), maxUrls: maxUrls}, nil
+}
+
+// readLimited reads r, failing if it is larger than max bytes
+func readLimited(r io.Reader, max int64, location string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%s is larger than SITEMAP_MAX_SIZE of %d bytes", location, max)
+	}
+	return data, nil
+}
+
+// limitedReader reads up to max bytes and fails if there are more, unlike io.LimitReader
+// which silently truncates
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	location  string
+	max       int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("%s is larger than SITEMAP_MAX_SIZE of %d bytes", l.location, l.max)
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("%s is larger than SITEMAP_MAX_SIZE of %d bytes", l.location, l.max)
+	}
+	return n, err
+}
+
+// checkedTokens passes on the tokens of an XML decoder, failing on a DOCTYPE, so no
+// entities can be declared and expanded, and on elements nested too deep
+type checkedTokens struct {
+	decoder *xml.Decoder
+	depth   int
+}
+
+func (c *checkedTokens) Token() (xml.Token, error) {
+	token, err := c.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case xml.StartElement:
+		c.depth++
+		if c.depth > maxXMLDepth {
+			return nil, fmt.Errorf("XML elements are nested deeper than %d levels", maxXMLDepth)
+		}
+	case xml.EndElement:
+		c.depth--
+	case xml.Directive:
+		if bytes.HasPrefix(bytes.TrimSpace(t), []byte("DOCTYPE")) {
+			return nil, fmt.Errorf("XML documents with a DOCTYPE are not supported")
+		}
+	}
+	return token, nil
+}
+
+// Structs to parse the other supported input formats
+type SitemapIndex struct {
+	Sitemaps []struct {
+		Loc     string `xml:"loc"`
+		Lastmod string `xml:"lastmod"`
+	} `xml:"sitemap"`
+}
+
+// sitemapRef is a child sitemap of a sitemap index
+type sitemapRef struct {
+	Loc     string `json:"loc"`
+	Lastmod string `json:"lastmod,omitempty"`
+}
+
+type RssFeed struct {
+	Items []struct {
+		Link    string `xml:"link"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+type AtomFeed struct {
+	Entries []struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Updated string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// parseInput detects the format of the input and passes its URLs to emit. Supported are
+// urlset sitemaps, sitemap indexes, RSS and Atom feeds, JSON and plain text lists with
+// one URL per line, each optionally gzipped. The URLs of sitemaps are passed on one at a
+// time as they are decoded, so large sitemaps are never held in memory as a whole.
+func parseInput(location string, r io.Reader, depth int, emit func(Url) error) error {
+	limits, err := loadInputLimits()
+	if err != nil {
+		return err
+	}
+	input := bufio.NewReader(&limitedReader{r: r, remaining: limits.maxSize, location: location, max: limits.maxSize})
+
+	// Gzip is detected by its magic bytes rather than the .gz extension or Content-Encoding,
+	// which servers often get wrong. A .gz file served with Content-Encoding: gzip arrives
+	// compressed twice, more layers than that are rejected.
+	for layers := 0; ; layers++ {
+		magic, _ := input.Peek(2)
+		if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			break
+		}
+		if layers == maxGzipLayers {
+			return fmt.Errorf("%s is compressed more than %d times", location, maxGzipLayers)
+		}
+		zr, err := gzip.NewReader(input)
+		if err != nil {
+			return fmt.Errorf("decompressing %s: %w", location, err)
+		}
+		defer zr.Close()
+		// The size limit also applies after decompression, against gzip bombs
+		input = bufio.NewReader(&limitedReader{r: zr, remaining: limits.maxSize, location: location, max: limits.maxSize})
+	}
+
+	// Skip a byte order mark and leading white space to find the first character
+	if bom, _ := input.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		input.Discard(3)
+	}
+	var first byte
+	for {
+		first, err = input.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(first)) {
+			input.UnreadByte()
+			break
+		}
+	}
+
+	switch first {
+	case '<':
+		return parseXML(location, input, depth, limits, emit)
+	case '[', '{':
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return err
+		}
+		// JSON input is ordered by priority, so it can only be passed on once it was read
+		urls, err := parseJSONInput(bytes.TrimSpace(data))
+		if err != nil {
+			return fmt.Errorf("parsing JSON in %s: %w", location, err)
+		}
+		return emitUrls(location, urls, limits, emit)
+	default:
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return err
+		}
+		return emitUrls(location, parseTextList(bytes.TrimSpace(data)), limits, emit)
+	}
+}
+
+// emitUrls passes the URLs of a document which was parsed as a whole to emit, if they are
+// within the URL limit
+func emitUrls(location string, urls []Url, limits inputLimits, emit func(Url) error) error {
+	if len(urls) > limits.maxUrls {
+		return fmt.Errorf("%s has %d URLs, more than SITEMAP_MAX_URLS of %d", location, len(urls), limits.maxUrls)
+	}
+	return emitAll(urls, emit)
+}
+
+// emitAll passes URLs to emit until it fails
+func emitAll(urls []Url, emit func(Url) error) error {
+	for _, url := range urls {
+		err := emit(url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseXML decodes an XML document by its root element. The url elements of a urlset
+// are decoded and passed to emit one at a time, the URL limit is checked as they are read.
+func parseXML(location string, r io.Reader, depth int, limits inputLimits, emit func(Url) error) error {
+	decoder := xml.NewTokenDecoder(&checkedTokens{decoder: xml.NewDecoder(r)})
+	var root xml.StartElement
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return fmt.Errorf("no XML element found in %s", location)
+		}
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+
+	switch root.Name.Local {
+	case "urlset":
+		count := 0
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if _, ok := token.(xml.EndElement); ok {
+				return nil
+			}
+			start, ok := token.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			if start.Name.Local != "url" {
+				err = decoder.Skip()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var url Url
+			err = decoder.DecodeElement(&url, &start)
+			if err != nil {
+				return err
+			}
+			count++
+			if count > limits.maxUrls {
+				return fmt.Errorf("%s has more than SITEMAP_MAX_URLS of %d URLs", location, limits.maxUrls)
+			}
+			err = emit(url)
+			if err != nil {
+				return err
+			}
+		}
+	case "sitemapindex":
+		var index SitemapIndex
+		err := decoder.DecodeElement(&index, &root)
+		if err != nil {
+			return err
+		}
+		return parseSitemapIndex(location, index, depth, limits, emit)
+	case "rss":
+		var feed RssFeed
+		err := decoder.DecodeElement(&feed, &root)
+		if err != nil {
+			return err
+		}
+		return emitUrls(location, parseRss(feed), limits, emit)
+	case "feed":
+		var feed AtomFeed
+		err := decoder.DecodeElement(&feed, &root)
+		if err != nil {
+			return err
+		}
+		return emitUrls(location, parseAtom(feed), limits, emit)
+	default:
+		return fmt.Errorf("unsupported XML document <%s> in %s", root.Name.Local, location)
+	}
+}
+
+// parseTextList reads one URL per line, optionally followed by a comma and the notification type,
+// skipping blank lines and # comments
+func parseTextList(data []byte) []Url {
+	var urls []Url
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// CSV rows give the notification type, e.g. https://example.com/old,URL_DELETED.
+		// Commas are also valid in URLs, so only a known type makes a line a CSV row.
+		loc, typ, ok := strings.Cut(line, ",")
+		typ = strings.ToUpper(strings.TrimSpace(typ))
+		if ok && strings.EqualFold(strings.TrimSpace(loc), "url") && typ == "TYPE" {
+			continue
+		}
+		if ok && (typ == "URL_UPDATED" || typ == "URL_DELETED") {
+			urls = append(urls, Url{Loc: strings.TrimSpace(loc), Type: typ})
+			continue
+		}
+		urls = append(urls, Url{Loc: line})
+	}
+	return urls
+}
+
+// jsonInputUrl is a URL of JSON input
+type jsonInputUrl struct {
+	Url     string `json:"url"`
+	Type    string `json:"type"`
+	Lastmod string `json:"lastmod"`
+	// Priority orders the URLs, higher first, like the sitemap priority it defaults to 0.5
+	Priority *float64 `json:"priority"`
+}
+
+func (u jsonInputUrl) priority() float64 {
+	if u.Priority == nil {
+		return 0.5
+	}
+	return *u.Priority
+}
+
+// parseJSONInput reads a JSON array or JSON Lines of jsonInputUrl objects, ordered by
+// priority and then by lastmod, newest first
+func parseJSONInput(data []byte) ([]Url, error) {
+	var items []jsonInputUrl
+	if bytes.HasPrefix(data, []byte("[")) {
+		err := json.Unmarshal(data, &items)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var item jsonInputUrl
+			err := decoder.Decode(&item)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		pi, pj := items[i].priority(), items[j].priority()
+		if pi != pj {
+			return pi > pj
+		}
+		ti, _ := parseLastmod(items[i].Lastmod)
+		tj, _ := parseLastmod(items[j].Lastmod)
+		return ti.After(tj)
+	})
+
+	var urls []Url
+	for _, item := range items {
+		loc := strings.TrimSpace(item.Url)
+		if loc == "" {
+			continue
+		}
+		typ := strings.ToUpper(strings.TrimSpace(item.Type))
+		if typ != "" && typ != "URL_UPDATED" && typ != "URL_DELETED" {
+			return nil, fmt.Errorf("unknown notification type %q of %s", item.Type, loc)
+		}
+		urls = append(urls, Url{
+			Loc:      loc,
+			Type:     typ,
+			Lastmod:  strings.TrimSpace(item.Lastmod),
+			Priority: strconv.FormatFloat(item.priority(), 'f', -1, 64),
+		})
+	}
+	return urls, nil
+}
+
+// parseSitemapIndex fetches and parses every sitemap referenced by the index.
+// Every referenced sitemap is checked against the limits on its own.
+func parseSitemapIndex(location string, index SitemapIndex, depth int, limits inputLimits, emit func(Url) error) error {
+	if len(index.Sitemaps) > limits.maxUrls {
+		return fmt.Errorf("sitemap index %s has %d sitemaps, more than SITEMAP_MAX_URLS of %d", location, len(index.Sitemaps), limits.maxUrls)
+	}
+
+	var children []sitemapRef
+	for _, sitemap := range index.Sitemaps {
+		children = append(children, sitemapRef{
+			Loc:     resolveLocation(location, strings.TrimSpace(sitemap.Loc)),
+			Lastmod: strings.TrimSpace(sitemap.Lastmod),
+		})
+	}
+	sitemapIndexChildren.Store(location, children)
+	return parseSitemaps(location, children, depth, emit)
+}
+
+// parseSitemaps parses the child sitemaps of a sitemap index. Children which
+// weren't modified since they were last fetched by their lastmod in the index
+// are taken from the sitemap cache without downloading them.
+func parseSitemaps(location string, children []sitemapRef, depth int, emit func(Url) error) error {
+	if depth >= maxIndexDepth {
+		return fmt.Errorf("sitemap index %s is nested too deep", location)
+	}
+
+	skipped := 0
+	for _, child := range children {
+		ok, err := unchangedSitemap(child, depth+1, emit)
+		if ok {
+			skipped++
+		} else if err == nil {
+			err = parseLocation(child.Loc, depth+1, emit)
+		}
+		if err != nil {
+			return fmt.Errorf("parsing sitemap %s: %w", child.Loc, err)
+		}
+	}
+	if skipped > 0 {
+		logInfo("Skipped %d of %d sitemaps of %s not modified since they were last fetched", skipped, len(children), location)
+	}
+	return nil
+}
+
+// resolveLocation resolves a sitemap location referenced by an index against the
+// index's own location, so local indexes can reference sibling files
+func resolveLocation(base, loc string) string {
+	if isRemote(loc) {
+		return loc
+	}
+	if isRemote(base) {
+		baseUrl, err := url.Parse(base)
+		if err != nil {
+			return loc
+		}
+		ref, err := url.Parse(loc)
+		if err != nil {
+			return loc
+		}
+		return baseUrl.ResolveReference(ref).String()
+	}
+	if filepath.IsAbs(loc) {
+		return loc
+	}
+	return filepath.Join(filepath.Dir(base), loc)
+}
+
+// isRemote checks if a location is a http(s) URL
+func isRemote(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// parseRss returns the item links of an RSS feed with their publication dates as lastmod
+func parseRss(feed RssFeed) []Url {
+	var urls []Url
+	for _, item := range feed.Items {
+		link := strings.TrimSpace(item.Link)
+		if link == "" {
+			continue
+		}
+		lastmod := strings.TrimSpace(item.PubDate)
+		for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+			if t, err := time.Parse(layout, lastmod); err == nil {
+				lastmod = t.Format(time.RFC3339)
+				break
+			}
+		}
+		urls = append(urls, Url{Loc: link, Lastmod: lastmod})
+	}
+	return urls
+}
+
+// parseAtom returns the alternate links of an Atom feed's entries with their update times as lastmod
+func parseAtom(feed AtomFeed) []Url {
+	var urls []Url
+	for _, entry := range feed.Entries {
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				urls = append(urls, Url{Loc: strings.TrimSpace(link.Href), Lastmod: strings.TrimSpace(entry.Updated)})
+				break
+			}
+		}
+	}
+	return urls
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gzipped compresses data
+func gzipped(t *testing.T, data string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := io.WriteString(zw, data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// collectLocation parses a location and returns the URLs it passes on
+func collectLocation(t *testing.T, location string) []Url {
+	t.Helper()
+	var urls []Url
+	err := parseLocation(location, 0, func(u Url) error {
+		urls = append(urls, u)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return urls
+}
+
+func TestParseInputFormats(t *testing.T) {
+	urlset := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/a</loc><lastmod>2024-06-01</lastmod></url>
+  <url><loc>https://example.com/b</loc></url>
+</urlset>`
+	tests := []struct {
+		name    string
+		content string
+		want    []Url
+	}{
+		{
+			name:    "urlset",
+			content: urlset,
+			want:    []Url{{Loc: "https://example.com/a", Lastmod: "2024-06-01"}, {Loc: "https://example.com/b"}},
+		},
+		{
+			name:    "gzipped urlset",
+			content: gzipped(t, urlset),
+			want:    []Url{{Loc: "https://example.com/a", Lastmod: "2024-06-01"}, {Loc: "https://example.com/b"}},
+		},
+		{
+			name:    "plain text",
+			content: "\n# new pages\nhttps://example.com/a\n  https://example.com/b  \n\nhttps://example.com/c,d\n",
+			want:    []Url{{Loc: "https://example.com/a"}, {Loc: "https://example.com/b"}, {Loc: "https://example.com/c,d"}},
+		},
+		{
+			name:    "plain text with types",
+			content: "url,type\nhttps://example.com/a,URL_UPDATED\nhttps://example.com/old,url_deleted\n",
+			want:    []Url{{Loc: "https://example.com/a", Type: "URL_UPDATED"}, {Loc: "https://example.com/old", Type: "URL_DELETED"}},
+		},
+		{
+			name: "rss",
+			content: `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Blog</title>
+  <item><title>A</title><link>https://example.com/a</link><pubDate>Sat, 01 Jun 2024 10:00:00 +0000</pubDate></item>
+  <item><title>No link</title></item>
+  <item><link> https://example.com/b </link></item>
+</channel></rss>`,
+			want: []Url{{Loc: "https://example.com/a", Lastmod: "2024-06-01T10:00:00Z"}, {Loc: "https://example.com/b"}},
+		},
+		{
+			name: "atom",
+			content: `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>Blog</title>
+  <entry><link rel="self" href="https://example.com/a.atom"/><link href="https://example.com/a"/><updated>2024-06-01T10:00:00Z</updated></entry>
+  <entry><link rel="alternate" href="https://example.com/b"/></entry>
+</feed>`,
+			want: []Url{{Loc: "https://example.com/a", Lastmod: "2024-06-01T10:00:00Z"}, {Loc: "https://example.com/b"}},
+		},
+		{
+			name:    "gzipped plain text",
+			content: gzipped(t, "https://example.com/a\n"),
+			want:    []Url{{Loc: "https://example.com/a"}},
+		},
+		{
+			name:    "empty",
+			content: " \n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collectLocation(t, writeTestFile(t, "input", tt.content))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGzippedSitemapIndex(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.xml.gz": gzipped(t, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>pages.xml.gz</loc><lastmod>2024-06-01</lastmod></sitemap>
+  <sitemap><loc>posts.rss</loc></sitemap>
+</sitemapindex>`),
+		"pages.xml.gz": gzipped(t, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc>https://example.com/a</loc></url></urlset>`),
+		"posts.rss":    `<rss version="2.0"><channel><item><link>https://example.com/b</link></item></channel></rss>`,
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := collectLocation(t, filepath.Join(dir, "index.xml.gz"))
+	want := []Url{{Loc: "https://example.com/a"}, {Loc: "https://example.com/b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+}
+
+// failingReader returns err once r is read
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestParseInputStreamsUrls(t *testing.T) {
+	head := `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/a</loc></url>
+  <url><loc>https://example.com/b</loc></url>`
+
+	// URLs are passed on before the rest of the sitemap is read
+	broken := errors.New("connection reset")
+	var got []string
+	err := parseInput("sitemap.xml", &failingReader{r: strings.NewReader(head), err: broken}, 0, func(u Url) error {
+		got = append(got, u.Loc)
+		return nil
+	})
+	if !errors.Is(err, broken) {
+		t.Errorf("parseInput = %v, want %v", err, broken)
+	}
+	if want := []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("passed on %v before the error, want %v", got, want)
+	}
+
+	// An error of emit stops parsing
+	stop := errors.New("stop")
+	got = nil
+	err = parseInput("sitemap.xml", strings.NewReader(head+"</urlset>"), 0, func(u Url) error {
+		got = append(got, u.Loc)
+		return stop
+	})
+	if !errors.Is(err, stop) || len(got) != 1 {
+		t.Errorf("parseInput passed on %v and returned %v, want one URL and %v", got, err, stop)
+	}
+}
+
+func TestParseInputLimitsUrls(t *testing.T) {
+	prev := sitemapMaxUrls
+	sitemapMaxUrls = "2"
+	t.Cleanup(func() { sitemapMaxUrls = prev })
+
+	for name, content := range map[string]string{
+		"urlset":     `<urlset><url><loc>https://example.com/a</loc></url><url><loc>https://example.com/b</loc></url><url><loc>https://example.com/c</loc></url></urlset>`,
+		"plain text": "https://example.com/a\nhttps://example.com/b\nhttps://example.com/c\n",
+	} {
+		count := 0
+		err := parseInput(name, strings.NewReader(content), 0, func(u Url) error {
+			count++
+			return nil
+		})
+		if err == nil || !strings.Contains(err.Error(), "SITEMAP_MAX_URLS") {
+			t.Errorf("%s: parseInput = %v, want an error about SITEMAP_MAX_URLS", name, err)
+		}
+		if count > 2 {
+			t.Errorf("%s: passed on %d URLs, more than the limit", name, count)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+// runIndexed records the URLs given as arguments as indexed, so they aren't sent
+func runIndexed(args []string) {
+	fs := flag.NewFlagSet("indexed", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatal("Usage: indexapi indexed <url>...")
+		return
+	}
+
+	for _, arg := range fs.Args() {
+		url := normalizeUrl(arg)
+		err := stateStore.MarkIndexed(url)
+		if err != nil {
+			// The URLs recorded before are saved, as exiting skips the save on exit
+			if err := saveState(); err != nil {
+				logError("Error saving the state: %v", err)
+			}
+			log.Fatal("Error recording indexed URL:", err)
+			return
+		}
+		logInfo("Recorded %s as indexed", url)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// apiTimeout limits how long a single API call may take
+var apiTimeout = os.Getenv("API_TIMEOUT")
+
+var (
+	interruptOnce sync.Once
+	interrupted   context.Context
+)
+
+// interruptContext returns a context which is cancelled when the process receives SIGINT or
+// SIGTERM, so in-flight API calls are stopped and no new ones are made. A second signal exits
+// the process right away.
+func interruptContext() context.Context {
+	interruptOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-signals
+			// The next signal has its default effect
+			signal.Stop(signals)
+			logWarning("Interrupted, stopping in-flight requests. Interrupt again to exit immediately")
+			cancel()
+		}()
+		interrupted = ctx
+	})
+	return interrupted
+}
+
+// callContext returns the context of a single API call, which is cancelled after API_TIMEOUT
+func callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout, err := parseDurationDefault(apiTimeout, 30*time.Second)
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sleepContext sleeps unless the context is cancelled first, which it reports
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// serviceAccountKey holds the identifying fields of a service account key file
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+}
+
+// parseServiceAccountKey reads the identifying fields of a key, which are empty for other credentials
+func parseServiceAccountKey(data []byte) serviceAccountKey {
+	var key serviceAccountKey
+	json.Unmarshal(data, &key)
+	return key
+}
+
+// credentialsEmail returns the client_email of the service account key, or an empty string.
+// An impersonated service account is the one calling the API.
+func credentialsEmail() string {
+	if impersonateServiceAccount != "" {
+		return impersonateServiceAccount
+	}
+	data, err := readCredentials()
+	if err != nil {
+		return ""
+	}
+	return parseServiceAccountKey(data).ClientEmail
+}
+
+// credentialsKey identifies the key in the credentials for quota accounting. An impersonated
+// service account has no key, its short-lived tokens count against its own quota.
+func credentialsKey() string {
+	if impersonateServiceAccount != "" {
+		return impersonateServiceAccount
+	}
+	data, err := readCredentials()
+	if err != nil {
+		return ""
+	}
+	return parseServiceAccountKey(data).id()
+}
+
+// id returns the client email with a short private key ID, so rotated keys of
+// one service account are told apart
+func (k serviceAccountKey) id() string {
+	if k.ClientEmail == "" {
+		return ""
+	}
+	if len(k.PrivateKeyID) > 8 {
+		return k.ClientEmail + "/" + k.PrivateKeyID[:8]
+	}
+	if k.PrivateKeyID != "" {
+		return k.ClientEmail + "/" + k.PrivateKeyID
+	}
+	return k.ClientEmail
+}
+
+// keyUsage counts the URLs sent through a key
+type keyUsage struct {
+	total int
+	daily map[string]int
+	first time.Time
+	last  time.Time
+}
+
+// runKeys reports the usage of every key today and over the last days with the
+// remaining headroom, from the key column of the sent file
+func runKeys(args []string) {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	days := fs.Int("days", 7, "Number of days of daily usage to show")
+	fs.Parse(args)
+
+	if schema.column("key") < 0 {
+		log.Fatal("The key column is not stored in the sent file, add it to STATE_COLUMNS")
+		return
+	}
+	perDay, err := parseIntDefault(rateLimitDay, 200)
+	if err != nil {
+		log.Fatal("Error converting rate limit per day to integer:", err)
+		return
+	}
+
+	records, err := readSentHistory(sentFile)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+
+	usage := map[string]*keyUsage{}
+	for _, rec := range records {
+		key := rec.Key
+		if key == "" {
+			key = "(unknown)"
+		}
+		u := usage[key]
+		if u == nil {
+			u = &keyUsage{daily: map[string]int{}}
+			usage[key] = u
+		}
+		u.total++
+		u.daily[rec.Time.In(time.Local).Format("2006-01-02")]++
+		if u.first.IsZero() || rec.Time.Before(u.first) {
+			u.first = rec.Time
+		}
+		if rec.Time.After(u.last) {
+			u.last = rec.Time
+		}
+	}
+
+	today := clock.Now().Format("2006-01-02")
+	fmt.Printf("%-60s %6s %8s %8s %-25s %s\n", "KEY", "TODAY", "HEADROOM", "TOTAL", "FIRST USED", "LAST USED")
+	for _, key := range sortedKeys(usage) {
+		u := usage[key]
+		headroom := perDay - u.daily[today]
+		if headroom < 0 {
+			headroom = 0
+		}
+		fmt.Printf("%-60s %6d %8d %8d %-25s %s\n", key, u.daily[today], headroom, u.total,
+			u.first.Format(time.RFC3339), u.last.Format(time.RFC3339))
+	}
+
+	fmt.Printf("\n%-10s %-60s %6s\n", "DATE", "KEY", "SENT")
+	for i := *days - 1; i >= 0; i-- {
+		date := clock.Now().AddDate(0, 0, -i).Format("2006-01-02")
+		for _, key := range sortedKeys(usage) {
+			if n := usage[key].daily[date]; n > 0 {
+				fmt.Printf("%-10s %-60s %6d\n", date, key, n)
+			}
+		}
+	}
+}
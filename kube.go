@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths of the service account files mounted into every pod
+const (
+	kubeTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubeNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// kubeClient is a minimal in-cluster client for the Kubernetes REST API
+type kubeClient struct {
+	host   string
+	client *http.Client
+}
+
+// kubeError is returned when the API server responds with a non-2xx status
+type kubeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API error %d: %s", e.StatusCode, e.Body)
+}
+
+// isKubeStatus checks if err is a kubeError with the given status code
+func isKubeStatus(err error, code int) bool {
+	kerr, ok := err.(*kubeError)
+	return ok && kerr.StatusCode == code
+}
+
+// newInClusterKubeClient creates a client using the pod's service account
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside a Kubernetes cluster")
+	}
+
+	caCert, err := os.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", kubeCAFile)
+	}
+
+	return &kubeClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// kubeNamespace returns the namespace the pod is running in
+func kubeNamespace() string {
+	ns, err := os.ReadFile(kubeNamespaceFile)
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(ns))
+}
+
+// do sends a request to the API server and decodes the JSON response into out
+func (c *kubeClient) do(method, path, contentType string, in, out interface{}) error {
+	req, err := c.newRequest(context.Background(), method, path, contentType, in)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &kubeError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// newRequest creates an authenticated request with in encoded as JSON
+func (c *kubeClient) newRequest(ctx context.Context, method, path, contentType string, in interface{}) (*http.Request, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	// The token is rotated by the kubelet, so read it for every request
+	token, err := os.ReadFile(kubeTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// kubeWatchEvent is a change of a watched resource
+type kubeWatchEvent struct {
+	// Type is ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch streams the changes of the resources of a collection since resourceVersion to handle,
+// until the server ends the watch after timeout, ctx is done or handle returns an error. A
+// resourceVersion which is too old to watch from is reported as a kubeError with status 410.
+func (c *kubeClient) watch(ctx context.Context, path, resourceVersion string, timeout time.Duration, handle func(kubeWatchEvent) error) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(timeout.Seconds()))},
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, path+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	// The stream stays open until the server ends the watch
+	client := *c.client
+	client.Timeout = 0
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		data, _ := io.ReadAll(res.Body)
+		return &kubeError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event kubeWatchEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return &kubeError{StatusCode: status.Code, Body: status.Message}
+		}
+		err = handle(event)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Kubernetes MicroTime format used by Lease objects
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// Lease mirrors the fields of a coordination.k8s.io/v1 Lease we care about
+type Lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   LeaseMetadata `json:"metadata"`
+	Spec       LeaseSpec     `json:"spec"`
+}
+
+type LeaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaderElector holds a Kubernetes Lease so only one replica submits URLs
+type leaderElector struct {
+	kube          *kubeClient
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	lease         *Lease
+	stop          chan struct{}
+	// done is closed when the renewal goroutine returned
+	done chan struct{}
+}
+
+// newLeaderElector creates an elector for the given lease using in-cluster credentials
+func newLeaderElector(namespace, name string, leaseDuration time.Duration) (*leaderElector, error) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = kubeNamespace()
+	}
+
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &leaderElector{
+		kube:          kube,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		stop:          make(chan struct{}),
+	}, nil
+}
+
+func (le *leaderElector) leasePath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", le.namespace, le.name)
+}
+
+// tryAcquireOrRenew takes the lease if it is free, expired or already ours
+func (le *leaderElector) tryAcquireOrRenew() (bool, error) {
+	now := clock.Now()
+
+	var lease Lease
+	err := le.kube.do(http.MethodGet, le.leasePath(), "", nil, &lease)
+	if isKubeStatus(err, http.StatusNotFound) {
+		lease = Lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   LeaseMetadata{Name: le.name, Namespace: le.namespace},
+			Spec: LeaseSpec{
+				HolderIdentity:       le.identity,
+				LeaseDurationSeconds: int(le.leaseDuration.Seconds()),
+				AcquireTime:          now.UTC().Format(kubeMicroTime),
+				RenewTime:            now.UTC().Format(kubeMicroTime),
+			},
+		}
+		path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", le.namespace)
+		err = le.kube.do(http.MethodPost, path, "application/json", &lease, &lease)
+		if isKubeStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		le.lease = &lease
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if lease.Spec.HolderIdentity != le.identity && lease.Spec.HolderIdentity != "" {
+		renewTime, err := time.Parse(kubeMicroTime, lease.Spec.RenewTime)
+		duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+		if err == nil && now.Before(renewTime.Add(duration)) {
+			// Another replica holds a valid lease
+			return false, nil
+		}
+	}
+
+	if lease.Spec.HolderIdentity != le.identity {
+		lease.Spec.HolderIdentity = le.identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(le.leaseDuration.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+
+	// resourceVersion makes the update fail with 409 if someone else won the race
+	err = le.kube.do(http.MethodPut, le.leasePath(), "application/json", &lease, &lease)
+	if isKubeStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	le.lease = &lease
+	return true, nil
+}
+
+// waitForLeadership blocks until this replica holds the lease and keeps renewing it
+// in the background. The process exits if the lease cannot be renewed in time,
+// so a standby replica can take over without submitting URLs twice.
+func (le *leaderElector) waitForLeadership() {
+	retryPeriod := le.leaseDuration / 3
+	logInfo("Waiting for leadership of lease %s/%s as %s", le.namespace, le.name, le.identity)
+
+	for {
+		ok, err := le.tryAcquireOrRenew()
+		if err != nil {
+			logError("Error acquiring lease: %v", err)
+		}
+		if ok {
+			break
+		}
+		clock.Sleep(retryPeriod)
+	}
+	logInfo("Acquired leadership")
+
+	le.done = make(chan struct{})
+	go func() {
+		defer close(le.done)
+		lastRenew := clock.Now()
+		for {
+			select {
+			case <-le.stop:
+				return
+			case <-clock.After(retryPeriod):
+			}
+			ok, err := le.tryAcquireOrRenew()
+			if err != nil {
+				logError("Error renewing lease: %v", err)
+			}
+			if ok {
+				lastRenew = clock.Now()
+				continue
+			}
+			if err == nil || clock.Now().Sub(lastRenew) > le.leaseDuration {
+				log.Fatal("Lost leadership of lease ", le.namespace, "/", le.name)
+			}
+		}
+	}()
+}
+
+// release gives up the lease so a standby replica can take over immediately
+func (le *leaderElector) release() error {
+	if le.lease == nil {
+		return nil
+	}
+	// A renewal in flight would update the lease, and its resourceVersion, concurrently
+	close(le.stop)
+	if le.done != nil {
+		<-le.done
+	}
+	lease := *le.lease
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = clock.Now().UTC().Format(kubeMicroTime)
+	err := le.kube.do(http.MethodPut, le.leasePath(), "application/json", &lease, nil)
+	if err != nil {
+		return err
+	}
+	logInfo("Released leadership of lease %s/%s", le.namespace, le.name)
+	return nil
+}
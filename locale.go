@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Locale settings
+var (
+	localePattern = os.Getenv("LOCALE_PATTERN")
+	localeDefault = os.Getenv("LOCALE_DEFAULT")
+	localeQuotas  = os.Getenv("LOCALE_QUOTAS")
+	hreflangGroup = os.Getenv("HREFLANG_GROUP")
+)
+
+// defaultLocalePattern matches a language code like en or pt-br as the first path segment or subdomain
+var defaultLocalePattern = regexp.MustCompile(`^([a-z]{2}(?:[-_][a-z]{2})?)$`)
+
+// Alternate is an xhtml:link hreflang alternate of a sitemap URL
+type Alternate struct {
+	Rel      string `xml:"rel,attr"`
+	Hreflang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
+}
+
+// hreflangLocale returns the locale of a sitemap URL which lists itself as an hreflang alternate
+func hreflangLocale(u Url) (string, bool) {
+	locale, found := "", false
+	for _, alt := range u.Alternates {
+		if alt.Hreflang != "" && alt.Hreflang != "x-default" && alt.Href == u.Loc {
+			locale, found = strings.ToLower(alt.Hreflang), true
+		}
+	}
+	return locale, found
+}
+
+// localeDetector finds the locale of a URL from hreflang data or its path and host
+type localeDetector struct {
+	pattern  *regexp.Regexp
+	hreflang map[string]string
+}
+
+// newLocaleDetector creates a detector using LOCALE_PATTERN, which must have one capture group, or the default pattern
+func newLocaleDetector(hreflang map[string]string) (*localeDetector, error) {
+	if localePattern == "" {
+		return &localeDetector{hreflang: hreflang}, nil
+	}
+	pattern, err := regexp.Compile(localePattern)
+	if err != nil {
+		return nil, fmt.Errorf("parsing LOCALE_PATTERN: %w", err)
+	}
+	if pattern.NumSubexp() != 1 {
+		return nil, fmt.Errorf("LOCALE_PATTERN must have exactly one capture group")
+	}
+	return &localeDetector{pattern: pattern, hreflang: hreflang}, nil
+}
+
+// detect returns the locale of a URL, or LOCALE_DEFAULT if none is found
+func (d *localeDetector) detect(rawUrl string) string {
+	if locale, ok := d.hreflang[rawUrl]; ok {
+		return locale
+	}
+
+	if d.pattern != nil {
+		if m := d.pattern.FindStringSubmatch(rawUrl); m != nil && m[1] != "" {
+			return strings.ToLower(m[1])
+		}
+	} else if u, err := url.Parse(rawUrl); err == nil {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		if m := defaultLocalePattern.FindStringSubmatch(strings.ToLower(segment)); m != nil {
+			return strings.ReplaceAll(m[1], "_", "-")
+		}
+		subdomain, _, _ := strings.Cut(u.Hostname(), ".")
+		if strings.Count(u.Hostname(), ".") >= 2 {
+			if m := defaultLocalePattern.FindStringSubmatch(strings.ToLower(subdomain)); m != nil {
+				return strings.ReplaceAll(m[1], "_", "-")
+			}
+		}
+	}
+
+	if localeDefault != "" {
+		return localeDefault
+	}
+	return "default"
+}
+
+// parseLocaleQuotas reads LOCALE_QUOTAS, e.g. "en=50,de=30,*=20". The shares are
+// relative weights, locales without one use the * weight, which defaults to 1.
+func parseLocaleQuotas(value string) (map[string]int, error) {
+	shares := map[string]int{}
+	for _, item := range strings.Split(value, ",") {
+		locale, share, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid locale quota %q, expected locale=share", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(share), "%"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid share in locale quota %q", item)
+		}
+		shares[strings.ToLower(strings.TrimSpace(locale))] = n
+	}
+	return shares, nil
+}
+
+// interleaveByLocale orders notifications so every locale gets its share of
+// whatever quota is available, keeping the order within each locale. A locale
+// running out of URLs leaves its share to the others.
+func interleaveByLocale(notifications []notification, shares map[string]int) []notification {
+	queues := map[string][]notification{}
+	var locales []string
+	for _, n := range notifications {
+		if _, ok := queues[n.Locale]; !ok {
+			locales = append(locales, n.Locale)
+		}
+		queues[n.Locale] = append(queues[n.Locale], n)
+	}
+	sort.Strings(locales)
+
+	weight := func(locale string) int {
+		if share, ok := shares[locale]; ok {
+			return share
+		}
+		if share, ok := shares["*"]; ok {
+			return share
+		}
+		return 1
+	}
+
+	// Smooth weighted round robin, locales with a zero share go last
+	current := map[string]int{}
+	ordered := make([]notification, 0, len(notifications))
+	for len(ordered) < len(notifications) {
+		total := 0
+		best := ""
+		for _, locale := range locales {
+			if len(queues[locale]) == 0 {
+				continue
+			}
+			w := weight(locale)
+			current[locale] += w
+			total += w
+			if best == "" || current[locale] > current[best] {
+				best = locale
+			}
+		}
+		current[best] -= total
+		ordered = append(ordered, queues[best][0])
+		queues[best] = queues[best][1:]
+	}
+	return ordered
+}
+
+// groupAlternates queues the hreflang alternates of every updated URL right after it,
+// so all language variants of a page are submitted together. Alternates which are
+// already queued are moved next to the first variant, alternates marked as deleted
+// are left out.
+func groupAlternates(notifications []notification, urls []Url) []notification {
+	if hreflangGroup != "true" {
+		return notifications
+	}
+
+	byLoc := map[string]Url{}
+	for _, u := range urls {
+		byLoc[u.Loc] = u
+	}
+	queued := map[string]notification{}
+	for _, n := range notifications {
+		queued[n.Url] = n
+	}
+
+	added := map[string]struct{}{}
+	grouped := make([]notification, 0, len(notifications))
+	for _, n := range notifications {
+		if contains(added, n.Url) {
+			continue
+		}
+		added[n.Url] = struct{}{}
+		grouped = append(grouped, n)
+		if n.Type != "URL_UPDATED" {
+			continue
+		}
+
+		for _, alt := range byLoc[n.Url].Alternates {
+			if alt.Href == "" || contains(added, alt.Href) {
+				continue
+			}
+			variant, ok := queued[alt.Href]
+			if !ok {
+				u := byLoc[alt.Href]
+				if u.Type == "URL_DELETED" {
+					continue
+				}
+				variant = notification{
+					Url:      alt.Href,
+					Type:     "URL_UPDATED",
+					Source:   n.Source,
+					Lastmod:  u.Lastmod,
+					Priority: parsePriority(u.Priority),
+					Images:   u.imageCount(),
+					Videos:   u.videoCount(),
+					Reason:   "hreflang alternate of " + n.Url,
+				}
+			} else if variant.Type != "URL_UPDATED" {
+				continue
+			}
+			added[alt.Href] = struct{}{}
+			grouped = append(grouped, variant)
+		}
+	}
+	return grouped
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log settings
+var (
+	cloudLogging = os.Getenv("CLOUD_LOGGING")
+	logSite      = os.Getenv("LOG_SITE")
+)
+
+// Log severities, named as in Cloud Logging
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// logEntry is a structured log message
+type logEntry struct {
+	Time     time.Time
+	Severity string
+	Message  string
+	Fields   map[string]string
+	Labels   map[string]string
+}
+
+// logSink receives log entries in addition to stdout
+type logSink interface {
+	write(entry logEntry)
+	flush()
+}
+
+var (
+	logMu     sync.Mutex
+	logSinks  []logSink
+	logLabels = map[string]string{}
+)
+
+// setupLogging creates the configured log sinks, the returned function flushes them
+func setupLogging() (func(), error) {
+	if logSite != "" {
+		setLogLabel("site", logSite)
+	}
+
+	if cloudLogging == "true" {
+		sink, err := newCloudLoggingSink()
+		if err != nil {
+			return nil, fmt.Errorf("setting up Cloud Logging: %w", err)
+		}
+		logMu.Lock()
+		logSinks = append(logSinks, sink)
+		logMu.Unlock()
+	}
+
+	return func() {
+		logMu.Lock()
+		sinks := logSinks
+		logMu.Unlock()
+		for _, sink := range sinks {
+			sink.flush()
+		}
+	}, nil
+}
+
+// setLogLabel adds a label to all following log entries, e.g. the run ID
+func setLogLabel(name, value string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logLabels[name] = value
+}
+
+// logMessage prints a message and ships it to the log sinks
+func logMessage(severity string, fields map[string]string, format string, args ...interface{}) {
+	logLabeled(severity, fields, nil, format, args...)
+}
+
+// logLabeled logs a message with labels in addition to the ones set with setLogLabel
+func logLabeled(severity string, fields, extra map[string]string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Println(message)
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if len(logSinks) == 0 {
+		return
+	}
+	labels := make(map[string]string, len(logLabels)+len(extra))
+	for k, v := range logLabels {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	entry := logEntry{Time: time.Now(), Severity: severity, Message: message, Fields: fields, Labels: labels}
+	for _, sink := range logSinks {
+		sink.write(entry)
+	}
+}
+
+func logDebug(format string, args ...interface{}) {
+	logMessage(severityDebug, nil, format, args...)
+}
+
+func logInfo(format string, args ...interface{}) {
+	logMessage(severityInfo, nil, format, args...)
+}
+
+func logWarning(format string, args ...interface{}) {
+	logMessage(severityWarning, nil, format, args...)
+}
+
+func logError(format string, args ...interface{}) {
+	logMessage(severityError, nil, format, args...)
+}
+
+// logURL logs a message about a single URL, keeping the URL as a separate field
+func logURL(severity, url, format string, args ...interface{}) {
+	logMessage(severity, map[string]string{"url": url}, format, args...)
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
-	"encoding/xml"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -16,14 +16,21 @@ import (
 	"google.golang.org/api/option"
 )
 
-// Struct to parse sitemap.xml
-type Urlset struct {
-	XMLName xml.Name `xml:"urlset"`
-	Urls    []Url    `xml:"url"`
-}
-
+// Struct to parse sitemap.xml entries
 type Url struct {
-	Loc string `xml:"loc"`
+	Loc        string      `xml:"loc"`
+	Lastmod    string      `xml:"lastmod"`
+	Priority   string      `xml:"priority"`
+	Changefreq string      `xml:"changefreq"`
+	Alternates []Alternate `xml:"http://www.w3.org/1999/xhtml link"`
+	Images     []Image     `xml:"http://www.google.com/schemas/sitemap-image/1.1 image"`
+	Videos     []Video     `xml:"http://www.google.com/schemas/sitemap-video/1.1 video"`
+	// Source is the sitemap the URL was read from
+	Source string `xml:"-"`
+	// Type is the notification type given by CSV input, empty for URL_UPDATED
+	Type string `xml:"-"`
+	// images and videos are the numbers of images and videos of a compacted URL
+	images, videos int
 }
 
 // Struct for Google Index API request body
@@ -40,200 +47,663 @@ var (
 	sentFile        = os.Getenv("SENT_FILE")
 	rateLimitDay    = os.Getenv("RATE_LIMIT_PER_DAY")
 	rateLimitMinute = os.Getenv("RATE_LIMIT_PER_MINUTE")
+
+	publishConcurrency  = os.Getenv("PUBLISH_CONCURRENCY")
+	metadataConcurrency = os.Getenv("METADATA_CONCURRENCY")
+	metadataRateLimit   = os.Getenv("METADATA_RATE_LIMIT_PER_MINUTE")
+
+	leaderElection         = os.Getenv("LEADER_ELECTION")
+	leaderElectionNs       = os.Getenv("LEADER_ELECTION_NAMESPACE")
+	leaderElectionLease    = os.Getenv("LEADER_ELECTION_LEASE")
+	leaderElectionDuration = os.Getenv("LEADER_ELECTION_LEASE_DURATION")
 )
 
 func main() {
-	ctx := context.Background()
-	client, err := indexing.NewService(ctx, option.WithCredentialsFile(credentialsFile))
+	var err error
+	schema, err = loadStateSchema()
+	if err != nil {
+		log.Fatal("Error in state file settings:", err)
+		return
+	}
+	stateStore, err = newStateStore()
 	if err != nil {
-		log.Fatal("Error creating indexing service:", err)
+		log.Fatal("Error in state file settings:", err)
+		return
+	}
+	if _, err := parseDurationDefault(apiTimeout, 0); err != nil {
+		log.Fatal("Error parsing API_TIMEOUT:", err)
+		return
+	}
+	if trailingSlash != "" && trailingSlash != "add" && trailingSlash != "remove" {
+		log.Fatalf("Unknown URL_TRAILING_SLASH %q, use add or remove", trailingSlash)
 		return
 	}
 
-	rateLimitDayInt, err := strconv.Atoi(rateLimitDay)
+	flushLogs, err := setupLogging()
 	if err != nil {
-		log.Fatal("Error converting rate limit per day to integer:", err)
+		log.Fatal(err)
 		return
 	}
+	defer flushLogs()
 
-	rateLimitMinuteInt, err := strconv.Atoi(rateLimitMinute)
+	command := "run"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	err = checkWritable(command)
 	if err != nil {
-		log.Fatal("Error converting rate limit per minute to integer:", err)
+		log.Fatal(err)
 		return
 	}
 
-	sleepDur := time.Minute/time.Duration(rateLimitMinuteInt) + time.Millisecond*100
+	if contains(stateCommands, command) {
+		err = lockState()
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
 
-	fmt.Println("Sleep duration (s): ", sleepDur.Seconds())
+	// Read-only commands use the local files, as loading would replace them under a running process
+	if stateSyncUrl != "" && readOnly != "true" {
+		stateSyncer, err = newStateSync()
+		if err == nil {
+			err = stateSyncer.load()
+		}
+		if err != nil {
+			log.Fatal("Error loading the state:", err)
+			return
+		}
+		defer func() {
+			err := saveState()
+			if err != nil {
+				logError("Error saving the state: %v", err)
+				flushLogs()
+				os.Exit(1)
+			}
+		}()
+	}
 
-	// Parse sitemap.xml
-	urls, err := parseSitemap(sitemapFile)
+	if _, ok := stateStore.(csvStore); ok && contains(stateCommands, command) {
+		upgraded, err := upgradeSentFile(sentFile)
+		if err != nil {
+			log.Fatal("Error upgrading the sent file:", err)
+			return
+		}
+		if upgraded {
+			logInfo("Upgraded %s to state file version %d", sentFile, stateFileVersion)
+		}
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "operator":
+			runOperator()
+			return
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "runs":
+			runRuns(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		case "sync":
+			runSync(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "validate":
+			runValidate(os.Args[2:])
+			return
+		case "delete":
+			runDelete(os.Args[2:])
+			return
+		case "status":
+			runUrlStatus(os.Args[2:])
+			return
+		case "indexed":
+			runIndexed(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "tail":
+			runTail(os.Args[2:])
+			return
+		case "estimate":
+			runEstimate(os.Args[2:])
+			return
+		case "sla":
+			runSla(os.Args[2:])
+			return
+		case "check-auth":
+			runCheckAuth(os.Args[2:])
+			return
+		case "keys":
+			runKeys(os.Args[2:])
+			return
+		case "login":
+			runLogin(os.Args[2:])
+			return
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+			return
+		}
+	}
+	run()
+}
+
+// run submits URLs from the sitemap to Google Index API
+func run() {
+	client, limits, cleanup, err := setupSubmission()
 	if err != nil {
-		log.Fatal("Error parsing sitemap:", err)
+		log.Fatal(err)
 		return
 	}
+	defer cleanup()
 
-	// Read indexed and sent URLs from CSV files
-	indexedUrls, err := readCsv(indexedFile)
+	err = submitOnce(interruptContext(), client, limits)
 	if err != nil {
-		log.Fatal("Error reading indexed URLs:", err)
+		log.Fatal(err)
 		return
 	}
+}
+
+// setupSubmission creates the API client, waits for leadership if leader election is enabled
+// and starts the metrics push and the control socket. The returned func stops them.
+func setupSubmission() (*indexingClient, rateLimits, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
 
-	sentUrls, err := readCsv(sentFile)
+	client, err := newIndexingService()
 	if err != nil {
-		log.Fatal("Error reading sent URLs:", err)
-		return
+		return nil, rateLimits{}, nil, fmt.Errorf("Error creating indexing service: %w", err)
 	}
 
-	todayAlreadySent, err := todaySent(sentFile)
+	limits, err := loadRateLimits()
 	if err != nil {
-		log.Fatal("Error reading today's sent URLs:", err)
-		return
+		return nil, rateLimits{}, nil, err
 	}
 
-	// Correct day limit
-	todayLimit := rateLimitDayInt - todayAlreadySent
+	// Only one replica submits URLs when leader election is enabled
+	if leaderElection == "true" {
+		elector, err := setupLeaderElection()
+		if err != nil {
+			return nil, rateLimits{}, nil, fmt.Errorf("Error setting up leader election: %w", err)
+		}
+		elector.waitForLeadership()
+		cleanups = append(cleanups, func() {
+			err := elector.release()
+			if err != nil {
+				logError("Error releasing lease: %v", err)
+			}
+		})
+	}
 
-	fmt.Printf("Today's limit: %d\n", todayLimit)
+	stopMetrics, err := startMetricsPush()
+	if err != nil {
+		cleanup()
+		return nil, rateLimits{}, nil, fmt.Errorf("Error setting up metrics push: %w", err)
+	}
+	cleanups = append(cleanups, stopMetrics)
 
-	count := 0
-	// Send URLs to Google Index API
-	for _, url := range urls {
-		if !contains(indexedUrls, url) && !contains(sentUrls, url) {
-			count++
-			if count > todayLimit {
-				// Sleep for a day
-				fmt.Println("Sleeping for a 24 hours...")
-				time.Sleep(24 * time.Hour)
-				count = 0
-				todayLimit = rateLimitDayInt
-			}
+	handleStatusSignal()
+	stopControl, err := startControlSocket()
+	if err != nil {
+		cleanup()
+		return nil, rateLimits{}, nil, fmt.Errorf("Error starting control socket: %w", err)
+	}
+	cleanups = append(cleanups, stopControl)
+	return client, limits, cleanup, nil
+}
 
-			fmt.Printf("%s %s", time.Now(), url)
+// submitOnce runs a single submission: it queues the pending URLs of the sitemap, submits them
+// and updates the snapshot
+func submitOnce(ctx context.Context, client *indexingClient, limits rateLimits) error {
+	archived, err := archiveState(sentFile)
+	if err != nil {
+		return fmt.Errorf("Error archiving sent URLs: %w", err)
+	}
+	if archived > 0 {
+		logInfo("Archived %d sent URLs older than %s", archived, stateRetention)
+	}
 
-			notification := indexing.UrlNotification{
-				Type: "URL_UPDATED",
-				Url:  url,
-			}
-			res, err := client.UrlNotifications.Publish(&notification).Do()
-			if err != nil {
-				fmt.Println("Error sending URL to Index API:", err)
-				continue
-			}
+	notifications, urls, err := loadPending()
+	if err != nil {
+		return err
+	}
 
-			// If status is not 200, log the error
-			if res.HTTPStatusCode != 200 {
-				fmt.Printf("Status code: %d\n", res.HTTPStatusCode)
-				continue
-			}
+	run := startRun("run")
+	setLogLabel("run_id", run.ID)
+	logInfo("Run ID: %s", run.ID)
+	stats, submitErr := submitUrls(ctx, client, notifications, sentFile, run.ID, limits)
+	err = finishRun(runsFilePath(sentFile), run, stats)
+	if err != nil {
+		logError("Error recording run: %v", err)
+	}
+	checkpointState()
+	if submitErr != nil {
+		return fmt.Errorf("Error submitting URLs: %w", submitErr)
+	}
 
-			// Append the sent URL to sent.csv
-			err = appendUrlToCsv(sentFile, url)
-			if err != nil {
-				fmt.Println("Error appending URL to sent.csv:", err)
-				continue
-			}
-			time.Sleep(sleepDur)
+	// The snapshot is only replaced after a complete run, so removed URLs aren't lost if it is interrupted
+	changed, err := writeSnapshot(snapshotFilePath(sentFile), urls)
+	if err != nil {
+		logError("Error writing sitemap snapshot: %v", err)
+	} else {
+		if changed {
+			pingSitemap(sitemapFile)
+		}
+		err = archiveSnapshot(snapshotFilePath(sentFile), archiveDirPath(sentFile))
+		if err != nil {
+			logError("Error archiving sitemap snapshot: %v", err)
+		}
+	}
+	err = checkSla(sentFile, run.Start)
+	if err != nil {
+		logError("Error checking the SLA: %v", err)
+	}
+	if len(stats.Locales) > 1 {
+		for _, locale := range sortedKeys(stats.Locales) {
+			logInfo("Locale %s: sent %d, failed %d", locale, stats.Locales[locale].Sent, stats.Locales[locale].Failed)
 		}
 	}
-	fmt.Printf("Finish. Sent %d URLs to Google Index API\n", count)
+	logInfo("Finish. Sent %d URLs to Google Index API", stats.Sent)
+	return nil
+}
+
+// newIndexingService creates the Google Index API client
+func newIndexingService() (*indexingClient, error) {
+	if (credentialsJSON != "" || impersonateServiceAccount != "" || oauthClientFile != "") && apiReplayDir == "" {
+		opt, err := credentialsOption(indexing.IndexingScope)
+		if err != nil {
+			return nil, err
+		}
+		return newIndexingClient(nil, opt)
+	}
+	return newCredentialsService(credentialsFile)
+}
+
+// newCredentialsService creates a Google Index API client authenticated by a credentials file.
+// A mock server set in API_ENDPOINT may be called without credentials, and replayed calls need none.
+func newCredentialsService(file string) (*indexingClient, error) {
+	if (apiEndpoint != "" && file == "") || apiReplayDir != "" {
+		return newIndexingClient(nil, option.WithoutAuthentication())
+	}
+	return newIndexingClient(nil, option.WithCredentialsFile(file))
 }
 
-// parseSitemap parses the given sitemap.xml file and returns a slice of URLs
-func parseSitemap(filePath string) ([]string, error) {
-	xmlFile, err := os.Open(filePath)
+// loadRateLimits reads the rate limits from environment variables
+func loadRateLimits() (rateLimits, error) {
+	rateLimitDayInt, err := strconv.Atoi(rateLimitDay)
 	if err != nil {
-		return nil, err
+		return rateLimits{}, fmt.Errorf("Error converting rate limit per day to integer: %w", err)
 	}
-	defer xmlFile.Close()
 
-	bytes, err := ioutil.ReadAll(xmlFile)
+	rateLimitMinuteInt, err := strconv.Atoi(rateLimitMinute)
 	if err != nil {
-		return nil, err
+		return rateLimits{}, fmt.Errorf("Error converting rate limit per minute to integer: %w", err)
 	}
 
-	var urlset Urlset
-	err = xml.Unmarshal(bytes, &urlset)
+	concurrency, err := parseIntDefault(publishConcurrency, 4)
 	if err != nil {
-		return nil, err
+		return rateLimits{}, fmt.Errorf("Error converting publish concurrency to integer: %w", err)
 	}
 
-	var urls []string
-	for _, url := range urlset.Urls {
-		urls = append(urls, url.Loc)
+	accounts, err := loadAccounts()
+	if err != nil {
+		return rateLimits{}, fmt.Errorf("Error loading service accounts: %w", err)
 	}
 
-	return urls, nil
+	return rateLimits{
+		perDay:         rateLimitDayInt,
+		perMinute:      rateLimitMinuteInt,
+		waitForNextDay: true,
+		concurrency:    concurrency,
+		key:            credentialsKey(),
+		accounts:       accounts,
+	}, nil
 }
 
-// readCsv reads URLs from a CSV file and returns them as a map
-func readCsv(filePath string) (map[string]struct{}, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+// loadPending parses the sitemap and returns notifications for URLs which are neither indexed nor sent yet,
+// along with the compacted sitemap URLs. The URLs are processed one at a time as they are parsed.
+func loadPending() ([]notification, []Url, error) {
+	// Read indexed and sent URLs from CSV files
+	indexedUrls, err := stateStore.Indexed()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading indexed URLs: %w", err)
+	}
+
+	lastSent, err := lastSentTimes(sentFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading sent URLs: %w", err)
+	}
+
+	var snapshot map[string]snapshotEntry
+	var lastNotified map[string]time.Time
+	if resubmitChanged == "true" {
+		snapshot, err = readSnapshot(snapshotFilePath(sentFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading sitemap snapshot: %w", err)
+		}
+		metadata, err := readMetadata(metadataFilePath(sentFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading metadata file: %w", err)
+		}
+		lastNotified = lastNotifiedTimes(lastSent, metadata)
+	}
+
+	// Parse sitemap.xml. Changed URLs are queued after the new ones.
+	var urls []Url
+	var pending, changed []notification
+	hreflang := map[string]string{}
+	err = streamSitemap(sitemapFile, func(url Url) error {
+		if n, ok := pendingNotification(url, sitemapFile, indexedUrls, lastSent); ok {
+			pending = append(pending, n)
+		} else if snapshot != nil {
+			if n, ok := changedNotification(snapshot, url, indexedUrls, lastNotified); ok {
+				changed = append(changed, n)
+			}
+		}
+		if locale, ok := hreflangLocale(url); ok {
+			hreflang[url.Loc] = locale
+		}
+		urls = append(urls, url.compact(hreflangGroup == "true"))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing sitemap: %w", err)
+	}
+	pending = append(pending, changed...)
+
+	pending, err = applyFailures(pending, sentFile, lastSent)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err = decayNotifications(pending, sentFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error applying the decay policy: %w", err)
+	}
+	pending, err = orderQueue(pending)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending = groupAlternates(pending, urls)
+	if movedFile == "" && autoDelete != "true" {
+		pending, err = groupByLocale(pending, hreflang)
+		return pending, urls, err
+	}
+
+	// Deletions go first, so moved URLs are removed before the updates of their new URLs
+	var notifications []notification
+	if movedFile != "" {
+		notifications, err = movedNotifications(movedFile, indexedUrls, lastSent)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading moved URLs: %w", err)
+		}
+	}
+	if autoDelete == "true" {
+		snapshot, err := readSnapshot(snapshotFilePath(sentFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading sitemap snapshot: %w", err)
+		}
+		notifications = append(notifications, removedNotifications(snapshot, urls, lastSent)...)
+	}
+
+	queued := map[string]struct{}{}
+	var ordered []notification
+	for _, n := range append(notifications, pending...) {
+		if !contains(queued, n.Url) {
+			queued[n.Url] = struct{}{}
+			ordered = append(ordered, n)
+		}
+	}
+	ordered, err = groupByLocale(ordered, hreflang)
+	return ordered, urls, err
+}
+
+// groupByLocale sets the locale of every notification, from the hreflang locales by URL or
+// detected, and, if LOCALE_QUOTAS is set, orders them so each locale gets its share of the quota
+func groupByLocale(notifications []notification, hreflang map[string]string) ([]notification, error) {
+	detector, err := newLocaleDetector(hreflang)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	for i := range notifications {
+		notifications[i].Locale = detector.detect(notifications[i].Url)
+	}
+	if localeQuotas == "" {
+		return notifications, nil
+	}
 
-	csvReader := csv.NewReader(file)
-	records, err := csvReader.ReadAll()
+	shares, err := parseLocaleQuotas(localeQuotas)
 	if err != nil {
 		return nil, err
 	}
+	return interleaveByLocale(notifications, shares), nil
+}
+
+// parseIntDefault parses an integer setting, returning def if it is empty
+func parseIntDefault(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
 
-	urls := map[string]struct{}{}
-	for _, record := range records {
-		urls[record[0]] = struct{}{}
+// parseFloatDefault parses a number setting, returning def if it is empty
+func parseFloatDefault(value string, def float64) (float64, error) {
+	if value == "" {
+		return def, nil
 	}
+	return strconv.ParseFloat(value, 64)
+}
 
-	return urls, nil
+// parseDurationDefault parses a duration setting, returning def if it is empty
+func parseDurationDefault(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
 }
 
-// todaySent reads the number of URLs sent today from a CSV file
-func todaySent(filePath string) (int, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return 0, err
+// setupLeaderElection creates a leader elector from environment variables
+func setupLeaderElection() (*leaderElector, error) {
+	leaseName := leaderElectionLease
+	if leaseName == "" {
+		leaseName = "google-indexing-api"
+	}
+
+	leaseDuration := 15 * time.Second
+	if leaderElectionDuration != "" {
+		var err error
+		leaseDuration, err = time.ParseDuration(leaderElectionDuration)
+		if err != nil {
+			return nil, fmt.Errorf("parsing LEADER_ELECTION_LEASE_DURATION: %w", err)
+		}
+	}
+	// Leases are held for whole seconds
+	if leaseDuration < time.Second {
+		return nil, fmt.Errorf("LEADER_ELECTION_LEASE_DURATION must be at least 1s")
 	}
-	defer file.Close()
 
-	csvReader := csv.NewReader(file)
-	records, err := csvReader.ReadAll()
+	return newLeaderElector(leaderElectionNs, leaseName, leaseDuration)
+}
+
+// streamSitemap parses the given sitemaps, feeds or URL lists, separated by commas, and
+// passes their URLs to emit one at a time as they are read, rewritten, filtered and with
+// the types of URL_TYPES_FILE. URLs in more than one of them are only passed once. If
+// filePath is empty the sitemaps are discovered from the robots.txt of SITE_ROOT.
+func streamSitemap(filePath string, emit func(Url) error) error {
+	locations, err := resolveSitemaps(filePath)
+	if err != nil {
+		return err
+	}
+	filter, err := loadUrlFilter()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	rewriter, err := loadUrlRewriter()
+	if err != nil {
+		return err
+	}
+	var types *urlTypes
+	if urlTypesFile != "" {
+		types, err = loadUrlTypes(urlTypesFile)
+		if err != nil {
+			return fmt.Errorf("reading URL types: %w", err)
+		}
 	}
 
-	today := time.Now().Format("2006-01-02")
-	sent := 0
-	// Read date stored in record[1] in a format 2024-04-05 and determine if it is today
-	for _, record := range records {
-		if strings.HasPrefix(record[1], today) {
-			sent++
+	seen := map[string]struct{}{}
+	filtered := 0
+	for _, location := range locations {
+		err := parseLocation(location, 0, func(url Url) error {
+			url.Loc = normalizeUrl(rewriter.rewrite(url.Loc))
+			for j := range url.Alternates {
+				url.Alternates[j].Href = normalizeUrl(rewriter.rewrite(url.Alternates[j].Href))
+			}
+			if contains(seen, url.Loc) {
+				return nil
+			}
+			seen[url.Loc] = struct{}{}
+			if !filter.keep(url.Loc) {
+				filtered++
+				return nil
+			}
+			url.Source = location
+			if types != nil {
+				types.apply(&url)
+			}
+			return emit(url)
+		})
+		if err != nil {
+			return err
 		}
 	}
-	return sent, nil
+	if filtered > 0 {
+		logInfo("Filtered out %d URLs", filtered)
+	}
+	if types != nil {
+		types.logIgnored()
+	}
+	return nil
+}
+
+// parseSitemap returns the URLs of streamSitemap, for commands which need all of them at once
+func parseSitemap(filePath string) ([]Url, error) {
+	var urls []Url
+	err := streamSitemap(filePath, func(url Url) error {
+		urls = append(urls, url)
+		return nil
+	})
+	return urls, err
 }
 
-// contains checks if a map contains a given string
-func contains(m map[string]struct{}, str string) bool {
-	_, ok := m[str]
-	return ok
+// sitemapLocations splits a comma separated list of sitemap paths and URLs. Local
+// directories stand for the files in them and glob patterns for the files they match,
+// both in lexical order.
+func sitemapLocations(list string) ([]string, error) {
+	var locations []string
+	for _, location := range strings.Split(list, ",") {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+		if isRemote(location) || strings.HasPrefix(location, crawlPrefix) {
+			locations = append(locations, location)
+			continue
+		}
+
+		pattern := location
+		if info, err := os.Stat(location); err == nil && info.IsDir() {
+			pattern = filepath.Join(location, "*")
+		} else if !strings.ContainsAny(location, "*?[") {
+			locations = append(locations, location)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sitemap pattern %q: %w", location, err)
+		}
+		found := 0
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(filepath.Base(match), ".") {
+				continue
+			}
+			locations = append(locations, match)
+			found++
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("no sitemap files match %s", location)
+		}
+	}
+	return locations, nil
 }
 
-// appendUrlToCsv appends a URL to a CSV file
-func appendUrlToCsv(filePath, url string) error {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// parseLocation reads a local file or http(s) URL, parses it in whatever format it is and
+// passes its URLs to emit
+func parseLocation(location string, depth int, emit func(Url) error) error {
+	if root, ok := strings.CutPrefix(location, crawlPrefix); ok {
+		urls, err := crawlSite(root)
+		if err != nil {
+			return err
+		}
+		return emitAll(urls, emit)
+	}
+	if isRemote(location) && sitemapCache != "false" {
+		return fetchSitemap(location, depth, emit)
+	}
+	file, err := openSource(location)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	err = writer.Write([]string{url, time.Now().Format(time.RFC3339)})
-	if err != nil {
-		return err
+	return parseInput(location, file, depth, emit)
+}
+
+// openSource opens a local file or fetches a http(s) URL
+func openSource(location string) (io.ReadCloser, error) {
+	if !isRemote(location) {
+		return os.Open(location)
 	}
-	writer.Flush()
 
-	return nil
+	timeout, err := parseDurationDefault(sitemapFetchTimeout, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SITEMAP_FETCH_TIMEOUT: %w", err)
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("fetching %s: status code %d", location, res.StatusCode)
+	}
+	return res.Body, nil
 }
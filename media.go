@@ -0,0 +1,42 @@
+package main
+
+// Image is an image:image entry of a sitemap URL
+type Image struct {
+	Loc string `xml:"http://www.google.com/schemas/sitemap-image/1.1 loc"`
+}
+
+// Video is a video:video entry of a sitemap URL
+type Video struct {
+	Title        string `xml:"http://www.google.com/schemas/sitemap-video/1.1 title"`
+	ThumbnailLoc string `xml:"http://www.google.com/schemas/sitemap-video/1.1 thumbnail_loc"`
+	ContentLoc   string `xml:"http://www.google.com/schemas/sitemap-video/1.1 content_loc"`
+	PlayerLoc    string `xml:"http://www.google.com/schemas/sitemap-video/1.1 player_loc"`
+}
+
+// compact returns the URL without its images and videos, which are only counted, and
+// without its hreflang alternates unless they are kept. The pipeline keeps this much of
+// every sitemap URL once it has been processed.
+func (u Url) compact(keepAlternates bool) Url {
+	u.images, u.videos = u.imageCount(), u.videoCount()
+	u.Images, u.Videos = nil, nil
+	if !keepAlternates {
+		u.Alternates = nil
+	}
+	return u
+}
+
+// imageCount returns the number of images of a URL, compacted or not
+func (u Url) imageCount() int {
+	if u.Images != nil {
+		return len(u.Images)
+	}
+	return u.images
+}
+
+// videoCount returns the number of videos of a URL, compacted or not
+func (u Url) videoCount() int {
+	if u.Videos != nil {
+		return len(u.Videos)
+	}
+	return u.videos
+}
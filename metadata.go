@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Metadata settings
+var (
+	metadataFile       = os.Getenv("METADATA_FILE")
+	metadataCacheTTL   = os.Getenv("METADATA_CACHE_TTL")
+	metadataSkipWindow = os.Getenv("METADATA_SKIP_WINDOW")
+)
+
+// metadataRecord is what Google last received for a URL, as reported by getMetadata
+type metadataRecord struct {
+	Url          string
+	LatestUpdate string
+	LatestRemove string
+	CheckedAt    time.Time
+}
+
+// metadataFilePath returns the path of the metadata file, which defaults to metadata.csv next to the sent file
+func metadataFilePath(sentFile string) string {
+	if metadataFile != "" {
+		return metadataFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "metadata.csv")
+}
+
+// fetchMetadata calls getMetadata for a URL. URLs Google never received a notification for
+// are not an error, their record has empty notify times.
+func fetchMetadata(ctx context.Context, client *indexingClient, url string) (metadataRecord, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	rec := metadataRecord{Url: url, CheckedAt: clock.Now()}
+	meta, err := client.UrlNotifications.GetMetadata().Url(url).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if meta.LatestUpdate != nil {
+		rec.LatestUpdate = meta.LatestUpdate.NotifyTime
+	}
+	if meta.LatestRemove != nil {
+		rec.LatestRemove = meta.LatestRemove.NotifyTime
+	}
+	return rec, nil
+}
+
+// readMetadata reads the metadata file, which is empty if it doesn't exist yet
+func readMetadata(filePath string) (map[string]metadataRecord, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return map[string]metadataRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]metadataRecord{}
+	for i, row := range rows {
+		if (i == 0 && row[0] == "url") || len(row) < 4 {
+			continue
+		}
+		checkedAt, _ := time.Parse(time.RFC3339, row[3])
+		records[row[0]] = metadataRecord{Url: row[0], LatestUpdate: row[1], LatestRemove: row[2], CheckedAt: checkedAt}
+	}
+	return records, nil
+}
+
+// writeMetadata replaces the metadata file with the given records sorted by URL
+func writeMetadata(filePath string, records map[string]metadataRecord) error {
+	rows := [][]string{{"url", "latest_update", "latest_remove", "checked_at"}}
+	for _, url := range sortedKeys(records) {
+		rec := records[url]
+		rows = append(rows, []string{rec.Url, rec.LatestUpdate, rec.LatestRemove, rec.CheckedAt.Format(time.RFC3339)})
+	}
+	data, err := appendRows(nil, ',', rows...)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// metadataCache serves getMetadata responses from the metadata file while they are
+// younger than METADATA_CACHE_TTL, so repeated lookups don't hit the API
+type metadataCache struct {
+	path string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	records map[string]metadataRecord
+	hits    int
+}
+
+// newMetadataCache loads the cache from the metadata file
+func newMetadataCache(sentFile string) (*metadataCache, error) {
+	ttl, err := parseDurationDefault(metadataCacheTTL, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("parsing METADATA_CACHE_TTL: %w", err)
+	}
+	path := metadataFilePath(sentFile)
+	records, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	return &metadataCache{path: path, ttl: ttl, records: records}, nil
+}
+
+// lookup returns the cached record of a URL if it is fresh, otherwise it calls getMetadata
+// within the limits of l and caches the response. force skips the cache.
+func (c *metadataCache) lookup(ctx context.Context, client *indexingClient, l *limiter, url string, force bool) (metadataRecord, error) {
+	c.mu.Lock()
+	rec, ok := c.records[url]
+	if ok && !force && clock.Now().Sub(rec.CheckedAt) < c.ttl {
+		c.hits++
+		c.mu.Unlock()
+		return rec, nil
+	}
+	c.mu.Unlock()
+
+	err := l.wait(ctx)
+	if err != nil {
+		return rec, err
+	}
+	rec, err = fetchMetadata(ctx, client, url)
+	if err != nil {
+		return rec, err
+	}
+	c.mu.Lock()
+	c.records[url] = rec
+	c.mu.Unlock()
+	return rec, nil
+}
+
+// save writes the cached records back to the metadata file
+func (c *metadataCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeMetadata(c.path, c.records)
+}
+
+// checkedSince checks if the cached record of a URL was fetched at or after t
+func (c *metadataCache) checkedSince(url string, t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec, ok := c.records[url]
+	return ok && !rec.CheckedAt.Before(t)
+}
+
+// lastNotifiedTimes combines the times URLs were last sent with the notify times Google
+// reported in the metadata file, keyed by sentKey, so notifications sent from another
+// machine or before the sent file was lost count too
+func lastNotifiedTimes(lastSent map[string]time.Time, records map[string]metadataRecord) map[string]time.Time {
+	times := make(map[string]time.Time, len(lastSent))
+	for key, t := range lastSent {
+		times[key] = t
+	}
+	for url, rec := range records {
+		for typ, notifyTime := range map[string]string{"URL_UPDATED": rec.LatestUpdate, "URL_DELETED": rec.LatestRemove} {
+			t, err := time.Parse(time.RFC3339Nano, notifyTime)
+			if err == nil && t.After(times[sentKey(url, typ)]) {
+				times[sentKey(url, typ)] = t
+			}
+		}
+	}
+	return times
+}
+
+// skipNotified calls getMetadata for the notifications about to be published and drops the ones
+// Google already received within METADATA_SKIP_WINDOW, unless their lastmod is later, so a stale or missing sent file doesn't
+// use up the publish quota on URLs notified from elsewhere. It does nothing unless the window is set.
+// Only due notifications are checked, and only until limit of them are kept, the ones after
+// are returned unchecked, as they can't be published with today's quota anyway. A negative limit
+// checks all.
+func skipNotified(ctx context.Context, client *indexingClient, notifications []notification, sentFile string, limit int, due func(notification) bool) ([]notification, error) {
+	if metadataSkipWindow == "" || len(notifications) == 0 {
+		return notifications, nil
+	}
+	window, err := time.ParseDuration(metadataSkipWindow)
+	if err != nil {
+		return nil, fmt.Errorf("parsing METADATA_SKIP_WINDOW: %w", err)
+	}
+	perMinute, err := parseIntDefault(metadataRateLimit, 180)
+	if err != nil {
+		return nil, fmt.Errorf("parsing METADATA_RATE_LIMIT_PER_MINUTE: %w", err)
+	}
+	concurrency, err := parseIntDefault(metadataConcurrency, 10)
+	if err != nil {
+		return nil, fmt.Errorf("parsing METADATA_CONCURRENCY: %w", err)
+	}
+	cache, err := newMetadataCache(sentFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata file: %w", err)
+	}
+
+	state := runStateOf(ctx)
+	metadataLimiter := newLimiter(perMinute, concurrency)
+	keep := make([]bool, len(notifications))
+	check := func(i int, n notification) {
+		defer metadataLimiter.release()
+		rec, err := cache.lookup(ctx, client, metadataLimiter, n.Url, false)
+		if err != nil {
+			// Without metadata the notification is published as usual
+			state.log.url(severityWarning, n.Url, "Error getting metadata of %s: %v", n.Url, err)
+			keep[i] = true
+			return
+		}
+		notifyTime := rec.LatestUpdate
+		if n.Type == "URL_DELETED" {
+			notifyTime = rec.LatestRemove
+		}
+		t, err := time.Parse(time.RFC3339Nano, notifyTime)
+		if err != nil || clock.Now().Sub(t) >= window {
+			keep[i] = true
+			return
+		}
+		// A page changed after the notification is published again
+		if lastmod, ok := parseLastmod(n.Lastmod); ok && lastmod.After(t) {
+			keep[i] = true
+			return
+		}
+		state.log.url(severityInfo, n.Url, "Skipping %s %s, Google received it at %s", n.Type, n.Url, notifyTime)
+		publishEvent("skipped", n, nil)
+	}
+
+	// Every round checks as many due notifications as the quota has room for, until it is
+	// filled or all are checked
+	kept, next := 0, 0
+	for next < len(notifications) && (limit < 0 || kept < limit) && ctx.Err() == nil {
+		var checked []int
+		for ; next < len(notifications) && (limit < 0 || kept+len(checked) < limit); next++ {
+			if !due(notifications[next]) {
+				keep[next] = true
+				continue
+			}
+			checked = append(checked, next)
+			metadataLimiter.acquire()
+			go check(next, notifications[next])
+		}
+		metadataLimiter.drain()
+		for _, i := range checked {
+			if keep[i] {
+				kept++
+			}
+		}
+	}
+	for i := next; i < len(notifications); i++ {
+		keep[i] = true
+	}
+
+	err = cache.save()
+	if err != nil {
+		return nil, fmt.Errorf("writing metadata file: %w", err)
+	}
+	var result []notification
+	for i, n := range notifications {
+		if keep[i] {
+			result = append(result, n)
+		}
+	}
+	if skipped := len(notifications) - len(result); skipped > 0 {
+		state.log.info("Skipped %d URLs Google received within %s", skipped, window)
+	}
+	return result, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics push settings
+var (
+	metricsPushInterval = os.Getenv("METRICS_PUSH_INTERVAL")
+	statsdAddr          = os.Getenv("STATSD_ADDR")
+	statsdPrefix        = os.Getenv("STATSD_PREFIX")
+	influxURL           = os.Getenv("INFLUX_URL")
+	influxToken         = os.Getenv("INFLUX_TOKEN")
+	influxMeasurement   = os.Getenv("INFLUX_MEASUREMENT")
+)
+
+// runMetrics holds the metrics of the current process
+var runMetrics = &metrics{}
+
+// metrics are counters and gauges describing the submission progress
+type metrics struct {
+	attempted      atomic.Int64
+	sent           atomic.Int64
+	failed         atomic.Int64
+	pending        atomic.Int64
+	quotaRemaining atomic.Int64
+}
+
+// metricsSnapshot is a point in time copy of the metrics
+type metricsSnapshot struct {
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+func (m *metrics) snapshot() metricsSnapshot {
+	return metricsSnapshot{
+		counters: map[string]int64{
+			"urls_attempted": m.attempted.Load(),
+			"urls_sent":      m.sent.Load(),
+			"urls_failed":    m.failed.Load(),
+		},
+		gauges: map[string]int64{
+			"urls_pending":    m.pending.Load(),
+			"quota_remaining": m.quotaRemaining.Load(),
+		},
+	}
+}
+
+// metricsPusher sends metrics to a monitoring system
+type metricsPusher interface {
+	push(s metricsSnapshot) error
+}
+
+// startMetricsPush pushes metrics to the configured systems at an interval.
+// The returned function stops pushing after a final push.
+func startMetricsPush() (func(), error) {
+	var pushers []metricsPusher
+	if statsdAddr != "" {
+		p, err := newStatsdPusher(statsdAddr, statsdPrefix)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+	if influxURL != "" {
+		pushers = append(pushers, newInfluxPusher(influxURL, influxToken, influxMeasurement))
+	}
+	if cloudMonitoring == "true" {
+		p, err := newCloudMonitoringPusher()
+		if err != nil {
+			return nil, fmt.Errorf("setting up Cloud Monitoring: %w", err)
+		}
+		pushers = append(pushers, p)
+	}
+	if len(pushers) == 0 {
+		return func() {}, nil
+	}
+
+	interval := 10 * time.Second
+	if metricsPushInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(metricsPushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("parsing metrics push interval: %w", err)
+		}
+	}
+
+	pushAll := func() {
+		s := runMetrics.snapshot()
+		for _, p := range pushers {
+			err := p.push(s)
+			if err != nil {
+				logError("Error pushing metrics: %v", err)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pushAll()
+			case <-stop:
+				pushAll()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}, nil
+}
+
+// sortedKeys returns the keys of a map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statsdPusher sends counter increments and gauges over UDP
+type statsdPusher struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]int64
+}
+
+func newStatsdPusher(addr, prefix string) (*statsdPusher, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = "indexapi."
+	}
+	return &statsdPusher{conn: conn, prefix: prefix, last: map[string]int64{}}, nil
+}
+
+func (p *statsdPusher) push(s metricsSnapshot) error {
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(s.counters) {
+		// StatsD counters are increments since the last push
+		value := s.counters[name]
+		fmt.Fprintf(&buf, "%s%s:%d|c\n", p.prefix, name, value-p.last[name])
+		p.last[name] = value
+	}
+	for _, name := range sortedKeys(s.gauges) {
+		fmt.Fprintf(&buf, "%s%s:%d|g\n", p.prefix, name, s.gauges[name])
+	}
+	_, err := p.conn.Write(buf.Bytes())
+	return err
+}
+
+// influxPusher writes metrics in InfluxDB line protocol to a write endpoint,
+// e.g. http://localhost:8086/api/v2/write?org=my-org&bucket=seo
+type influxPusher struct {
+	url         string
+	token       string
+	measurement string
+	tags        string
+	client      *http.Client
+}
+
+func newInfluxPusher(url, token, measurement string) *influxPusher {
+	if measurement == "" {
+		measurement = "indexapi"
+	}
+	tags := ""
+	if host, err := os.Hostname(); err == nil {
+		tags = ",host=" + strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(host)
+	}
+	return &influxPusher{
+		url:         url,
+		token:       token,
+		measurement: measurement,
+		tags:        tags,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *influxPusher) push(s metricsSnapshot) error {
+	var fields []string
+	for _, name := range sortedKeys(s.counters) {
+		fields = append(fields, fmt.Sprintf("%s=%di", name, s.counters[name]))
+	}
+	for _, name := range sortedKeys(s.gauges) {
+		fields = append(fields, fmt.Sprintf("%s=%di", name, s.gauges[name]))
+	}
+	line := fmt.Sprintf("%s%s %s %d\n", p.measurement, p.tags, strings.Join(fields, ","), time.Now().UnixNano())
+
+	req, err := http.NewRequest(http.MethodPost, p.url, strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write failed with status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"time"
+)
+
+var movedFile = os.Getenv("MOVED_FILE")
+
+// movedNotifications reads old_url,new_url pairs and returns a URL_DELETED notification
+// for every old URL followed by a URL_UPDATED notification for its new URL. Notifications
+// already sent according to lastSent, or new URLs which are indexed, are left out.
+func movedNotifications(filePath string, indexedUrls map[string]struct{}, lastSent map[string]time.Time) ([]notification, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = 2
+	csvReader.TrimLeadingSpace = true
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []notification
+	for i, record := range records {
+		oldUrl, newUrl := normalizeUrl(record[0]), normalizeUrl(record[1])
+		if i == 0 && oldUrl == "old_url" {
+			// Header row
+			continue
+		}
+		if oldUrl == "" || newUrl == "" {
+			return nil, fmt.Errorf("line %d: both the old and the new URL are required", i+1)
+		}
+
+		if _, ok := lastSent[sentKey(oldUrl, "URL_DELETED")]; !ok {
+			notifications = append(notifications, notification{
+				Url:    oldUrl,
+				Type:   "URL_DELETED",
+				Source: filePath,
+				Reason: "moved to " + newUrl,
+			})
+		}
+		if _, ok := lastSent[sentKey(newUrl, "URL_UPDATED")]; !ok && !contains(indexedUrls, newUrl) {
+			notifications = append(notifications, notification{
+				Url:    newUrl,
+				Type:   "URL_UPDATED",
+				Source: filePath,
+				Reason: "moved from " + oldUrl,
+			})
+		}
+	}
+	return notifications, nil
+}
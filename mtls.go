@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Settings of the TCP control endpoint, which is only served with mutual TLS
+var (
+	controlAddr    = os.Getenv("CONTROL_ADDR")
+	controlTLSCert = os.Getenv("CONTROL_TLS_CERT")
+	controlTLSKey  = os.Getenv("CONTROL_TLS_KEY")
+	controlTLSCA   = os.Getenv("CONTROL_TLS_CA")
+)
+
+// controlTLSConfig creates the TLS config of the control endpoint. Both sides present
+// the certificate in CONTROL_TLS_CERT and verify the peer against CONTROL_TLS_CA,
+// so the server only accepts clients with a certificate signed by that CA.
+func controlTLSConfig(server bool) (*tls.Config, error) {
+	if controlTLSCert == "" || controlTLSKey == "" || controlTLSCA == "" {
+		return nil, fmt.Errorf("CONTROL_TLS_CERT, CONTROL_TLS_KEY and CONTROL_TLS_CA must be set to use CONTROL_ADDR")
+	}
+
+	cert, err := tls.LoadX509KeyPair(controlTLSCert, controlTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading control certificate: %w", err)
+	}
+	caCert, err := os.ReadFile(controlTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", controlTLSCA)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if server {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// trailingSlash is the trailing slash policy of URL paths: add, remove or empty to keep them as they are
+var trailingSlash = os.Getenv("URL_TRAILING_SLASH")
+
+// urlStripParams are the query parameters removed from URLs, a trailing * matches any suffix
+var urlStripParams = os.Getenv("URL_STRIP_PARAMS")
+
+// stripParams are the parsed URL_STRIP_PARAMS
+var stripParams = parseStripParams(urlStripParams)
+
+// normalizeUrl returns the canonical form of a URL, so equivalent URLs are
+// deduplicated and matched against the state files. The host is lowercased and
+// converted to punycode, default ports are dropped, duplicate slashes in the path
+// are collapsed, and the path and query are percent-encoded consistently with
+// Unicode in NFC form. Fragments are dropped, as they address parts of the same
+// page. URLs which can't be parsed are returned unchanged.
+func normalizeUrl(rawUrl string) string {
+	rawUrl = strings.TrimSpace(rawUrl)
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return rawUrl
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host, port := u.Hostname(), u.Port()
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	host = strings.ToLower(host)
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	path := normalizeEscapes(u.EscapedPath(), "/:@")
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if path == "" {
+		path = "/"
+	}
+	path = applyTrailingSlash(path)
+
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(host)
+	b.WriteString(path)
+	query := stripQueryParams(u.RawQuery)
+	if query != "" || u.ForceQuery && u.RawQuery == "" {
+		b.WriteString("?" + normalizeEscapes(query, "/:@?"))
+	}
+	return b.String()
+}
+
+// parseStripParams reads the comma separated parameter names of URL_STRIP_PARAMS
+func parseStripParams(value string) []string {
+	var params []string
+	for _, param := range strings.Split(value, ",") {
+		param = strings.TrimSpace(param)
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// stripQueryParams removes the URL_STRIP_PARAMS parameters from a raw query, keeping the order of the others
+func stripQueryParams(rawQuery string) string {
+	if len(stripParams) == 0 || rawQuery == "" {
+		return rawQuery
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !matchesParam(name) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// matchesParam checks if a query parameter name is in URL_STRIP_PARAMS
+func matchesParam(name string) bool {
+	for _, pattern := range stripParams {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTrailingSlash adds or removes the trailing slash of a path by URL_TRAILING_SLASH.
+// Paths whose last segment looks like a file name, e.g. /feed.xml, don't get one added.
+func applyTrailingSlash(path string) string {
+	switch trailingSlash {
+	case "add":
+		last := path[strings.LastIndex(path, "/")+1:]
+		if last != "" && !strings.Contains(last, ".") {
+			return path + "/"
+		}
+	case "remove":
+		if len(path) > 1 {
+			return strings.TrimRight(path, "/")
+		}
+	}
+	return path
+}
+
+// normalizeEscapes decodes escaped unreserved and non-ASCII characters,
+// normalizes Unicode to NFC and encodes everything that isn't allowed literally,
+// with uppercase hex digits. Escaped reserved characters keep their meaning.
+func normalizeEscapes(s, allowed string) string {
+	var decoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if c >= 0x80 || isUnreserved(c) {
+				decoded.WriteByte(c)
+			} else {
+				decoded.WriteString(strings.ToUpper(s[i : i+3]))
+			}
+			i += 2
+			continue
+		}
+		decoded.WriteByte(s[i])
+	}
+
+	result := decoded.String()
+	if utf8.ValidString(result) {
+		result = norm.NFC.String(result)
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < len(result); i++ {
+		c := result[i]
+		isEscape := c == '%' && i+2 < len(result) && isHex(result[i+1]) && isHex(result[i+2])
+		if isEscape || isUnreserved(c) || strings.IndexByte("!$&'()*+,;="+allowed, c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
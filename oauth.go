@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/indexing/v3"
+	"google.golang.org/api/searchconsole/v1"
+)
+
+// Settings of the OAuth flow for site owners who sign in with their Google account instead
+// of setting up a service account. The client file is the "Desktop app" OAuth client
+// downloaded from the Google Cloud console.
+var (
+	oauthClientFile = os.Getenv("OAUTH_CLIENT_FILE")
+	oauthTokenFile  = os.Getenv("OAUTH_TOKEN_FILE")
+)
+
+// oauthScopes are the scopes the user consents to, Search Console is read for its sitemaps
+var oauthScopes = []string{indexing.IndexingScope, searchconsole.WebmastersReadonlyScope}
+
+// oauthTokenPath returns OAUTH_TOKEN_FILE or the token file in the user's config directory
+func oauthTokenPath() (string, error) {
+	if oauthTokenFile != "" {
+		return oauthTokenFile, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding the config directory, set OAUTH_TOKEN_FILE: %w", err)
+	}
+	return filepath.Join(dir, "indexapi", "token.json"), nil
+}
+
+// oauthConfig reads the OAuth client of OAUTH_CLIENT_FILE
+func oauthConfig() (*oauth2.Config, error) {
+	data, err := os.ReadFile(oauthClientFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading OAUTH_CLIENT_FILE: %w", err)
+	}
+	config, err := google.ConfigFromJSON(data, oauthScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OAUTH_CLIENT_FILE: %w", err)
+	}
+	return config, nil
+}
+
+// oauthContext returns a context whose token requests use the transport of API calls
+func oauthContext() (context.Context, error) {
+	base, err := apiTransport()
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base}), nil
+}
+
+// runLogin signs in with a Google account in the browser and saves the token, which API
+// calls then use instead of a service account. The consent is returned to a server on
+// the loopback interface, as Google requires for installed applications.
+func runLogin(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	noBrowser := fs.Bool("no-browser", false, "Only print the consent URL instead of opening it in a browser")
+	timeout := fs.Duration("timeout", 5*time.Minute, "How long to wait for the consent")
+	fs.Parse(args)
+
+	if oauthClientFile == "" {
+		log.Fatal("OAUTH_CLIENT_FILE must be set to log in")
+		return
+	}
+	config, err := oauthConfig()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	tokenPath, err := oauthTokenPath()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	ctx, err := oauthContext()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("Error listening for the consent:", err)
+		return
+	}
+	config.RedirectURL = "http://" + listener.Addr().String() + "/"
+	state := make([]byte, 16)
+	rand.Read(state)
+	verifier := oauth2.GenerateVerifier()
+	authUrl := config.AuthCodeURL(hex.EncodeToString(state), oauth2.AccessTypeOffline,
+		oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("prompt", "consent"))
+
+	type consent struct {
+		code string
+		err  error
+	}
+	consents := make(chan consent, 1)
+	var once sync.Once
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != hex.EncodeToString(state) {
+			http.Error(w, "Unexpected state", http.StatusBadRequest)
+			return
+		}
+		c := consent{code: query.Get("code")}
+		if e := query.Get("error"); e != "" {
+			c.err = fmt.Errorf("consent denied: %s", e)
+			fmt.Fprintln(w, "Login failed, you can close this window.")
+		} else {
+			fmt.Fprintln(w, "Logged in, you can close this window.")
+		}
+		once.Do(func() { consents <- c })
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Println("Open this URL to log in with the Google account which owns the site in Search Console:")
+	fmt.Println(authUrl)
+	if !*noBrowser {
+		err = openBrowser(authUrl)
+		if err != nil {
+			logWarning("Error opening a browser, open the URL yourself: %v", err)
+		}
+	}
+
+	var c consent
+	select {
+	case c = <-consents:
+	case <-interruptContext().Done():
+		log.Fatal("Login interrupted")
+		return
+	case <-time.After(*timeout):
+		log.Fatal("Timed out waiting for the consent")
+		return
+	}
+	if c.err != nil {
+		log.Fatal(c.err)
+		return
+	}
+	token, err := config.Exchange(ctx, c.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Fatal("Error exchanging the authorization code:", err)
+		return
+	}
+	err = saveOAuthToken(tokenPath, token)
+	if err != nil {
+		log.Fatal("Error saving the token:", err)
+		return
+	}
+	logInfo("Logged in, token saved to %s", tokenPath)
+}
+
+// openBrowser opens a URL in the default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+// saveOAuthToken writes the token to a file only the user can read
+func saveOAuthToken(path string, token *oauth2.Token) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// loadOAuthToken reads the token saved by login
+func loadOAuthToken(path string) (*oauth2.Token, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("not logged in, run indexapi login")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &token, nil
+}
+
+// savingTokenSource saves the token whenever it was refreshed, so the next run starts
+// with a valid access token
+type savingTokenSource struct {
+	source oauth2.TokenSource
+	path   string
+
+	mu     sync.Mutex
+	expiry time.Time
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !token.Expiry.Equal(s.expiry) {
+		s.expiry = token.Expiry
+		if err := saveOAuthToken(s.path, token); err != nil {
+			logWarning("Error saving the refreshed token: %v", err)
+		}
+	}
+	return token, nil
+}
+
+// oauthTokenSource returns the token source of the logged in user, which refreshes the
+// saved token when it expires
+func oauthTokenSource() (oauth2.TokenSource, error) {
+	config, err := oauthConfig()
+	if err != nil {
+		return nil, err
+	}
+	path, err := oauthTokenPath()
+	if err != nil {
+		return nil, err
+	}
+	token, err := loadOAuthToken(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := oauthContext()
+	if err != nil {
+		return nil, err
+	}
+	return &savingTokenSource{source: config.TokenSource(ctx, token), path: path, expiry: token.Expiry}, nil
+}
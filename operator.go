@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// API coordinates of the SitemapSubmission custom resource
+const (
+	crdGroup   = "indexing.alehano.github.io"
+	crdVersion = "v1alpha1"
+	crdPlural  = "sitemapsubmissions"
+)
+
+// Operator settings
+var (
+	operatorNamespace = os.Getenv("OPERATOR_NAMESPACE")
+	operatorStateDir  = os.Getenv("OPERATOR_STATE_DIR")
+	operatorResync    = os.Getenv("OPERATOR_RESYNC_INTERVAL")
+)
+
+// SitemapSubmission describes a site whose sitemap is submitted on a schedule
+type SitemapSubmission struct {
+	Metadata SitemapSubmissionMetadata `json:"metadata"`
+	Spec     SitemapSubmissionSpec     `json:"spec"`
+	Status   SitemapSubmissionStatus   `json:"status"`
+}
+
+type SitemapSubmissionMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	Generation      int64  `json:"generation"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type SitemapSubmissionSpec struct {
+	// SitemapURL is a http(s) URL or a path to the sitemap
+	SitemapURL        string            `json:"sitemapURL"`
+	CredentialsSecret SecretKeySelector `json:"credentialsSecret"`
+	Quota             Quota             `json:"quota"`
+	// Schedule is the interval between runs, e.g. "6h"
+	Schedule string `json:"schedule"`
+}
+
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type Quota struct {
+	PerDay    int `json:"perDay"`
+	PerMinute int `json:"perMinute"`
+}
+
+type SitemapSubmissionStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	LastRunTime        string      `json:"lastRunTime,omitempty"`
+	NextRunTime        string      `json:"nextRunTime,omitempty"`
+	LastSubmitted      int         `json:"lastSubmitted"`
+	SentToday          int         `json:"sentToday"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+type Condition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+type SitemapSubmissionList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []SitemapSubmission `json:"items"`
+}
+
+type Secret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+// operator reconciles SitemapSubmission resources
+type operator struct {
+	kube     *kubeClient
+	stateDir string
+	// items are the watched resources by namespace/name, only used by the watch loop
+	items map[string]SitemapSubmission
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// sharedStateSettings are the settings which point every resource at the same file,
+// so the operator can't keep the state of each resource apart when they are set
+var sharedStateSettings = map[string]*string{
+	"DEAD_LETTER_FILE":  &deadLetterFile,
+	"RETRY_QUEUE_FILE":  &retryQueueFile,
+	"METADATA_FILE":     &metadataFile,
+	"RUNS_FILE":         &runsFile,
+	"STATE_ARCHIVE_DIR": &stateArchiveDir,
+}
+
+// runOperator watches SitemapSubmission resources and submits their sitemaps on schedule
+func runOperator() {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		log.Fatal("Error creating Kubernetes client:", err)
+		return
+	}
+
+	for name, value := range sharedStateSettings {
+		if *value != "" {
+			log.Fatal("Error starting operator:", fmt.Errorf("%s is shared by all resources, unset it to keep the state of every resource in OPERATOR_STATE_DIR", name))
+			return
+		}
+	}
+
+	resync := time.Minute
+	if operatorResync != "" {
+		resync, err = time.ParseDuration(operatorResync)
+		if err != nil {
+			log.Fatal("Error parsing operator resync interval:", err)
+			return
+		}
+	}
+
+	stateDir := operatorStateDir
+	if stateDir == "" {
+		stateDir = "state"
+	}
+	err = os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		log.Fatal("Error creating state directory:", err)
+		return
+	}
+
+	if leaderElection == "true" {
+		elector, err := setupLeaderElection()
+		if err != nil {
+			log.Fatal("Error setting up leader election:", err)
+			return
+		}
+		elector.waitForLeadership()
+		defer func() {
+			err := elector.release()
+			if err != nil {
+				logError("Error releasing lease: %v", err)
+			}
+		}()
+	}
+
+	stopMetrics, err := startMetricsPush()
+	if err != nil {
+		log.Fatal("Error setting up metrics push:", err)
+		return
+	}
+	defer stopMetrics()
+
+	handleStatusSignal()
+	stopControl, err := startControlSocket()
+	if err != nil {
+		log.Fatal("Error starting control socket:", err)
+		return
+	}
+	defer stopControl()
+
+	op := &operator{kube: kube, stateDir: stateDir, running: map[string]bool{}}
+	// On interrupt the lease is released, submissions in flight are stopped by the same context
+	ctx := interruptContext()
+	logInfo("Operator started")
+	for {
+		err := op.listAndWatch(ctx, resync)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logError("Error watching SitemapSubmissions: %v", err)
+			runStatus.setNext("list SitemapSubmissions", clock.Now().Add(resync))
+			if sleepContext(ctx, resync) != nil {
+				return
+			}
+		}
+	}
+}
+
+// collectionPath returns the API path of the watched SitemapSubmissions
+func collectionPath() string {
+	if operatorNamespace != "" {
+		return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", crdGroup, crdVersion, operatorNamespace, crdPlural)
+	}
+	return fmt.Sprintf("/apis/%s/%s/%s", crdGroup, crdVersion, crdPlural)
+}
+
+// listAndWatch lists the resources and then follows their changes, starting a submission
+// whenever one is due. The watch is renewed from the last seen version after timeout and
+// whenever the next scheduled run comes. It returns nil when the resources must be listed
+// again because the watched version expired.
+func (op *operator) listAndWatch(ctx context.Context, timeout time.Duration) error {
+	var list SitemapSubmissionList
+	err := op.kube.do(http.MethodGet, collectionPath(), "", nil, &list)
+	if err != nil {
+		return fmt.Errorf("listing SitemapSubmissions: %w", err)
+	}
+	op.items = map[string]SitemapSubmission{}
+	for _, item := range list.Items {
+		op.items[resourceKey(item)] = item
+	}
+	version := list.Metadata.ResourceVersion
+
+	for {
+		wait, next := op.reconcileDue()
+		if wait <= 0 || wait > timeout {
+			wait, next = timeout, "renew SitemapSubmissions watch"
+		}
+		runStatus.setNext(next, clock.Now().Add(wait))
+
+		// The watch ends early when the next scheduled run comes
+		watchCtx, cancel := context.WithTimeout(ctx, wait)
+		err := op.kube.watch(watchCtx, collectionPath(), version, timeout, func(event kubeWatchEvent) error {
+			var item SitemapSubmission
+			err := json.Unmarshal(event.Object, &item)
+			if err != nil {
+				return fmt.Errorf("parsing %s event: %w", event.Type, err)
+			}
+			version = item.Metadata.ResourceVersion
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				op.items[resourceKey(item)] = item
+				if isDue(item) {
+					op.start(item)
+				}
+			case "DELETED":
+				delete(op.items, resourceKey(item))
+			}
+			return nil
+		})
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if isKubeStatus(err, http.StatusGone) {
+			logInfo("SitemapSubmissions changed too long ago to watch, listing them again")
+			return nil
+		}
+		if err != nil && watchCtx.Err() == nil {
+			return fmt.Errorf("watching SitemapSubmissions: %w", err)
+		}
+	}
+}
+
+// reconcileDue starts a submission for every resource which is due and returns the time
+// until the next scheduled run with its description, zero if none is scheduled
+func (op *operator) reconcileDue() (time.Duration, string) {
+	var wait time.Duration
+	var next string
+	for key, item := range op.items {
+		if isDue(item) {
+			op.start(item)
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, item.Status.NextRunTime)
+		if err != nil {
+			continue
+		}
+		if d := at.Sub(clock.Now()); wait == 0 || d < wait {
+			wait, next = d, "reconcile "+key
+		}
+	}
+	return wait, next
+}
+
+// start reconciles a resource in the background unless it's already being reconciled
+func (op *operator) start(item SitemapSubmission) {
+	key := resourceKey(item)
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.running[key] {
+		return
+	}
+	op.running[key] = true
+
+	go func() {
+		defer func() {
+			op.mu.Lock()
+			delete(op.running, key)
+			op.mu.Unlock()
+		}()
+		op.reconcile(item)
+	}()
+}
+
+// resourceKey returns the namespace/name of a resource
+func resourceKey(item SitemapSubmission) string {
+	return item.Metadata.Namespace + "/" + item.Metadata.Name
+}
+
+// isDue checks if the resource changed or its next scheduled run has come
+func isDue(item SitemapSubmission) bool {
+	if item.Status.ObservedGeneration != item.Metadata.Generation {
+		return true
+	}
+	next, err := time.Parse(time.RFC3339, item.Status.NextRunTime)
+	return err != nil || !clock.Now().Before(next)
+}
+
+// reconcile submits the resource's sitemap and records the outcome in its status
+func (op *operator) reconcile(item SitemapSubmission) {
+	key := resourceKey(item)
+	// Every reconcile has its own status and log labels, so concurrent runs don't mix them up
+	run := startRun("operator")
+	state := runState{
+		status: &status{started: clock.Now()},
+		log:    runLogger{labels: map[string]string{"run_id": run.ID, "resource": key}},
+	}
+	runStatus.track(key, state.status)
+	defer runStatus.untrack(key)
+	state.log.info("Reconciling SitemapSubmission %s", key)
+
+	status := item.Status
+	status.ObservedGeneration = item.Metadata.Generation
+	status.LastRunTime = clock.Now().UTC().Format(time.RFC3339)
+
+	interval, err := time.ParseDuration(item.Spec.Schedule)
+	if err != nil || interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	status.NextRunTime = clock.Now().Add(interval).UTC().Format(time.RFC3339)
+
+	// Mark the run as started so the watch doesn't start it again
+	err = op.updateStatus(item, status)
+	if err != nil {
+		state.log.error("Error updating status of %s: %v", key, err)
+	}
+
+	sent, sentToday, err := op.submit(withRunState(interruptContext(), state), item, run)
+	status.LastSubmitted = sent
+	status.SentToday = sentToday
+	if err != nil {
+		state.log.error("Error reconciling %s: %v", key, err)
+		status.Conditions = setCondition(status.Conditions, "Ready", "False", "SubmissionFailed", err.Error())
+	} else {
+		message := fmt.Sprintf("Sent %d URLs to Google Index API", sent)
+		status.Conditions = setCondition(status.Conditions, "Ready", "True", "Submitted", message)
+	}
+
+	err = op.updateStatus(item, status)
+	if err != nil {
+		state.log.error("Error updating status of %s: %v", key, err)
+	}
+}
+
+// submit sends the resource's sitemap URLs and returns the number sent in this run and today
+func (op *operator) submit(ctx context.Context, item SitemapSubmission, run *runRecord) (int, int, error) {
+	secretKey := item.Spec.CredentialsSecret.Key
+	if secretKey == "" {
+		secretKey = "credentials.json"
+	}
+
+	var secret Secret
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", item.Metadata.Namespace, item.Spec.CredentialsSecret.Name)
+	err := op.kube.do(http.MethodGet, path, "", nil, &secret)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading credentials secret: %w", err)
+	}
+	credentials, ok := secret.Data[secretKey]
+	if !ok {
+		return 0, 0, fmt.Errorf("key %q not found in secret %s", secretKey, item.Spec.CredentialsSecret.Name)
+	}
+
+	client, err := newIndexingClient(nil, option.WithCredentialsJSON(credentials))
+	if err != nil {
+		return 0, 0, fmt.Errorf("creating indexing service: %w", err)
+	}
+
+	urls, err := parseSitemap(item.Spec.SitemapURL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing sitemap: %w", err)
+	}
+
+	stateFile, err := op.stateFile(item)
+	if err != nil {
+		return 0, 0, fmt.Errorf("preparing state directory: %w", err)
+	}
+	_, err = archiveState(stateFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("archiving sent URLs: %w", err)
+	}
+	lastSent, err := lastSentTimes(stateFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading sent URLs: %w", err)
+	}
+
+	limits := rateLimits{
+		perDay:    item.Spec.Quota.PerDay,
+		perMinute: item.Spec.Quota.PerMinute,
+		key:       parseServiceAccountKey(credentials).id(),
+	}
+	if limits.perDay <= 0 {
+		limits.perDay = 200
+	}
+	if limits.perMinute <= 0 {
+		limits.perMinute = 60
+	}
+
+	pending, err := applyFailures(pendingNotifications(urls, item.Spec.SitemapURL, map[string]struct{}{}, lastSent), stateFile, lastSent)
+	if err != nil {
+		return 0, 0, err
+	}
+	pending, err = orderQueue(pending)
+	if err != nil {
+		return 0, 0, err
+	}
+	pending = groupAlternates(pending, urls)
+
+	stats, err := submitUrls(ctx, client, pending, stateFile, run.ID, limits)
+	if err != nil {
+		return stats.Sent, 0, err
+	}
+	err = finishRun(runsFilePath(stateFile), run, stats)
+	if err != nil {
+		return stats.Sent, 0, fmt.Errorf("recording run: %w", err)
+	}
+
+	sentToday, _, err := storeFor(stateFile).SentToday()
+	return stats.Sent, sentToday, err
+}
+
+// stateFile returns the sent file of a resource. Every resource has a directory of its own,
+// so its retry queue, dead letters, metadata, runs and archive aren't shared with others.
+// The files of older versions, which kept them all in one directory, are moved into it.
+func (op *operator) stateFile(item SitemapSubmission) (string, error) {
+	name := item.Metadata.Namespace + "_" + item.Metadata.Name
+	dir := filepath.Join(op.stateDir, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	stateFile := filepath.Join(dir, "sent.csv")
+
+	moves := map[string]string{
+		filepath.Join(op.stateDir, name+".csv"):      stateFile,
+		filepath.Join(op.stateDir, name+"_runs.csv"): runsFilePath(stateFile),
+	}
+	for from, to := range moves {
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		err := os.Rename(from, to)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return stateFile, nil
+}
+
+// updateStatus writes the status subresource of the resource
+func (op *operator) updateStatus(item SitemapSubmission, status SitemapSubmissionStatus) error {
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s/status",
+		crdGroup, crdVersion, item.Metadata.Namespace, crdPlural, item.Metadata.Name)
+	patch := map[string]interface{}{"status": status}
+	return op.kube.do(http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
+
+// setCondition adds or updates a condition, keeping the transition time if the status didn't change
+func setCondition(conditions []Condition, condType, status, reason, message string) []Condition {
+	now := clock.Now().UTC().Format(time.RFC3339)
+	for i, c := range conditions {
+		if c.Type != condType {
+			continue
+		}
+		if c.Status != status {
+			conditions[i].LastTransitionTime = now
+		}
+		conditions[i].Status = status
+		conditions[i].Reason = reason
+		conditions[i].Message = message
+		return conditions
+	}
+	return append(conditions, Condition{
+		Type:               condType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: now,
+	})
+}
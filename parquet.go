@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Minimal Parquet writer: a single row group of required columns stored
+// uncompressed with PLAIN encoding, which every Parquet reader understands.
+
+// Parquet physical types
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// Parquet converted types
+const (
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// parquetColumn is a required column of a Parquet file
+type parquetColumn struct {
+	Name string
+	// Type is the physical type, one of parquetInt32, parquetInt64 or parquetByteArray
+	Type int32
+	// ConvertedType is the logical type or -1 if the column has none
+	ConvertedType int32
+
+	values []interface{}
+}
+
+// parquetWriter collects rows and writes them as a Parquet file
+type parquetWriter struct {
+	columns []*parquetColumn
+	rows    int
+}
+
+// newParquetWriter creates a writer for the given columns
+func newParquetWriter(columns ...*parquetColumn) *parquetWriter {
+	return &parquetWriter{columns: columns}
+}
+
+// add appends a row, values must be int32, int64 or string matching the column types
+func (w *parquetWriter) add(values ...interface{}) {
+	for i, column := range w.columns {
+		column.values = append(column.values, values[i])
+	}
+	w.rows++
+}
+
+// writeTo writes the Parquet file to out
+func (w *parquetWriter) writeTo(out io.Writer) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunkInfo struct {
+		offset int64
+		size   int64
+	}
+	var chunks []chunkInfo
+
+	totalSize := int64(0)
+	if w.rows > 0 {
+		for _, column := range w.columns {
+			var data bytes.Buffer
+			for _, value := range column.values {
+				switch v := value.(type) {
+				case int32:
+					binary.Write(&data, binary.LittleEndian, v)
+				case int64:
+					binary.Write(&data, binary.LittleEndian, v)
+				case string:
+					binary.Write(&data, binary.LittleEndian, uint32(len(v)))
+					data.WriteString(v)
+				}
+			}
+
+			// PageHeader with a DataPageHeader
+			var header thriftWriter
+			header.fieldI32(1, 0) // DATA_PAGE
+			header.fieldI32(2, int32(data.Len()))
+			header.fieldI32(3, int32(data.Len()))
+			header.fieldStruct(5)
+			header.fieldI32(1, int32(w.rows))
+			header.fieldI32(2, 0) // PLAIN
+			header.fieldI32(3, 3) // RLE
+			header.fieldI32(4, 3) // RLE
+			header.stop()
+			header.stop()
+
+			offset := int64(file.Len())
+			file.Write(header.Bytes())
+			file.Write(data.Bytes())
+			size := int64(file.Len()) - offset
+			totalSize += size
+			chunks = append(chunks, chunkInfo{offset: offset, size: size})
+		}
+	}
+
+	// FileMetaData
+	var meta thriftWriter
+	meta.fieldI32(1, 1)
+	meta.fieldList(2, thriftStruct, len(w.columns)+1)
+	meta.fieldString(4, "schema")
+	meta.fieldI32(5, int32(len(w.columns)))
+	meta.stop()
+	for _, column := range w.columns {
+		meta.fieldI32(1, column.Type)
+		meta.fieldI32(3, 0) // REQUIRED
+		meta.fieldString(4, column.Name)
+		if column.ConvertedType >= 0 {
+			meta.fieldI32(6, column.ConvertedType)
+		}
+		meta.stop()
+	}
+	meta.fieldI64(3, int64(w.rows))
+	if w.rows > 0 {
+		meta.fieldList(4, thriftStruct, 1)
+		meta.fieldList(1, thriftStruct, len(w.columns))
+		for i, column := range w.columns {
+			meta.fieldI64(2, chunks[i].offset)
+			meta.fieldStruct(3)
+			meta.fieldI32(1, column.Type)
+			meta.fieldList(2, thriftI32, 1)
+			meta.varint(0) // PLAIN
+			meta.fieldList(3, thriftBinary, 1)
+			meta.binary(column.Name)
+			meta.fieldI32(4, 0) // UNCOMPRESSED
+			meta.fieldI64(5, int64(w.rows))
+			meta.fieldI64(6, chunks[i].size)
+			meta.fieldI64(7, chunks[i].size)
+			meta.fieldI64(9, chunks[i].offset)
+			meta.stop()
+			meta.stop()
+		}
+		meta.fieldI64(2, totalSize)
+		meta.fieldI64(3, int64(w.rows))
+		meta.stop()
+	} else {
+		meta.fieldList(4, thriftStruct, 0)
+	}
+	meta.fieldString(6, "indexapi")
+	meta.stop()
+
+	file.Write(meta.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(len(meta.Bytes())))
+	file.WriteString("PAR1")
+
+	_, err := out.Write(file.Bytes())
+	return err
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol used by Parquet metadata
+type thriftWriter struct {
+	bytes.Buffer
+	// lastField holds the last field ID of every open struct
+	lastField []int16
+}
+
+func (t *thriftWriter) varint(v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(v<<1^v>>63))
+	t.Write(buf[:n])
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	t.Write(buf[:n])
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.uvarint(uint64(len(s)))
+	t.WriteString(s)
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if len(t.lastField) == 0 {
+		t.lastField = append(t.lastField, 0)
+	}
+	last := &t.lastField[len(t.lastField)-1]
+	delta := id - *last
+	if delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) fieldString(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// fieldStruct starts a nested struct field, which must be closed with stop
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.lastField = append(t.lastField, 0)
+}
+
+// fieldList starts a list field, struct elements follow and are closed with stop each
+func (t *thriftWriter) fieldList(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.WriteByte(0xf0 | elemType)
+		t.uvarint(uint64(size))
+	}
+	if elemType == thriftStruct {
+		for i := 0; i < size; i++ {
+			t.lastField = append(t.lastField, 0)
+		}
+	}
+}
+
+// stop ends the innermost open struct
+func (t *thriftWriter) stop() {
+	t.WriteByte(0)
+	if len(t.lastField) > 0 {
+		t.lastField = t.lastField[:len(t.lastField)-1]
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps by field ID, with
+// integers as int64, binary as string and lists as slices
+type thriftReader struct {
+	t    *testing.T
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.t.Fatalf("thrift data ends at %d", r.pos)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("bad varint at %d", r.pos)
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := int(r.uvarint())
+		if r.pos+n > len(r.data) {
+			r.t.Fatalf("binary of %d bytes at %d overflows", n, r.pos)
+		}
+		s := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := []interface{}{}
+		for i := 0; i < size; i++ {
+			list = append(list, r.value(header&0x0f))
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	r.t.Fatalf("unexpected thrift type %d at %d", typ, r.pos)
+	return nil
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	last := int16(0)
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.varint())
+		}
+		fields[id] = r.value(header & 0x0f)
+		last = id
+	}
+}
+
+// parquetFile is a decoded Parquet file
+type parquetFile struct {
+	meta map[int16]interface{}
+	// values are the values of every column by name
+	values map[string][]interface{}
+}
+
+// readParquet decodes a file written by parquetWriter, checking its layout on the way
+func readParquet(t *testing.T, data []byte) parquetFile {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("file doesn't start and end with PAR1: %q", data)
+	}
+	footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerSize
+	if footerStart < 4 {
+		t.Fatalf("footer of %d bytes doesn't fit the file of %d bytes", footerSize, len(data))
+	}
+	r := &thriftReader{t: t, data: data[:len(data)-8], pos: footerStart}
+	file := parquetFile{meta: r.structure(), values: map[string][]interface{}{}}
+	if r.pos != len(r.data) {
+		t.Fatalf("footer ends at %d, want %d", r.pos, len(r.data))
+	}
+
+	schema := file.meta[2].([]interface{})
+	types := map[string]int64{}
+	for _, element := range schema[1:] {
+		fields := element.(map[int16]interface{})
+		types[fields[4].(string)] = fields[1].(int64)
+	}
+	for _, group := range file.meta[4].([]interface{}) {
+		rows := int(group.(map[int16]interface{})[3].(int64))
+		for _, chunk := range group.(map[int16]interface{})[1].([]interface{}) {
+			columnMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			name := columnMeta[3].([]interface{})[0].(string)
+			offset := int(columnMeta[9].(int64))
+			size := int(columnMeta[7].(int64))
+			if offset < 4 || offset+size > footerStart {
+				t.Fatalf("column %s at %d with %d bytes is outside the data", name, offset, size)
+			}
+
+			page := &thriftReader{t: t, data: data[:offset+size], pos: offset}
+			header := page.structure()
+			pageSize := int(header[3].(int64))
+			if page.pos+pageSize != offset+size {
+				t.Fatalf("page of column %s has %d bytes, the chunk has %d after the header", name, pageSize, offset+size-page.pos)
+			}
+			if n := header[5].(map[int16]interface{})[1].(int64); n != int64(rows) {
+				t.Fatalf("page of column %s has %d values, want %d", name, n, rows)
+			}
+			values := bytes.NewReader(data[page.pos : page.pos+pageSize])
+			for i := 0; i < rows; i++ {
+				var err error
+				switch types[name] {
+				case parquetInt32:
+					var v int32
+					err = binary.Read(values, binary.LittleEndian, &v)
+					file.values[name] = append(file.values[name], v)
+				case parquetInt64:
+					var v int64
+					err = binary.Read(values, binary.LittleEndian, &v)
+					file.values[name] = append(file.values[name], v)
+				case parquetByteArray:
+					var n uint32
+					err = binary.Read(values, binary.LittleEndian, &n)
+					s := make([]byte, n)
+					if err == nil {
+						_, err = io.ReadFull(values, s)
+					}
+					file.values[name] = append(file.values[name], string(s))
+				}
+				if err != nil {
+					t.Fatalf("reading value %d of column %s: %v", i, name, err)
+				}
+			}
+			if values.Len() != 0 {
+				t.Fatalf("page of column %s has %d bytes left", name, values.Len())
+			}
+		}
+	}
+	return file
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	pw := newParquetWriter(
+		&parquetColumn{Name: "url", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		&parquetColumn{Name: "time", Type: parquetInt64, ConvertedType: parquetTimestampMillis},
+		&parquetColumn{Name: "status", Type: parquetInt32, ConvertedType: -1},
+	)
+	pw.add("https://example.com/a", int64(1717236000000), int32(200))
+	pw.add("", int64(0), int32(-1))
+	pw.add("https://example.com/ü", int64(1717239600000), int32(429))
+	var buf bytes.Buffer
+	err := pw.writeTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := readParquet(t, buf.Bytes())
+	if file.meta[1] != int64(1) || file.meta[3] != int64(3) {
+		t.Errorf("footer has version %v and %v rows, want 1 and 3", file.meta[1], file.meta[3])
+	}
+	schema := file.meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[4] != "schema" || root[5] != int64(3) {
+		t.Errorf("schema root is %v, want schema with 3 children", root)
+	}
+	wantSchema := []map[int16]interface{}{
+		{1: int64(parquetByteArray), 3: int64(0), 4: "url", 6: int64(parquetUTF8)},
+		{1: int64(parquetInt64), 3: int64(0), 4: "time", 6: int64(parquetTimestampMillis)},
+		{1: int64(parquetInt32), 3: int64(0), 4: "status"},
+	}
+	for i, want := range wantSchema {
+		if got := schema[i+1]; !reflect.DeepEqual(got, want) {
+			t.Errorf("schema element %d is %v, want %v", i+1, got, want)
+		}
+	}
+	group := file.meta[4].([]interface{})[0].(map[int16]interface{})
+	// The column chunks fill the file between the magic number and the footer
+	footerSize := int(binary.LittleEndian.Uint32(buf.Bytes()[buf.Len()-8:]))
+	if dataSize := int64(buf.Len() - 4 - footerSize - 8); group[3] != int64(3) || group[2] != dataSize {
+		t.Errorf("row group has %v rows and %v bytes, want 3 and %d", group[3], group[2], dataSize)
+	}
+
+	want := map[string][]interface{}{
+		"url":    {"https://example.com/a", "", "https://example.com/ü"},
+		"time":   {int64(1717236000000), int64(0), int64(1717239600000)},
+		"status": {int32(200), int32(-1), int32(429)},
+	}
+	if !reflect.DeepEqual(file.values, want) {
+		t.Errorf("file has values %v, want %v", file.values, want)
+	}
+}
+
+func TestParquetWithoutRows(t *testing.T) {
+	pw := newParquetWriter(&parquetColumn{Name: "url", Type: parquetByteArray, ConvertedType: parquetUTF8})
+	var buf bytes.Buffer
+	err := pw.writeTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := readParquet(t, buf.Bytes())
+	if file.meta[3] != int64(0) || len(file.meta[4].([]interface{})) != 0 {
+		t.Errorf("footer of an empty file has %v rows and row groups %v", file.meta[3], file.meta[4])
+	}
+	if len(file.meta[2].([]interface{})) != 2 {
+		t.Errorf("schema is %v, want the root and url", file.meta[2])
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	sent := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	records := []sentRecord{
+		{Url: "https://example.com/a", Time: sent, RunID: "run1", Type: "URL_UPDATED", Images: 2},
+		{Url: "https://example.com/b", Time: sent.Add(time.Minute), Type: "URL_DELETED"},
+	}
+	var buf bytes.Buffer
+	err := exportParquet(&buf, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The schema has more than 14 elements, which takes the long form of Thrift list headers
+	file := readParquet(t, buf.Bytes())
+	if file.meta[3] != int64(2) {
+		t.Errorf("footer has %v rows, want 2", file.meta[3])
+	}
+	if n := len(file.meta[2].([]interface{})); n != 20 {
+		t.Errorf("schema has %d elements, want 20", n)
+	}
+	checks := map[string][]interface{}{
+		"url":    {"https://example.com/a", "https://example.com/b"},
+		"time":   {sent.UnixMilli(), sent.Add(time.Minute).UnixMilli()},
+		"run_id": {"run1", ""},
+		"type":   {"URL_UPDATED", "URL_DELETED"},
+		"images": {int32(2), int32(0)},
+	}
+	for name, want := range checks {
+		if got := file.values[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("column %s is %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Sitemap ping settings
+var (
+	sitemapPingUrls  = os.Getenv("SITEMAP_PING_URLS")
+	sitemapPublicUrl = os.Getenv("SITEMAP_PUBLIC_URL")
+)
+
+// pingSitemap tells search engines the sitemaps changed through their sitemap ping
+// endpoints. Pings don't use the Indexing API quota, so they complement submissions
+// for URLs beyond the daily limit. Errors are only logged.
+func pingSitemap(sitemaps string) {
+	if sitemapPingUrls == "" {
+		return
+	}
+	if sitemapPublicUrl != "" {
+		sitemaps = sitemapPublicUrl
+	}
+	locations, err := resolveSitemaps(sitemaps)
+	if err != nil {
+		logError("Error finding the sitemaps to ping: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, sitemap := range locations {
+		if !isRemote(sitemap) {
+			logWarning("Not pinging search engines, the sitemap %s isn't a public URL, set SITEMAP_PUBLIC_URL", sitemap)
+			continue
+		}
+		for _, endpoint := range strings.Split(sitemapPingUrls, ",") {
+			endpoint = strings.TrimSpace(endpoint)
+			if endpoint == "" {
+				continue
+			}
+			err := ping(client, endpoint+url.QueryEscape(sitemap))
+			if err != nil {
+				logError("Error pinging %s: %v", endpoint, err)
+				continue
+			}
+			logInfo("Pinged %s about the changed sitemap %s", endpoint, sitemap)
+		}
+	}
+}
+
+// ping requests a sitemap ping URL
+func ping(client *http.Client, pingUrl string) error {
+	res, err := client.Get(pingUrl)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Plan is a reviewable list of notifications produced by the plan command
+type Plan struct {
+	Created    time.Time   `json:"created"`
+	Sitemap    string      `json:"sitemap"`
+	TodayLimit int         `json:"today_limit"`
+	Entries    []PlanEntry `json:"entries"`
+}
+
+// PlanEntry is a single notification of a plan with the reason it was planned
+type PlanEntry struct {
+	Url    string `json:"url"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Locale string `json:"locale,omitempty"`
+	Images int    `json:"images,omitempty"`
+	Videos int    `json:"videos,omitempty"`
+}
+
+// runPlan writes a plan of the notifications the next run would send
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	out := fs.String("out", "plan.json", "Path of the plan file to write, - for stdout")
+	fs.Parse(args)
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	notifications, _, err := loadPending()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// The run would skip the notifications sent within the dedup window
+	store, err := newDedupStore(sentFile)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	todayAlreadySent, _, err := stateStore.SentToday()
+	if err != nil {
+		log.Fatal("Error reading today's sent URLs:", err)
+		return
+	}
+
+	plan := Plan{
+		Created:    clock.Now(),
+		Sitemap:    sitemapFile,
+		TodayLimit: limits.dailyQuota() - todayAlreadySent,
+		Entries:    []PlanEntry{},
+	}
+	if plan.Sitemap == "" && searchConsoleProperty != "" {
+		plan.Sitemap = searchConsoleProperty
+	}
+	if plan.Sitemap == "" {
+		plan.Sitemap = siteRoot
+	}
+	for _, n := range notifications {
+		if _, ok := store.due(n); !ok {
+			continue
+		}
+		plan.Entries = append(plan.Entries, PlanEntry{
+			Url:    n.Url,
+			Type:   n.Type,
+			Reason: n.Reason,
+			Locale: n.Locale,
+			Images: n.Images,
+			Videos: n.Videos,
+		})
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		log.Fatal("Error encoding plan:", err)
+		return
+	}
+	if *out == "-" {
+		fmt.Println(string(data))
+		return
+	}
+	err = os.WriteFile(*out, append(data, '\n'), 0644)
+	if err != nil {
+		log.Fatal("Error writing plan:", err)
+		return
+	}
+	fmt.Printf("Plan with %d URLs written to %s\n", len(plan.Entries), *out)
+}
+
+// runApply sends exactly the notifications of a plan file
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: apply <plan.json>")
+		return
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatal("Error reading plan:", err)
+		return
+	}
+	var plan Plan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		log.Fatal("Error parsing plan:", err)
+		return
+	}
+
+	client, err := newIndexingService()
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	// The plan is sent as it is, in the quota it was made for
+	limits.waitForNextDay = false
+	limits.planned = true
+
+	notifications, err := planNotifications(plan, fs.Arg(0))
+	if err != nil {
+		log.Fatal("Error applying plan:", err)
+		return
+	}
+
+	stopMetrics, err := startMetricsPush()
+	if err != nil {
+		log.Fatal("Error setting up metrics push:", err)
+		return
+	}
+	defer stopMetrics()
+
+	run := startRun("apply")
+	setLogLabel("run_id", run.ID)
+	logInfo("Run ID: %s", run.ID)
+	stats, submitErr := submitUrls(interruptContext(), client, notifications, sentFile, run.ID, limits)
+	err = finishRun(runsFilePath(sentFile), run, stats)
+	if err != nil {
+		logError("Error recording run: %v", err)
+	}
+	checkpointState()
+	if submitErr != nil {
+		log.Fatal("Error submitting URLs:", submitErr)
+		return
+	}
+	logInfo("Finish. Sent %d URLs to Google Index API", stats.Sent)
+}
+
+// planNotifications returns the notifications of a plan which are left to send. A plan only
+// holds on the day it was made and while no other run sent URLs since, as its entries and
+// today's limit were checked against the state at that time. Entries sent since were sent
+// by an interrupted apply of the plan, they are skipped and count against today's limit.
+func planNotifications(plan Plan, path string) ([]notification, error) {
+	now := clock.Now()
+	y, m, d := plan.Created.In(time.Local).Date()
+	if ny, nm, nd := now.Date(); y != ny || m != nm || d != nd {
+		return nil, fmt.Errorf("the plan was made on %s, make a new one for today's quota", plan.Created.Format(time.DateOnly))
+	}
+
+	planned := map[string]bool{}
+	for _, entry := range plan.Entries {
+		if entry.Type != "URL_UPDATED" && entry.Type != "URL_DELETED" {
+			return nil, fmt.Errorf("invalid notification type %q for %s", entry.Type, entry.Url)
+		}
+		planned[sentKey(entry.Url, entry.Type)] = true
+	}
+
+	// The sent file may store whole seconds only
+	created := plan.Created.Truncate(time.Second)
+	records, err := stateStore.SentSince(created)
+	if err != nil {
+		return nil, fmt.Errorf("reading sent URLs: %w", err)
+	}
+	sent := map[string]bool{}
+	for _, rec := range records {
+		key := sentKey(rec.Url, rec.Type)
+		if !planned[key] {
+			return nil, fmt.Errorf("the state changed since the plan was made, %s was sent at %s, make a new plan",
+				rec.Url, rec.Time.Format(time.RFC3339))
+		}
+		sent[key] = true
+	}
+
+	limit := plan.TodayLimit - len(sent)
+	var notifications []notification
+	for _, entry := range plan.Entries {
+		if sent[sentKey(entry.Url, entry.Type)] {
+			logURL(severityInfo, entry.Url, "Skipping already sent URL %s", entry.Url)
+			continue
+		}
+		if len(notifications) >= limit {
+			logInfo("Today's limit of the plan reached, %d URLs are left for a new plan", len(plan.Entries)-len(sent)-len(notifications))
+			break
+		}
+		notifications = append(notifications, notification{Url: entry.Url, Type: entry.Type, Source: "plan:" + path, Locale: entry.Locale,
+			Images: entry.Images, Videos: entry.Videos})
+	}
+	return notifications, nil
+}
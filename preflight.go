@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Preflight settings
+var preflight = os.Getenv("PREFLIGHT")
+
+// maxPreflightBody limits how much of a page is read to extract its metadata
+const maxPreflightBody = 2 << 20
+
+// preflightClient doesn't follow redirects, so a moved page isn't mistaken for a live one
+var preflightClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// preflightStatus returns the HTTP status code of a page. HEAD is tried first,
+// with a fallback to GET for servers which don't support it.
+func preflightStatus(url string) (int, error) {
+	res, err := preflightClient.Head(url)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotImplemented {
+			return res.StatusCode, nil
+		}
+	}
+
+	res, err = preflightClient.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// pageMetadata describes a page fetched during preflight
+type pageMetadata struct {
+	Status    int
+	Title     string
+	Canonical string
+	Published string
+	H1        string
+}
+
+// preflightPage fetches a page and extracts its metadata, so reports show
+// recognizable pages instead of bare URLs
+func preflightPage(url string) (pageMetadata, error) {
+	res, err := preflightClient.Get(url)
+	if err != nil {
+		return pageMetadata{}, err
+	}
+	defer res.Body.Close()
+
+	meta := pageMetadata{Status: res.StatusCode}
+	if !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return meta, nil
+	}
+	parsePageMetadata(io.LimitReader(res.Body, maxPreflightBody), &meta)
+	return meta, nil
+}
+
+// parsePageMetadata reads the title, canonical link, publish date and first h1 of an HTML page
+func parsePageMetadata(r io.Reader, meta *pageMetadata) {
+	tokenizer := html.NewTokenizer(r)
+	var inTitle, inH1 bool
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = meta.Title == ""
+			case "h1":
+				inH1 = meta.H1 == ""
+			case "link":
+				if strings.EqualFold(attr(token, "rel"), "canonical") && meta.Canonical == "" {
+					meta.Canonical = strings.TrimSpace(attr(token, "href"))
+				}
+			case "meta":
+				name := attr(token, "property")
+				if name == "" {
+					name = attr(token, "name")
+				}
+				if name == "" {
+					name = attr(token, "itemprop")
+				}
+				switch strings.ToLower(name) {
+				case "article:published_time", "datepublished", "date", "pubdate", "publish_date":
+					if meta.Published == "" {
+						meta.Published = strings.TrimSpace(attr(token, "content"))
+					}
+				}
+			}
+		case html.EndTagToken:
+			switch tokenizer.Token().Data {
+			case "title":
+				inTitle = false
+			case "h1":
+				inH1 = false
+			}
+		case html.TextToken:
+			text := strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+			if inTitle {
+				meta.Title = strings.TrimSpace(meta.Title + " " + text)
+			}
+			if inH1 {
+				meta.H1 = strings.TrimSpace(meta.H1 + " " + text)
+			}
+		}
+	}
+}
+
+// attr returns the value of an HTML attribute or an empty string
+func attr(token html.Token, name string) string {
+	for _, a := range token.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
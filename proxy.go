@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Network settings of the API clients, for machines which reach Google through a proxy
+var (
+	apiProxy    = os.Getenv("API_PROXY")
+	apiCABundle = os.Getenv("API_CA_BUNDLE")
+)
+
+// newAPITransport creates the base transport of the API clients. It connects through the
+// proxy in API_PROXY, or the one in HTTPS_PROXY and NO_PROXY if unset, and trusts the
+// certificates in API_CA_BUNDLE besides the system ones, as proxies which inspect TLS
+// present certificates of their own CA.
+func newAPITransport() (*http.Transport, error) {
+	transport, err := tunedTransport()
+	if err != nil {
+		return nil, err
+	}
+	if apiProxy != "" {
+		proxyUrl, err := url.Parse(apiProxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing API_PROXY: %w", err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("API_PROXY must be an http, https or socks5 URL, got %q", apiProxy)
+		}
+		if proxyUrl.Host == "" {
+			return nil, fmt.Errorf("API_PROXY has no host: %q", apiProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if apiCABundle != "" {
+		bundle, err := os.ReadFile(apiCABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading API_CA_BUNDLE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", apiCABundle)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+		transport.TLSClientConfig.MinVersion = tls.VersionTLS12
+	}
+	return transport, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// queueOrder is the order pending URLs are submitted in
+var queueOrder = os.Getenv("QUEUE_ORDER")
+
+// orderQueue sorts pending notifications so the daily quota is spent on the most
+// recently changed pages first. URLs without a valid lastmod go last, in input order.
+// QUEUE_ORDER=priority sorts by sitemap priority first, QUEUE_ORDER=sitemap keeps the
+// order of the input.
+func orderQueue(notifications []notification) ([]notification, error) {
+	switch queueOrder {
+	case "", "lastmod":
+		sort.SliceStable(notifications, func(i, j int) bool {
+			return fresher(notifications[i], notifications[j])
+		})
+		return notifications, nil
+	case "priority":
+		sort.SliceStable(notifications, func(i, j int) bool {
+			if notifications[i].Priority != notifications[j].Priority {
+				return notifications[i].Priority > notifications[j].Priority
+			}
+			return fresher(notifications[i], notifications[j])
+		})
+		return notifications, nil
+	case "sitemap":
+		return notifications, nil
+	default:
+		return nil, fmt.Errorf("unknown QUEUE_ORDER %q, use lastmod, priority or sitemap", queueOrder)
+	}
+}
+
+// fresher checks if a was modified more recently than b, URLs without a valid lastmod are the oldest
+func fresher(a, b notification) bool {
+	ta, aok := parseLastmod(a.Lastmod)
+	tb, bok := parseLastmod(b.Lastmod)
+	if aok != bok {
+		return aok
+	}
+	return ta.After(tb)
+}
+
+// parsePriority parses a sitemap priority, which defaults to 0.5 if it is missing or invalid
+func parsePriority(value string) float64 {
+	priority, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0.5
+	}
+	return priority
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter spaces out API calls to stay within a per minute rate and bounds
+// how many are in flight at once
+type limiter struct {
+	interval time.Duration
+	slots    chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+	// current is the interval in use, which grows while the API throttles calls
+	current     time.Duration
+	pausedUntil time.Time
+}
+
+// newLimiter creates a limiter for perMinute calls with up to concurrency in flight
+func newLimiter(perMinute, concurrency int) *limiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	l := &limiter{slots: make(chan struct{}, concurrency)}
+	if perMinute > 0 {
+		// Evenly spaced calls never exceed perMinute in any minute. The API's own count may
+		// still differ a little, which throttle adapts to.
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+	l.current = l.interval
+	return l
+}
+
+// acquire blocks until fewer than concurrency calls are in flight
+func (l *limiter) acquire() {
+	l.slots <- struct{}{}
+}
+
+// release frees the slot taken by acquire
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// wait blocks until the next call is allowed by the rate or ctx is done
+func (l *limiter) wait(ctx context.Context) error {
+	return l.waitN(ctx, 1)
+}
+
+// waitN blocks until the next n calls are allowed by the rate or ctx is done, for batch
+// requests whose calls all count against the quota
+func (l *limiter) waitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.current * time.Duration(n))
+	l.mu.Unlock()
+	return sleepContext(ctx, delay)
+}
+
+// drain blocks until all acquired slots are released
+func (l *limiter) drain() {
+	for i := 0; i < cap(l.slots); i++ {
+		l.slots <- struct{}{}
+	}
+	for i := 0; i < cap(l.slots); i++ {
+		<-l.slots
+	}
+}
+
+// maxThrottledInterval is the longest interval the limiter slows down to when throttled
+const maxThrottledInterval = time.Minute
+
+// throttle pauses all calls for the given time after the API rejected one for exceeding
+// the quota, and halves the rate. Calls rejected during the same pause slow it down once.
+func (l *limiter) throttle(pause time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := clock.Now()
+	if !now.Before(l.pausedUntil) {
+		if l.current == 0 {
+			l.current = 100 * time.Millisecond
+		} else {
+			l.current = min(l.current*2, maxThrottledInterval)
+		}
+		logWarning("Throttled by the API, pausing for %s and lowering the rate to %.1f per minute",
+			pause, float64(time.Minute)/float64(l.current))
+	}
+	until := now.Add(pause)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if l.next.Before(l.pausedUntil) {
+		l.next = l.pausedUntil
+	}
+}
+
+// restore speeds the rate back up by a tenth of the way to the configured one after a successful call
+func (l *limiter) restore() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current > l.interval {
+		l.current -= max((l.current-l.interval)/10, time.Millisecond)
+		if l.current < l.interval {
+			l.current = l.interval
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterSpacesCalls(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+	l := newLimiter(60, 1)
+
+	for i := 0; i < 3; i++ {
+		err := l.wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first call goes through at once, the others a second apart
+	if got := c.Now().Sub(start); got != 2*time.Second {
+		t.Errorf("3 calls at 60 per minute took %s, want 2s", got)
+	}
+
+	// A batch counts as many calls
+	err := l.waitN(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Now().Sub(start); got != 8*time.Second {
+		t.Errorf("a batch of 5 and a call took until %s, want 8s", got)
+	}
+}
+
+func TestLimiterIdleCallsDontBurst(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+	l := newLimiter(60, 1)
+
+	l.wait(context.Background())
+	c.advance(time.Minute)
+	l.wait(context.Background())
+	l.wait(context.Background())
+	// Time spent idle isn't saved up for a burst
+	if got := c.Now().Sub(start); got != time.Minute+time.Second {
+		t.Errorf("calls after an idle minute took until %s, want 1m1s", got)
+	}
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+	l := newLimiter(60, 1)
+
+	l.throttle(10 * time.Second)
+	if l.current != 2*time.Second {
+		t.Errorf("throttled interval = %s, want 2s", l.current)
+	}
+	// Calls rejected during the same pause slow the rate down once
+	l.throttle(5 * time.Second)
+	if l.current != 2*time.Second {
+		t.Errorf("interval after a second throttle in the pause = %s, want 2s", l.current)
+	}
+
+	l.wait(context.Background())
+	if got := c.Now().Sub(start); got != 10*time.Second {
+		t.Errorf("call after the pause went through at %s, want 10s", got)
+	}
+	l.wait(context.Background())
+	if got := c.Now().Sub(start); got != 12*time.Second {
+		t.Errorf("next throttled call went through at %s, want 12s", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.restore()
+	}
+	if l.current != l.interval {
+		t.Errorf("restored interval = %s, want %s", l.current, l.interval)
+	}
+}
+
+func TestLimiterThrottleIsCapped(t *testing.T) {
+	useFakeClock(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	l := newLimiter(60, 1)
+
+	for i := 0; i < 10; i++ {
+		l.throttle(time.Second)
+		clock.Sleep(time.Second)
+	}
+	if l.current != maxThrottledInterval {
+		t.Errorf("interval after repeated throttling = %s, want %s", l.current, maxThrottledInterval)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// readOnly makes every command inspect the state without writing it, so it can run
+// next to a process which is submitting URLs
+var readOnly = os.Getenv("READ_ONLY")
+
+// stateCommands are the commands which write state and can't run in read-only mode
+var stateCommands = map[string]struct{}{
+	"run":      {},
+	"operator": {},
+	"apply":    {},
+	"sync":     {},
+	"watch":    {},
+	"delete":   {},
+	"check":    {},
+	"indexed":  {},
+}
+
+// checkWritable fails if the command writes state while in read-only mode
+func checkWritable(command string) error {
+	if readOnly == "true" && contains(stateCommands, command) {
+		return fmt.Errorf("%s writes state and can't be used with READ_ONLY=true", command)
+	}
+	return nil
+}
+
+// readState reads a state file which a running process may be appending to.
+// Outside read-only mode a missing file is created if create is set. In read-only
+// mode the file is never created and a partial last row, which is still being
+// written, is left out.
+func readState(filePath string, create bool) (io.Reader, error) {
+	if readOnly != "true" {
+		flag := os.O_RDONLY
+		if create {
+			flag = os.O_RDWR | os.O_CREATE
+		}
+		file, err := os.OpenFile(filePath, flag, 0644)
+		if os.IsNotExist(err) {
+			return bytes.NewReader(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return bytes.NewReader(data), err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return bytes.NewReader(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data[:bytes.LastIndexByte(data, '\n')+1]), nil
+}
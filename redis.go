@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout limits how long connecting to Redis and every command may take
+const redisTimeout = 10 * time.Second
+
+// redisError is an error reply of a Redis command
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisClient is a connection to a Redis server speaking RESP, which is redialed after
+// network errors. Commands are serialized, as workers record sent URLs at once.
+type redisClient struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient parses a redis:// or rediss:// URL with an optional user, password and
+// database number, e.g. rediss://:secret@redis.example.com:6380/2
+func newRedisClient(rawUrl string) (*redisClient, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("expected a redis:// or rediss:// URL")
+	}
+	c := &redisClient{addr: u.Host, useTLS: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// dial connects, authenticates and selects the database
+func (c *redisClient) dial() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := c.roundTrip(setup)
+		if err == nil {
+			err = firstRedisError(replies)
+		}
+		if err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+// do sends a command and returns its reply: a string, an int64, a []byte, nil or a
+// []interface{} of those. An error reply is returned as the error.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(redisError); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands at once and returns their replies, including error replies
+func (c *redisClient) pipeline(cmds [][]string) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		err := c.dial()
+		if err != nil {
+			return nil, fmt.Errorf("connecting to Redis at %s: %w", c.addr, err)
+		}
+	}
+	replies, err := c.roundTrip(cmds)
+	if err != nil {
+		// The connection may be left in the middle of a reply
+		c.close()
+		return nil, err
+	}
+	return replies, nil
+}
+
+func (c *redisClient) roundTrip(cmds [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	w := bufio.NewWriter(c.conn)
+	for _, args := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		replies[i], err = readRedisReply(c.r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// readRedisReply reads a RESP reply
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		if string(data[n:]) != "\r\n" {
+			return nil, fmt.Errorf("Redis bulk reply of %d bytes isn't terminated by CRLF", n)
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected Redis reply %q", line)
+}
+
+// firstRedisError returns the first error among replies, including ones of a transaction
+func firstRedisError(replies []interface{}) error {
+	for _, reply := range replies {
+		switch reply := reply.(type) {
+		case redisError:
+			return reply
+		case []interface{}:
+			if err := firstRedisError(reply); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
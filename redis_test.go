@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"error", "-ERR unknown command 'FOO'\r\n", redisError("ERR unknown command 'FOO'")},
+		{"integer", ":1000\r\n", int64(1000)},
+		{"negative integer", ":-1\r\n", int64(-1)},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello")},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}},
+		{"bulk string with CRLF", "$7\r\na\r\nb\r\nc\r\n", []byte("a\r\nb\r\nc")},
+		{"nil bulk string", "$-1\r\n", nil},
+		{"nil array", "*-1\r\n", nil},
+		{"empty array", "*0\r\n", []interface{}{}},
+		{
+			name:  "array",
+			reply: "*3\r\n$3\r\nfoo\r\n$-1\r\n:7\r\n",
+			want:  []interface{}{[]byte("foo"), nil, int64(7)},
+		},
+		{
+			name:  "transaction with an error",
+			reply: "*2\r\n+OK\r\n*2\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n:1\r\n",
+			want:  []interface{}{"OK", []interface{}{redisError("WRONGTYPE Operation against a key holding the wrong kind of value"), int64(1)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.reply + "+next\r\n"))
+			got, err := readRedisReply(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reply is %#v, want %#v", got, tt.want)
+			}
+			// The whole reply was read and nothing more
+			if next, err := readRedisReply(r); next != "next" || err != nil {
+				t.Errorf("next reply is %#v, %v", next, err)
+			}
+		})
+	}
+}
+
+func TestReadRedisReplyErrors(t *testing.T) {
+	for name, reply := range map[string]string{
+		"empty":                   "",
+		"empty line":              "\r\n",
+		"unknown type":            "!3\r\n",
+		"bad integer":             ":12a\r\n",
+		"bad bulk length":         "$x\r\n",
+		"truncated line":          "+OK",
+		"truncated bulk string":   "$5\r\nhel",
+		"unterminated bulk":       "$3\r\nhello\r\n",
+		"truncated array":         "*2\r\n:1\r\n",
+		"bad element":             "*1\r\n?\r\n",
+		"bad array length":        "*two\r\n",
+		"bulk without terminator": "$2\r\nab",
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(reply)))
+			if err == nil {
+				t.Errorf("reply %q was read as %#v, want an error", reply, got)
+			}
+		})
+	}
+}
+
+// redisTestServer answers the commands of a connection with canned replies by the whole
+// command or its name. The returned function waits for the connection to close and
+// returns its commands.
+func redisTestServer(t *testing.T, replies map[string]string) (string, func() [][]string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var commands [][]string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			// Commands are arrays of bulk strings, like replies
+			cmd, err := readRedisReply(r)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range cmd.([]interface{}) {
+				args = append(args, string(arg.([]byte)))
+			}
+			commands = append(commands, args)
+			reply, ok := replies[strings.Join(args, " ")]
+			if !ok {
+				reply, ok = replies[args[0]]
+			}
+			if !ok {
+				reply = "-ERR unknown command\r\n"
+			}
+			io.WriteString(conn, reply)
+		}
+	}()
+	return listener.Addr().String(), func() [][]string {
+		<-done
+		return commands
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	addr, commands := redisTestServer(t, map[string]string{
+		"AUTH":   "+OK\r\n",
+		"SELECT": "+OK\r\n",
+		"GET":    "$4\r\nsent\r\n",
+		"HMGET":  "*2\r\n$1\r\na\r\n$-1\r\n",
+		"INCR":   "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+	})
+	c, err := newRedisClient("redis://indexapi:s3cret%20pw@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.do("GET", "url:https://example.com/a b")
+	if err != nil || !reflect.DeepEqual(got, []byte("sent")) {
+		t.Errorf("GET = %#v, %v", got, err)
+	}
+	replies, err := c.pipeline([][]string{{"HMGET", "h", "a", "b"}, {"INCR", "h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{[]interface{}{[]byte("a"), nil}, redisError("WRONGTYPE Operation against a key holding the wrong kind of value")}; !reflect.DeepEqual(replies, want) {
+		t.Errorf("pipeline replies are %#v, want %#v", replies, want)
+	}
+	_, err = c.do("INCR", "h")
+	var redisErr redisError
+	if !errors.As(err, &redisErr) {
+		t.Errorf("INCR = %v, want the error reply", err)
+	}
+	c.mu.Lock()
+	c.close()
+	c.mu.Unlock()
+
+	want := [][]string{
+		{"AUTH", "indexapi", "s3cret pw"},
+		{"SELECT", "2"},
+		{"GET", "url:https://example.com/a b"},
+		{"HMGET", "h", "a", "b"},
+		{"INCR", "h"},
+		{"INCR", "h"},
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server got %q, want %q", got, want)
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	type settings struct {
+		addr               string
+		useTLS             bool
+		username, password string
+		db                 int
+	}
+	tests := []struct {
+		url  string
+		want settings
+	}{
+		{"redis://localhost", settings{addr: "localhost:6379"}},
+		{"rediss://:secret@redis.example.com:6380/2", settings{addr: "redis.example.com:6380", useTLS: true, password: "secret", db: 2}},
+		{"redis://user:pw@[::1]/", settings{addr: "[::1]:6379", username: "user", password: "pw"}},
+	}
+	for _, tt := range tests {
+		c, err := newRedisClient(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if got := (settings{c.addr, c.useTLS, c.username, c.password, c.db}); got != tt.want {
+			t.Errorf("%s is parsed as %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+	for _, url := range []string{"http://localhost", "redis://localhost/db", "://"} {
+		if _, err := newRedisClient(url); err == nil {
+			t.Errorf("%s was accepted", url)
+		}
+	}
+}
+
+// redisArray is an array reply of bulk strings
+func redisArray(values ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(values))
+	for _, v := range values {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	}
+	return reply
+}
+
+func TestRedisStoreLookups(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+	var values []string
+	for _, rec := range lookupRecords(now) {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, string(data))
+	}
+	addr, _ := redisTestServer(t, map[string]string{
+		"EVAL":   ":5\r\n",
+		"EXISTS": ":1\r\n",
+		"LRANGE indexapi:sent:url:https://example.com/a 0 -1":       redisArray(values[0], values[2], values[3]),
+		"LRANGE indexapi:sent:url:https://example.com/c 0 -1":       redisArray(values[4]),
+		"LRANGE indexapi:sent:url:https://example.com/missing 0 -1": redisArray(),
+		"HVALS indexapi:sent:latest":                                redisArray(values[4], values[1], values[3], values[2]),
+		"LRANGE indexapi:sent:log -1000 -1":                         redisArray(values...),
+		"HGETALL indexapi:sent:day:2024-06-01":                      redisArray("total", "4", "key:", "4"),
+	})
+	prevUrl, prevPrefix := redisUrl, redisPrefix
+	redisUrl, redisPrefix = "redis://"+addr, ""
+	redisOnce, redisState, redisSetErr = sync.Once{}, nil, nil
+	redisIndexOnce, redisIndexed, redisIndexErr = sync.Once{}, false, nil
+	t.Cleanup(func() {
+		if redisState != nil {
+			redisState.close()
+		}
+		redisUrl, redisPrefix = prevUrl, prevPrefix
+		redisOnce, redisState, redisSetErr = sync.Once{}, nil, nil
+		redisIndexOnce, redisIndexed, redisIndexErr = sync.Once{}, false, nil
+	})
+
+	checkStoreLookups(t, redisStore{}, now)
+}
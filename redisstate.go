@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis backend settings, so the state survives containers and is shared by instances
+var (
+	redisUrl    = os.Getenv("REDIS_URL")
+	redisPrefix = os.Getenv("REDIS_PREFIX")
+)
+
+// redisDayTTL is how long the counters of a day are kept
+const redisDayTTL = 8 * 24 * time.Hour
+
+var (
+	redisOnce   sync.Once
+	redisState  *redisClient
+	redisSetErr error
+
+	redisIndexOnce sync.Once
+	redisIndexed   bool
+	redisIndexErr  error
+)
+
+// openRedis creates the client of REDIS_URL once per run, it connects on the first command
+func openRedis() (*redisClient, error) {
+	redisOnce.Do(func() {
+		if redisUrl == "" {
+			redisSetErr = fmt.Errorf("REDIS_URL must be set with STATE_BACKEND=redis")
+			return
+		}
+		redisState, redisSetErr = newRedisClient(redisUrl)
+		if redisSetErr != nil {
+			redisSetErr = fmt.Errorf("parsing REDIS_URL: %w", redisSetErr)
+		}
+	})
+	return redisState, redisSetErr
+}
+
+// redisKey returns a key under REDIS_PREFIX:
+//
+//	sent:log            list of all sent records, oldest first
+//	sent:url:<url>      list of the sent records of a URL, oldest first
+//	sent:url-index      set once the lists of the URLs hold all records of sent:log
+//	sent:urls           set of the sent URLs
+//	sent:latest         hash of the latest record of every URL and type, by sentKey
+//	sent:day:<date>     hash of the URLs sent on a day, the total and per service account
+//	indexed             set of the indexed URLs
+//	failed:<queue>      list of failed notifications of the dead_letter or retry queue
+func redisKey(name string) string {
+	prefix := redisPrefix
+	if prefix == "" {
+		prefix = "indexapi:"
+	}
+	return prefix + name
+}
+
+// redisDayKey returns the key of the counters of today
+func redisDayKey() string {
+	return redisKey("sent:day:" + clock.Now().Format("2006-01-02"))
+}
+
+// redisList reads all items of a list
+func redisList(key string) ([][]byte, error) {
+	client, err := openRedis()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := client.do("LRANGE", key, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return redisBulks(reply), nil
+}
+
+// redisIndexScript fills the lists of the URLs from sent:log, atomically so records sent
+// meanwhile aren't missed or added twice. KEYS are sent:log and sent:url-index, ARGV[1]
+// is the prefix of the lists.
+const redisIndexScript = `
+if redis.call('EXISTS', KEYS[2]) == 1 then return 0 end
+local seen = {}
+local log = redis.call('LRANGE', KEYS[1], 0, -1)
+for _, v in ipairs(log) do
+	local key = ARGV[1] .. cjson.decode(v).Url
+	if not seen[key] then
+		redis.call('DEL', key)
+		seen[key] = true
+	end
+	redis.call('RPUSH', key, v)
+end
+redis.call('SET', KEYS[2], '1')
+return #log`
+
+// redisUrlIndex checks once per run if the lists of the URLs are complete, and fills them
+// from the records sent by older versions if not and the state may be written
+func redisUrlIndex() (bool, error) {
+	redisIndexOnce.Do(func() {
+		client, err := openRedis()
+		if err != nil {
+			redisIndexErr = err
+			return
+		}
+		if readOnly != "true" {
+			_, err = client.do("EVAL", redisIndexScript, "2", redisKey("sent:log"), redisKey("sent:url-index"), redisKey("sent:url:"))
+			if err != nil {
+				redisIndexErr = fmt.Errorf("indexing the sent records by URL: %w", err)
+				return
+			}
+		}
+		reply, err := client.do("EXISTS", redisKey("sent:url-index"))
+		redisIndexed, redisIndexErr = reply == int64(1), err
+	})
+	return redisIndexed, redisIndexErr
+}
+
+// parseRedisRecords decodes sent records
+func parseRedisRecords(values [][]byte) ([]sentRecord, error) {
+	records := make([]sentRecord, 0, len(values))
+	for _, value := range values {
+		var rec sentRecord
+		err := json.Unmarshal(value, &rec)
+		if err != nil {
+			return nil, err
+		}
+		rec.Url = normalizeUrl(rec.Url)
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// redisBulks returns the bulk strings of an array reply
+func redisBulks(reply interface{}) [][]byte {
+	items, _ := reply.([]interface{})
+	values := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if value, ok := item.([]byte); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// redisStore keeps the state in the keys of a Redis server
+type redisStore struct{}
+
+// Get reads the lists of the URLs at once
+func (s redisStore) Get(urls ...string) ([]sentRecord, error) {
+	indexed, err := redisUrlIndex()
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		// The state of older versions isn't indexed by URL in read-only mode
+		records, err := s.Sent()
+		return recordsOf(records, urls), err
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	client, err := openRedis()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([][]string, len(urls))
+	for i, url := range urls {
+		cmds[i] = []string{"LRANGE", redisKey("sent:url:" + url), "0", "-1"}
+	}
+	replies, err := client.pipeline(cmds)
+	if err == nil {
+		err = firstRedisError(replies)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []sentRecord
+	for _, reply := range replies {
+		found, err := parseRedisRecords(redisBulks(reply))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// Latest reads the sent:latest hash
+func (redisStore) Latest() ([]sentRecord, error) {
+	client, err := openRedis()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := client.do("HVALS", redisKey("sent:latest"))
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseRedisRecords(redisBulks(reply))
+	if err != nil {
+		return nil, err
+	}
+	return latestRecords(records), nil
+}
+
+// redisPageSize is the number of records SentSince reads at a time
+const redisPageSize = 1000
+
+// SentSince reads sent:log backwards a page at a time, as records are added in the order
+// they are sent
+func (redisStore) SentSince(t time.Time) ([]sentRecord, error) {
+	client, err := openRedis()
+	if err != nil {
+		return nil, err
+	}
+	var records []sentRecord
+	for end := -1; ; end -= redisPageSize {
+		reply, err := client.do("LRANGE", redisKey("sent:log"), strconv.Itoa(end-redisPageSize+1), strconv.Itoa(end))
+		if err != nil {
+			return nil, err
+		}
+		page, err := parseRedisRecords(redisBulks(reply))
+		if err != nil {
+			return nil, err
+		}
+		for i := len(page) - 1; i >= 0; i-- {
+			if page[i].Time.Before(t) {
+				slices.Reverse(records)
+				return records, nil
+			}
+			records = append(records, page[i])
+		}
+		if len(page) < redisPageSize {
+			slices.Reverse(records)
+			return records, nil
+		}
+	}
+}
+
+func (redisStore) Sent() ([]sentRecord, error) {
+	values, err := redisList(redisKey("sent:log"))
+	if err != nil {
+		return nil, err
+	}
+	return parseRedisRecords(values)
+}
+
+// MarkSent records a sent URL and counts it for today, in one transaction
+func (redisStore) MarkSent(rec sentRecord) error {
+	client, err := openRedis()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	day := redisDayKey()
+	replies, err := client.pipeline([][]string{
+		{"MULTI"},
+		{"RPUSH", redisKey("sent:log"), string(data)},
+		{"RPUSH", redisKey("sent:url:" + rec.Url), string(data)},
+		{"SADD", redisKey("sent:urls"), rec.Url},
+		{"HSET", redisKey("sent:latest"), sentKey(rec.Url, rec.Type), string(data)},
+		{"HINCRBY", day, "total", "1"},
+		{"HINCRBY", day, "key:" + rec.Key, "1"},
+		{"EXPIRE", day, strconv.Itoa(int(redisDayTTL.Seconds()))},
+		{"EXEC"},
+	})
+	if err != nil {
+		return err
+	}
+	return firstRedisError(replies)
+}
+
+// SentToday reads the counters of today instead of all sent records
+func (redisStore) SentToday() (int, map[string]int, error) {
+	client, err := openRedis()
+	if err != nil {
+		return 0, nil, err
+	}
+	reply, err := client.do("HGETALL", redisDayKey())
+	if err != nil {
+		return 0, nil, err
+	}
+	items, _ := reply.([]interface{})
+	total, byKey := 0, map[string]int{}
+	for i := 0; i+1 < len(items); i += 2 {
+		field, _ := items[i].([]byte)
+		value, _ := items[i+1].([]byte)
+		n, _ := strconv.Atoi(string(value))
+		if key, ok := strings.CutPrefix(string(field), "key:"); ok {
+			byKey[key] = n
+		} else if string(field) == "total" {
+			total = n
+		}
+	}
+	return total, byKey, nil
+}
+
+func (redisStore) Indexed() (map[string]struct{}, error) {
+	client, err := openRedis()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := client.do("SMEMBERS", redisKey("indexed"))
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	urls := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		if url, ok := item.([]byte); ok {
+			urls[normalizeUrl(string(url))] = struct{}{}
+		}
+	}
+	return withIndexedFile(urls)
+}
+
+func (redisStore) MarkIndexed(url string) error {
+	client, err := openRedis()
+	if err != nil {
+		return err
+	}
+	_, err = client.do("SADD", redisKey("indexed"), url)
+	return err
+}
+
+func (redisStore) Failures(queue string) ([]failedNotification, error) {
+	values, err := redisList(redisKey("failed:" + queue))
+	if err != nil {
+		return nil, err
+	}
+	failures := make([]failedNotification, 0, len(values))
+	for _, value := range values {
+		var f failedNotification
+		err = json.Unmarshal(value, &f)
+		if err != nil {
+			return nil, err
+		}
+		f.Url = normalizeUrl(f.Url)
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+func (redisStore) MarkFailed(queue string, f failedNotification) error {
+	client, err := openRedis()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = client.do("RPUSH", redisKey("failed:"+queue), string(data))
+	return err
+}
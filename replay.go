@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+)
+
+// Directories API responses are recorded to or replayed from, for offline development
+var (
+	apiRecordDir = os.Getenv("API_RECORD_DIR")
+	apiReplayDir = os.Getenv("API_REPLAY_DIR")
+)
+
+// replayTransport records the responses to API calls in a directory, or answers calls with
+// the recorded responses instead of calling the API. Responses are stored in files named
+// by a hash of the request, so a call gets the last response recorded to the same request.
+type replayTransport struct {
+	base   http.RoundTripper
+	dir    string
+	record bool
+}
+
+// withRecordReplay wraps a transport in a replayTransport if API_RECORD_DIR or API_REPLAY_DIR is set
+func withRecordReplay(base http.RoundTripper) (http.RoundTripper, error) {
+	if apiRecordDir != "" && apiReplayDir != "" {
+		return nil, fmt.Errorf("API_RECORD_DIR and API_REPLAY_DIR can't both be set")
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	switch {
+	case apiRecordDir != "":
+		err := os.MkdirAll(apiRecordDir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("creating API_RECORD_DIR: %w", err)
+		}
+		return &replayTransport{base: base, dir: apiRecordDir, record: true}, nil
+	case apiReplayDir != "":
+		return &replayTransport{base: base, dir: apiReplayDir}, nil
+	}
+	return base, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path, err := t.responsePath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.record {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no recorded response to %s %s in %s", req.Method, req.URL, t.dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	dump, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	err = os.WriteFile(path, dump, 0644)
+	if err != nil {
+		logWarning("Error recording response to %s %s: %v", req.Method, req.URL, err)
+	}
+	return res, nil
+}
+
+// responsePath returns the file of the response to a request. Batch requests get a random
+// multipart boundary, which is left out of the hash so they match across runs.
+func (t *replayTransport) responsePath(req *http.Request) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		body = bytes.ReplaceAll(body, []byte(params["boundary"]), nil)
+	}
+
+	u := *req.URL
+	query := u.Query()
+	query.Del("key")
+	u.RawQuery = query.Encode()
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", req.Method, u.String())
+	hash.Write(body)
+	return filepath.Join(t.dir, hex.EncodeToString(hash.Sum(nil))[:32]+".http"), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// URL rewrite settings
+var (
+	urlRewriteHosts = os.Getenv("URL_REWRITE_HOSTS")
+	urlRewrite      = os.Getenv("URL_REWRITE")
+)
+
+// rewriteRule replaces the matches of a regular expression in a URL
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// urlRewriter maps sitemap URLs to the URLs to submit, e.g. a staging host to production
+type urlRewriter struct {
+	hosts map[string]string
+	rules []rewriteRule
+}
+
+// loadUrlRewriter reads URL_REWRITE_HOSTS, comma separated old=new host pairs, and
+// URL_REWRITE, rules of the form pattern=>replacement separated by semicolons
+func loadUrlRewriter() (*urlRewriter, error) {
+	rw := &urlRewriter{hosts: map[string]string{}}
+	for _, pair := range strings.Split(urlRewriteHosts, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return nil, fmt.Errorf("invalid URL_REWRITE_HOSTS entry %q, expected old=new", pair)
+		}
+		rw.hosts[strings.ToLower(strings.TrimSpace(from))] = strings.TrimSpace(to)
+	}
+
+	for _, rule := range strings.Split(urlRewrite, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(rule, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid URL_REWRITE rule %q, expected pattern=>replacement", rule)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("parsing URL_REWRITE rule %q: %w", rule, err)
+		}
+		rw.rules = append(rw.rules, rewriteRule{pattern: re, replacement: strings.TrimSpace(replacement)})
+	}
+	return rw, nil
+}
+
+// rewrite replaces the host of a URL and then applies the rules in order
+func (rw *urlRewriter) rewrite(rawUrl string) string {
+	if len(rw.hosts) > 0 {
+		u, err := url.Parse(strings.TrimSpace(rawUrl))
+		if err == nil {
+			if host, ok := rw.hosts[strings.ToLower(u.Host)]; ok {
+				u.Host = host
+				rawUrl = u.String()
+			}
+		}
+	}
+	for _, rule := range rw.rules {
+		rawUrl = rule.pattern.ReplaceAllString(rawUrl, rule.replacement)
+	}
+	return rawUrl
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// siteRoot is the root URL of a site whose sitemaps are discovered from robots.txt
+var siteRoot = os.Getenv("SITE_ROOT")
+
+// resolveSitemaps returns the sitemap locations of a comma separated list or, if it is
+// empty, the sitemaps registered in Search Console or discovered from the robots.txt of SITE_ROOT
+func resolveSitemaps(list string) ([]string, error) {
+	if list != "" {
+		return sitemapLocations(list)
+	}
+	if searchConsoleProperty != "" {
+		return searchConsoleSitemaps(searchConsoleProperty)
+	}
+	if siteRoot == "" {
+		return nil, fmt.Errorf("SITEMAP_FILE, SEARCH_CONSOLE_PROPERTY or SITE_ROOT must be set")
+	}
+	return discoverSitemaps(siteRoot)
+}
+
+// discoverSitemaps reads the Sitemap directives of the site's robots.txt, falling back
+// to /sitemap.xml if there are none
+func discoverSitemaps(root string) ([]string, error) {
+	base, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SITE_ROOT: %w", err)
+	}
+	robotsUrl := base.ResolveReference(&url.URL{Path: "/robots.txt"}).String()
+
+	file, err := openSource(robotsUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	limits, err := loadInputLimits()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readLimited(file, limits.maxSize, robotsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	sitemaps := parseRobotsSitemaps(base, data)
+	if len(sitemaps) == 0 {
+		fallback := base.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String()
+		logInfo("No Sitemap directives in %s, using %s", robotsUrl, fallback)
+		return []string{fallback}, nil
+	}
+	logInfo("Discovered %d sitemaps in %s", len(sitemaps), robotsUrl)
+	return sitemaps, nil
+}
+
+// parseRobotsSitemaps returns the URLs of the Sitemap directives in robots.txt. The
+// directive is independent of user agent groups and its name is case insensitive.
+func parseRobotsSitemaps(base *url.URL, data []byte) []string {
+	var sitemaps []string
+	seen := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "sitemap") {
+			continue
+		}
+		ref, err := url.Parse(strings.TrimSpace(value))
+		if err != nil || ref.String() == "" {
+			continue
+		}
+		sitemap := base.ResolveReference(ref).String()
+		if !contains(seen, sitemap) {
+			seen[sitemap] = struct{}{}
+			sitemaps = append(sitemaps, sitemap)
+		}
+	}
+	return sitemaps
+}
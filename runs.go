@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var runsFile = os.Getenv("RUNS_FILE")
+
+// runRecord is the run-level metadata stored in the runs file
+type runRecord struct {
+	ID         string
+	Command    string
+	Start      time.Time
+	End        time.Time
+	ConfigHash string
+	Stats      runStats
+}
+
+// startRun creates the record of a new run of the given command
+func startRun(command string) *runRecord {
+	return &runRecord{
+		ID:         newRunID(),
+		Command:    command,
+		Start:      time.Now(),
+		ConfigHash: configHash(),
+	}
+}
+
+// newRunID returns a sortable unique ID like 20240405T101500-1a2b3c
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// configHash returns a short hash of the settings which affect what a run submits
+func configHash() string {
+	h := sha256.New()
+	for _, v := range []string{sitemapFile, indexedFile, sentFile, rateLimitDay, rateLimitMinute} {
+		fmt.Fprintln(h, v)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// runsFilePath returns the path of the runs file, which defaults to runs.csv next to the sent file
+func runsFilePath(sentFile string) string {
+	if runsFile != "" {
+		return runsFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "runs.csv")
+}
+
+// finishRun records the end of a run with its stats in the runs file
+func finishRun(filePath string, run *runRecord, stats runStats) error {
+	run.End = time.Now()
+	run.Stats = stats
+	reportTelemetry(run.Command, stats)
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	err = writer.Write([]string{
+		run.ID,
+		run.Command,
+		run.Start.Format(time.RFC3339),
+		run.End.Format(time.RFC3339),
+		run.ConfigHash,
+		strconv.Itoa(stats.Attempted),
+		strconv.Itoa(stats.Sent),
+		strconv.Itoa(stats.Failed),
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readRuns reads all run records from the runs file
+func readRuns(filePath string) ([]runRecord, error) {
+	file, err := readState(filePath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = 8
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []runRecord
+	for _, record := range records {
+		run := runRecord{ID: record[0], Command: record[1], ConfigHash: record[4]}
+		run.Start, _ = time.Parse(time.RFC3339, record[2])
+		run.End, _ = time.Parse(time.RFC3339, record[3])
+		run.Stats.Attempted, _ = strconv.Atoi(record[5])
+		run.Stats.Sent, _ = strconv.Atoi(record[6])
+		run.Stats.Failed, _ = strconv.Atoi(record[7])
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// runRuns lists recent runs, or the URLs sent by a single run
+func runRuns(args []string) {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	limit := fs.Int("n", 10, "Number of recent runs to list")
+	fs.Parse(args)
+
+	if fs.NArg() == 1 {
+		printRunUrls(fs.Arg(0))
+		return
+	}
+
+	runs, err := readRuns(runsFilePath(sentFile))
+	if err != nil {
+		log.Fatal("Error reading runs:", err)
+		return
+	}
+	if len(runs) > *limit {
+		runs = runs[len(runs)-*limit:]
+	}
+
+	fmt.Printf("%-22s %-10s %-25s %-10s %-12s %9s %6s %6s\n",
+		"RUN", "COMMAND", "START", "DURATION", "CONFIG", "ATTEMPTED", "SENT", "FAILED")
+	for _, run := range runs {
+		fmt.Printf("%-22s %-10s %-25s %-10s %-12s %9d %6d %6d\n",
+			run.ID, run.Command, run.Start.Format(time.RFC3339), run.End.Sub(run.Start).Round(time.Second),
+			run.ConfigHash, run.Stats.Attempted, run.Stats.Sent, run.Stats.Failed)
+	}
+}
+
+// printRunUrls prints the URLs sent by the given run
+func printRunUrls(runID string) {
+	if schema.column("run_id") < 0 {
+		log.Fatal("The run_id column is not stored in the sent file")
+		return
+	}
+
+	records, err := readSentHistory(sentFile)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+
+	for _, rec := range records {
+		if rec.RunID == runID {
+			fmt.Println(rec.Time.Format(time.RFC3339), rec.Url)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "context"
+
+// runState is the status and log labels of a submission run. Commands run one submission
+// and use the process wide ones, the operator reconciles several resources at once and
+// gives each its own, kept in the context of the run.
+type runState struct {
+	status *status
+	log    runLogger
+}
+
+type runStateKey struct{}
+
+// withRunState returns a context whose submission uses the given state
+func withRunState(ctx context.Context, state runState) context.Context {
+	return context.WithValue(ctx, runStateKey{}, state)
+}
+
+// runStateOf returns the state of the run of a context, the process wide one if it has none
+func runStateOf(ctx context.Context) runState {
+	if state, ok := ctx.Value(runStateKey{}).(runState); ok {
+		return state
+	}
+	return runState{status: runStatus}
+}
+
+// runLogger logs with labels of its own in addition to the process wide ones
+type runLogger struct {
+	labels map[string]string
+}
+
+func (l runLogger) info(format string, args ...interface{}) {
+	logLabeled(severityInfo, nil, l.labels, format, args...)
+}
+
+func (l runLogger) warning(format string, args ...interface{}) {
+	logLabeled(severityWarning, nil, l.labels, format, args...)
+}
+
+func (l runLogger) error(format string, args ...interface{}) {
+	logLabeled(severityError, nil, l.labels, format, args...)
+}
+
+// url logs a message about a single URL, keeping the URL as a separate field
+func (l runLogger) url(severity, url, format string, args ...interface{}) {
+	logLabeled(severity, map[string]string{"url": url}, l.labels, format, args...)
+}
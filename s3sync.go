@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Endpoint is an S3-compatible server like MinIO, whose buckets are addressed by path,
+// e.g. http://minio:9000. AWS is used if it's not set.
+var s3Endpoint = os.Getenv("S3_ENDPOINT")
+
+// s3ObjectStore keeps objects in an S3 bucket, their ETag is the version. Conditional
+// writes make the uploads fail if an object changed.
+type s3ObjectStore struct {
+	client   *http.Client
+	creds    awsCredentials
+	endpoint string
+	bucket   string
+}
+
+// newS3ObjectStore creates the store of a bucket with the AWS credentials
+func newS3ObjectStore(bucket string) (*s3ObjectStore, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.region == "" {
+		creds.region = "us-east-1"
+	}
+	base, err := apiTransport()
+	if err != nil {
+		return nil, err
+	}
+	s := &s3ObjectStore{
+		client: &http.Client{Transport: base, Timeout: 60 * time.Second},
+		creds:  creds,
+		bucket: bucket,
+	}
+	if s3Endpoint != "" {
+		s.endpoint = strings.TrimSuffix(s3Endpoint, "/") + "/" + bucket
+	} else {
+		s.endpoint = "https://" + bucket + ".s3." + creds.region + ".amazonaws.com"
+	}
+	return s, nil
+}
+
+// do sends a signed request for an object
+func (s *s3ObjectStore) do(method, name string, body []byte, header http.Header) (*http.Response, error) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return s.request(method, s.endpoint+"/"+strings.Join(segments, "/"), body, header)
+}
+
+// request sends a signed request
+func (s *s3ObjectStore) request(method, rawUrl string, body []byte, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signAWSRequest(req, body, s.creds, "s3", time.Now())
+	return s.client.Do(req)
+}
+
+func (s *s3ObjectStore) download(name string) ([]byte, string, error) {
+	res, err := s.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", os.ErrNotExist
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("S3 responded %s: %s", res.Status, data)
+	}
+	return data, res.Header.Get("ETag"), nil
+}
+
+func (s *s3ObjectStore) upload(name string, data []byte, version string) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/csv")
+	if version != "" {
+		header.Set("If-Match", version)
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+	res, err := s.do(http.MethodPut, name, data, header)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	// 409 is returned when a conditional write races with another one
+	if res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusConflict {
+		return "", errStateChanged
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("S3 responded %s: %s", res.Status, body)
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+func (s *s3ObjectStore) list(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.request(http.MethodGet, s.endpoint+"/?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("S3 responded %s: %s", res.Status, data)
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.Unmarshal(data, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			names = append(names, obj.Key)
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/searchconsole/v1"
+)
+
+// searchConsoleProperty is the Search Console property whose sitemaps are submitted,
+// e.g. https://example.com/ or sc-domain:example.com
+var searchConsoleProperty = os.Getenv("SEARCH_CONSOLE_PROPERTY")
+
+// searchConsoleSitemaps lists the sitemaps registered for a Search Console property.
+// The service account must be a user of the property.
+func searchConsoleSitemaps(property string) ([]string, error) {
+	opt, err := credentialsOption(searchconsole.WebmastersReadonlyScope)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAuthenticatedClient(nil, opt, option.WithScopes(searchconsole.WebmastersReadonlyScope))
+	if err != nil {
+		return nil, err
+	}
+	service, err := searchconsole.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := service.Sitemaps.List(property).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing sitemaps of %s: %w", property, err)
+	}
+
+	var sitemaps []string
+	for _, sitemap := range res.Sitemap {
+		if sitemap.Errors > 0 {
+			logWarning("Search Console reports %d errors in sitemap %s", sitemap.Errors, sitemap.Path)
+		}
+		sitemaps = append(sitemaps, sitemap.Path)
+	}
+	if len(sitemaps) == 0 {
+		return nil, fmt.Errorf("no sitemaps registered for %s in Search Console", property)
+	}
+	logInfo("Discovered %d sitemaps of %s in Search Console", len(sitemaps), property)
+	return sitemaps, nil
+}
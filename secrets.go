@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Prefixes of secret references, which credentials are fetched from instead of a file
+const (
+	gcpSecretPrefix   = "sm://"
+	awsSecretPrefix   = "awssm://"
+	vaultSecretPrefix = "vault://"
+)
+
+var (
+	secretsMu sync.Mutex
+	secrets   = map[string][]byte{}
+)
+
+// isSecretRef checks if a credentials location is a reference to a secret manager
+func isSecretRef(location string) bool {
+	return strings.HasPrefix(location, gcpSecretPrefix) || strings.HasPrefix(location, awsSecretPrefix) ||
+		strings.HasPrefix(location, vaultSecretPrefix)
+}
+
+// readKey reads a service account key from a file or a secret reference
+func readKey(location string) ([]byte, error) {
+	if isSecretRef(location) {
+		return fetchSecret(location)
+	}
+	return os.ReadFile(location)
+}
+
+// fetchSecret returns the secret a reference points to. Secrets are fetched once per run.
+//
+//	sm://projects/<project>/secrets/<name>[/versions/<version>]   GCP Secret Manager
+//	awssm://<name or ARN>                                          AWS Secrets Manager
+//	vault://<path>[#<field>]                                       HashiCorp Vault
+func fetchSecret(ref string) ([]byte, error) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if data, ok := secrets[ref]; ok {
+		return data, nil
+	}
+
+	base, err := apiTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: base, Timeout: 30 * time.Second}
+	var data []byte
+	switch {
+	case strings.HasPrefix(ref, gcpSecretPrefix):
+		data, err = fetchGCPSecret(client, strings.TrimPrefix(ref, gcpSecretPrefix))
+	case strings.HasPrefix(ref, awsSecretPrefix):
+		data, err = fetchAWSSecret(client, strings.TrimPrefix(ref, awsSecretPrefix))
+	default:
+		data, err = fetchVaultSecret(client, strings.TrimPrefix(ref, vaultSecretPrefix))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching secret %s: %w", ref, err)
+	}
+	secrets[ref] = data
+	return data, nil
+}
+
+// fetchGCPSecret accesses a secret version in GCP Secret Manager with the application default
+// credentials, e.g. of the workload the tool runs as
+func fetchGCPSecret(client *http.Client, name string) ([]byte, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/secrets/") {
+		return nil, fmt.Errorf("expected projects/<project>/secrets/<name>")
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	authClient := oauth2.NewClient(ctx, ts)
+
+	res, err := authClient.Get("https://secretmanager.googleapis.com/v1/" + name + ":access")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	err = decodeSecretResponse(res, &body)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(body.Payload.Data)
+}
+
+// fetchAWSSecret gets the value of a secret in AWS Secrets Manager, in the region of its ARN
+// or of the AWS credentials
+func fetchAWSSecret(client *http.Client, id string) ([]byte, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if arn := strings.Split(id, ":"); len(arn) > 3 && arn[0] == "arn" {
+		creds.region = arn[3]
+	}
+	if creds.region == "" {
+		return nil, fmt.Errorf("AWS_REGION must be set")
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://secretsmanager."+creds.region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, "secretsmanager", time.Now())
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var value struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary []byte `json:"SecretBinary"`
+	}
+	err = decodeSecretResponse(res, &value)
+	if err != nil {
+		return nil, err
+	}
+	if value.SecretString != "" {
+		return []byte(value.SecretString), nil
+	}
+	return value.SecretBinary, nil
+}
+
+// fetchVaultSecret reads a secret from HashiCorp Vault at VAULT_ADDR with VAULT_TOKEN. Without
+// a field, a secret holding the key's fields is used as the key itself, and a secret with a
+// single field is that field's value.
+func fetchVaultSecret(client *http.Client, ref string) ([]byte, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	path, field, _ := strings.Cut(ref, "#")
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	err = decodeSecretResponse(res, &body)
+	if err != nil {
+		return nil, err
+	}
+	fields := body.Data
+	// KV version 2 nests the fields with the metadata of the version
+	if nested, ok := fields["data"]; ok && fields["metadata"] != nil {
+		fields = nil
+		err = json.Unmarshal(nested, &fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case field != "":
+		value, ok := fields[field]
+		if !ok {
+			return nil, fmt.Errorf("no field %q in secret", field)
+		}
+		return secretValue(value), nil
+	case fields["private_key"] != nil:
+		return json.Marshal(fields)
+	case len(fields) == 1:
+		for _, value := range fields {
+			return secretValue(value), nil
+		}
+	}
+	return nil, fmt.Errorf("secret has %d fields, add #<field> to the reference", len(fields))
+}
+
+// secretValue returns a JSON string field as its text, other values as JSON
+func secretValue(value json.RawMessage) []byte {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return []byte(s)
+	}
+	return value
+}
+
+// decodeSecretResponse checks the status of a secret manager response and decodes its body
+func decodeSecretResponse(res *http.Response, v interface{}) error {
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("status code %d: %s", res.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleStatusSignal dumps the status to stderr whenever the process receives SIGUSR1
+func handleStatusSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			runStatus.dump(os.Stderr)
+		}
+	}()
+}
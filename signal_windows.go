@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// handleStatusSignal does nothing on Windows, which has no SIGUSR1, use the control socket instead
+func handleStatusSignal() {}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// runSimulate runs the full pipeline against the built-in fake API, so rate limits
+// and error handling can be validated without spending real quota
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	latency := fs.Duration("latency", 200*time.Millisecond, "Average response time of the fake API")
+	errorRate := fs.Float64("error-rate", 0.05, "Share of requests failing with a server error, 0-1")
+	// Fault injection for validating retry and alerting settings, left out of the usage
+	chaosSpec := fs.String("chaos", "", "Fault rates, e.g. timeout=0.02,429=0.05,5xx=0.05,malformed=0.02")
+	chaosTimeout := fs.Duration("chaos-timeout", 5*time.Second, "Client timeout for injected timeouts")
+	fs.Usage = func() {
+		visible := flag.NewFlagSet("simulate", flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "chaos") {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintln(fs.Output(), "Usage of simulate:")
+		visible.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	chaos, err := parseChaos(*chaosSpec)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	notifications, _, err := loadPending()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	api := newFakeAPI(*latency, *errorRate)
+	api.chaos = chaos
+	server := api.start()
+	defer server.Close()
+
+	httpClient := &http.Client{}
+	if chaos.timeout > 0 {
+		httpClient.Timeout = *chaosTimeout
+	}
+	client, err := newIndexingClient(httpClient, option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+	// Pooled accounts keep their quotas, but publish to the fake API as well
+	for i := range limits.accounts {
+		limits.accounts[i].client = client
+	}
+
+	fmt.Printf("Simulating %d URLs (latency %s, error rate %.2f)\n", len(notifications), *latency, *errorRate)
+	start := time.Now()
+	stats, err := simulateRun(interruptContext(), client, notifications, limits)
+	if err != nil {
+		log.Fatal("Error submitting URLs:", err)
+		return
+	}
+	elapsed := time.Since(start)
+	reportTelemetry("simulate", stats)
+
+	fmt.Println("Simulation finished")
+	fmt.Printf("Attempted: %d\n", stats.Attempted)
+	fmt.Printf("Sent: %d\n", stats.Sent)
+	fmt.Printf("Failed: %d\n", stats.Failed)
+	fmt.Printf("Elapsed: %s\n", elapsed.Round(time.Millisecond))
+	if elapsed > 0 {
+		fmt.Printf("Rate: %.1f requests/minute\n", float64(stats.Attempted)/elapsed.Minutes())
+	}
+}
+
+// simulateRun submits notifications like a run, but keeps all state in a private temporary
+// directory which is removed afterwards. It starts from a copy of the sent URLs, the real
+// state files are never written and no alerts are sent. Metrics aren't pushed either, since
+// runSimulate doesn't start the push.
+func simulateRun(ctx context.Context, client *indexingClient, notifications []notification, limits rateLimits) (runStats, error) {
+	dir, err := os.MkdirTemp("", "indexapi-simulate-*")
+	if err != nil {
+		return runStats{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Files set to a fixed path would be the real ones, use the defaults next to the copy instead
+	for _, value := range sharedStateSettings {
+		defer func(value *string, prev string) { *value = prev }(value, *value)
+		*value = ""
+	}
+	defer func(prev string) { alertWebhookUrls = prev }(alertWebhookUrls)
+	alertWebhookUrls = ""
+
+	simSentFile := filepath.Join(dir, "sent.csv")
+	err = copySentUrls(simSentFile)
+	if err != nil {
+		return runStats{}, fmt.Errorf("copying sent URLs: %w", err)
+	}
+	return submitUrls(ctx, client, notifications, simSentFile, newRunID(), limits)
+}
+
+// copySentUrls copies the sent URLs of the state store to a sent file
+func copySentUrls(filePath string) error {
+	// A database backend keeps no sent file, its records are copied instead
+	if _, ok := stateStore.(csvStore); !ok {
+		records, err := stateStore.Sent()
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			err = appendUrlToCsv(filePath, rec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	src, err := os.Open(sentFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestSimulateLeavesTheStateAlone(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+
+	// The real state, with every file at a fixed path
+	real := t.TempDir()
+	prevStore, prevFile := stateStore, sentFile
+	sentFile = filepath.Join(real, "sent.csv")
+	stateStore = csvStore{sentFile: sentFile}
+	t.Cleanup(func() { stateStore, sentFile = prevStore, prevFile })
+	err := appendUrlToCsv(sentFile, sentRecord{Url: "https://example.com/old", Time: now.Add(-48 * time.Hour), Type: "URL_UPDATED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := os.ReadFile(sentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range sharedStateSettings {
+		prev := *value
+		*value = filepath.Join(real, name)
+		t.Cleanup(func() { *value = prev })
+	}
+
+	var alerts int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&alerts, 1)
+	}))
+	t.Cleanup(webhook.Close)
+	prevAlerts := alertWebhookUrls
+	alertWebhookUrls = webhook.URL
+	t.Cleanup(func() { alertWebhookUrls = prevAlerts })
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	chaos, err := parseChaos("5xx=0.5,malformed=0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newFakeAPI(0, 0)
+	api.chaos = chaos
+	server := api.start()
+	t.Cleanup(server.Close)
+	client, err := newIndexingClient(&http.Client{}, option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notifications []notification
+	for i := 0; i < 20; i++ {
+		notifications = append(notifications, notification{Url: fmt.Sprintf("https://example.com/%d", i), Type: "URL_UPDATED"})
+	}
+
+	stats, err := simulateRun(context.Background(), client, notifications, rateLimits{perDay: 200, perMinute: 600, concurrency: 2})
+	if err != nil {
+		t.Logf("simulation aborted: %v", err)
+	}
+	if stats.Sent == 0 || stats.Failed == 0 {
+		t.Fatalf("simulation sent %d and failed %d, want both", stats.Sent, stats.Failed)
+	}
+
+	entries, err := os.ReadDir(real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "sent.csv" {
+			t.Errorf("simulation wrote %s to the real state", entry.Name())
+		}
+	}
+	after, err := os.ReadFile(sentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, sent) {
+		t.Errorf("simulation changed the real sent file:\n%s", after)
+	}
+	for name, value := range sharedStateSettings {
+		if *value != filepath.Join(real, name) {
+			t.Errorf("%s is %q after the simulation", name, *value)
+		}
+	}
+	if leftover, _ := os.ReadDir(tmp); len(leftover) != 0 {
+		t.Errorf("simulation left %d files in the temporary directory", len(leftover))
+	}
+	if n := atomic.LoadInt32(&alerts); n != 0 {
+		t.Errorf("simulation sent %d alerts", n)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sitemap cache settings
+var (
+	sitemapCache    = os.Getenv("SITEMAP_CACHE")
+	sitemapCacheDir = os.Getenv("SITEMAP_CACHE_DIR")
+)
+
+// sitemapCacheEntry holds the validators and parsed URLs of a remote sitemap,
+// or the child sitemaps if it is a sitemap index
+type sitemapCacheEntry struct {
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"last_modified,omitempty"`
+	Fetched      time.Time    `json:"fetched"`
+	Urls         []Url        `json:"urls,omitempty"`
+	Sitemaps     []sitemapRef `json:"sitemaps,omitempty"`
+}
+
+// sitemapIndexChildren records the child locations of the sitemap indexes parsed
+// by this process, so they can be cached with the index
+var sitemapIndexChildren sync.Map
+
+// sitemapCachePath returns the cache file of a sitemap location
+func sitemapCachePath(location string) string {
+	dir := sitemapCacheDir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(sentFile), "sitemap_cache")
+	}
+	sum := sha256.Sum256([]byte(location))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// readSitemapCache returns the cached entry of a location, or nil if there is none
+func readSitemapCache(location string) *sitemapCacheEntry {
+	data, err := os.ReadFile(sitemapCachePath(location))
+	if err != nil {
+		return nil
+	}
+	var entry sitemapCacheEntry
+	if json.Unmarshal(data, &entry) != nil {
+		return nil
+	}
+	return &entry
+}
+
+// writeSitemapCache stores the entry of a location, nothing is written in read-only mode
+func writeSitemapCache(location string, entry sitemapCacheEntry) error {
+	if readOnly == "true" {
+		return nil
+	}
+	filePath := sitemapCachePath(location)
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// fetchSitemap fetches a remote sitemap with the validators of the previous fetch and
+// passes its URLs to emit. An unchanged sitemap isn't parsed again, its URLs come from the
+// cache. An unchanged sitemap index still revalidates every child sitemap.
+func fetchSitemap(location string, depth int, emit func(Url) error) error {
+	timeout, err := parseDurationDefault(sitemapFetchTimeout, time.Minute)
+	if err != nil {
+		return fmt.Errorf("parsing SITEMAP_FETCH_TIMEOUT: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	cached := readSitemapCache(location)
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		cached.Fetched = clock.Now()
+		err = writeSitemapCache(location, *cached)
+		if err != nil {
+			logError("Error caching sitemap %s: %v", location, err)
+		}
+		if len(cached.Sitemaps) > 0 {
+			logInfo("Sitemap index %s not modified", location)
+			return parseSitemaps(location, cached.Sitemaps, depth, emit)
+		}
+		logInfo("Sitemap %s not modified, using %d cached URLs", location, len(cached.Urls))
+		return emitAll(cached.Urls, emit)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: status code %d", location, res.StatusCode)
+	}
+
+	// The cache keeps the URLs of a urlset, they are collected as they are passed on. An
+	// index only keeps its children, which are cached on their own.
+	entry := sitemapCacheEntry{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified"), Fetched: clock.Now()}
+	sitemapIndexChildren.Delete(location)
+	err = parseInput(location, res.Body, depth, func(url Url) error {
+		if _, index := sitemapIndexChildren.Load(location); !index {
+			entry.Urls = append(entry.Urls, url)
+		}
+		return emit(url)
+	})
+	if err != nil {
+		return err
+	}
+	if children, ok := sitemapIndexChildren.Load(location); ok {
+		entry.Sitemaps = children.([]sitemapRef)
+	}
+	err = writeSitemapCache(location, entry)
+	if err != nil {
+		logError("Error caching sitemap %s: %v", location, err)
+	}
+	return nil
+}
+
+// unchangedSitemap returns the cached URLs of a child sitemap whose lastmod in the
+// index is earlier than the time it was last fetched. A lastmod without a time, like
+// 2024-06-01, counts as the end of that day.
+func unchangedSitemap(child sitemapRef, depth int, emit func(Url) error) (bool, error) {
+	if sitemapCache == "false" || !isRemote(child.Loc) {
+		return false, nil
+	}
+	modified, ok := parseLastmod(child.Lastmod)
+	if !ok {
+		return false, nil
+	}
+	switch len(child.Lastmod) {
+	case len("2006"):
+		modified = modified.AddDate(1, 0, 0)
+	case len("2006-01"):
+		modified = modified.AddDate(0, 1, 0)
+	case len("2006-01-02"):
+		modified = modified.AddDate(0, 0, 1)
+	}
+
+	cached := readSitemapCache(child.Loc)
+	if cached == nil || !modified.Before(cached.Fetched) {
+		return false, nil
+	}
+	if len(cached.Sitemaps) > 0 {
+		return true, parseSitemaps(child.Loc, cached.Sitemaps, depth, emit)
+	}
+	return true, emitAll(cached.Urls, emit)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// slaTarget is the time within which URLs must be submitted after they appear in the sitemap
+var slaTarget = os.Getenv("SLA_TARGET")
+
+// slaReport is the discovery to submission latency of URLs
+type slaReport struct {
+	target    time.Duration
+	latencies []time.Duration
+	// breached counts the submitted URLs whose latency exceeded the target
+	breached int
+	// waiting counts the URLs not submitted yet which are already past the target
+	waiting       int
+	oldestWaiting time.Time
+}
+
+// buildSlaReport measures the latency from the time a URL was first seen in the sitemap to its
+// first submission, for URLs submitted since the given time. URLs which were submitted in the run
+// they appeared in have a latency of 0, as they are added to the snapshot after the run.
+func buildSlaReport(sentFile string, target time.Duration, since time.Time) (slaReport, error) {
+	report := slaReport{target: target}
+	snapshot, err := readSnapshot(snapshotFilePath(sentFile))
+	if err != nil {
+		return report, fmt.Errorf("reading sitemap snapshot: %w", err)
+	}
+	records, err := readSentHistory(sentFile)
+	if err != nil {
+		return report, fmt.Errorf("reading sent URLs: %w", err)
+	}
+	indexedUrls, err := stateStore.Indexed()
+	if err != nil {
+		return report, fmt.Errorf("reading indexed URLs: %w", err)
+	}
+
+	firstSent := map[string]time.Time{}
+	for _, rec := range records {
+		if rec.Type != "" && rec.Type != "URL_UPDATED" {
+			continue
+		}
+		if t, ok := firstSent[rec.Url]; !ok || rec.Time.Before(t) {
+			firstSent[rec.Url] = rec.Time
+		}
+	}
+
+	now := clock.Now()
+	for _, entry := range snapshot {
+		if entry.FirstSeen.IsZero() {
+			continue
+		}
+		sent, ok := firstSent[entry.Url]
+		if !ok {
+			if !contains(indexedUrls, entry.Url) && now.Sub(entry.FirstSeen) > target {
+				report.waiting++
+				if report.oldestWaiting.IsZero() || entry.FirstSeen.Before(report.oldestWaiting) {
+					report.oldestWaiting = entry.FirstSeen
+				}
+			}
+			continue
+		}
+		if sent.Before(since) {
+			continue
+		}
+		latency := sent.Sub(entry.FirstSeen)
+		if latency < 0 {
+			latency = 0
+		}
+		report.latencies = append(report.latencies, latency)
+		if latency > target {
+			report.breached++
+		}
+	}
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report, nil
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func (r slaReport) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(r.latencies)) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(r.latencies) {
+		rank = len(r.latencies)
+	}
+	return r.latencies[rank-1]
+}
+
+// checkSla alerts when URLs submitted since the run started missed the SLA, or URLs are still
+// waiting past it. It does nothing unless SLA_TARGET is set.
+func checkSla(sentFile string, runStart time.Time) error {
+	if slaTarget == "" {
+		return nil
+	}
+	target, err := time.ParseDuration(slaTarget)
+	if err != nil {
+		return fmt.Errorf("parsing SLA_TARGET: %w", err)
+	}
+	report, err := buildSlaReport(sentFile, target, runStart)
+	if err != nil {
+		return err
+	}
+	if report.breached > 0 {
+		alert("sla_breached", "%d of %d URLs submitted in this run missed the %s SLA, p90 latency %s",
+			report.breached, len(report.latencies), target, report.percentile(90).Round(time.Minute))
+	}
+	if report.waiting > 0 {
+		alert("sla_waiting", "%d URLs are waiting longer than the %s SLA, the oldest since %s",
+			report.waiting, target, report.oldestWaiting.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// runSla reports the discovery to submission latency percentiles and SLA breaches
+func runSla(args []string) {
+	fs := flag.NewFlagSet("sla", flag.ExitOnError)
+	days := fs.Int("days", 30, "Report URLs submitted within this many days")
+	fs.Parse(args)
+
+	target, err := parseDurationDefault(slaTarget, 24*time.Hour)
+	if err != nil {
+		log.Fatal("Error parsing SLA_TARGET:", err)
+		return
+	}
+	report, err := buildSlaReport(sentFile, target, clock.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	fmt.Printf("SLA:       submitted within %s of appearing in the sitemap\n", target)
+	fmt.Printf("Submitted: %d URLs in the last %d days\n", len(report.latencies), *days)
+	if len(report.latencies) > 0 {
+		fmt.Printf("Latency:   p50 %s, p90 %s, p99 %s, max %s\n",
+			report.percentile(50).Round(time.Minute), report.percentile(90).Round(time.Minute),
+			report.percentile(99).Round(time.Minute), report.latencies[len(report.latencies)-1].Round(time.Minute))
+		fmt.Printf("Breached:  %d URLs (%.1f%%)\n", report.breached, float64(report.breached)*100/float64(len(report.latencies)))
+	}
+	if report.waiting > 0 {
+		fmt.Printf("Waiting:   %d URLs past the SLA, the oldest since %s\n", report.waiting, report.oldestWaiting.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Waiting:   no URLs past the SLA\n")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SLO alert settings
+var (
+	alertErrorRate   = os.Getenv("ALERT_ERROR_RATE")
+	alertErrorWindow = os.Getenv("ALERT_ERROR_WINDOW")
+	alertMinRequests = os.Getenv("ALERT_MIN_REQUESTS")
+	alertStall       = os.Getenv("ALERT_STALL")
+)
+
+// sloMonitor raises alerts when submissions break the configured thresholds
+type sloMonitor struct {
+	errorRate   float64
+	window      time.Duration
+	minRequests int
+	stall       time.Duration
+
+	mu       sync.Mutex
+	outcomes []sloOutcome
+}
+
+type sloOutcome struct {
+	time time.Time
+	ok   bool
+}
+
+// newSloMonitor creates a monitor from environment variables, unset thresholds are not checked
+func newSloMonitor() (*sloMonitor, error) {
+	m := &sloMonitor{}
+	var err error
+	if alertErrorRate != "" {
+		m.errorRate, err = strconv.ParseFloat(alertErrorRate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ALERT_ERROR_RATE: %w", err)
+		}
+	}
+	m.window, err = parseDurationDefault(alertErrorWindow, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ALERT_ERROR_WINDOW: %w", err)
+	}
+	m.minRequests, err = parseIntDefault(alertMinRequests, 10)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ALERT_MIN_REQUESTS: %w", err)
+	}
+	m.stall, err = parseDurationDefault(alertStall, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ALERT_STALL: %w", err)
+	}
+	return m, nil
+}
+
+// record adds the outcome of a submission and alerts if the error rate over the window is too high
+func (m *sloMonitor) record(ok bool) {
+	if m.errorRate <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clock.Now()
+	m.outcomes = append(m.outcomes, sloOutcome{time: now, ok: ok})
+	for len(m.outcomes) > 0 && now.Sub(m.outcomes[0].time) > m.window {
+		m.outcomes = m.outcomes[1:]
+	}
+	if len(m.outcomes) < m.minRequests {
+		return
+	}
+
+	failed := 0
+	for _, o := range m.outcomes {
+		if !o.ok {
+			failed++
+		}
+	}
+	rate := float64(failed) / float64(len(m.outcomes))
+	if rate > m.errorRate {
+		alert("error_rate", "Error rate %.0f%% over the last %s exceeds %.0f%% (%d of %d submissions failed)",
+			rate*100, m.window, m.errorRate*100, failed, len(m.outcomes))
+	}
+}
+
+// checkStall alerts if no URL was sent within the stall threshold while there is a backlog
+func (m *sloMonitor) checkStall(sentFile string, backlog int) error {
+	if m.stall <= 0 || backlog == 0 {
+		return nil
+	}
+
+	store := storeFor(sentFile)
+	records, err := store.SentSince(clock.Now().Add(-m.stall))
+	if err != nil || len(records) > 0 {
+		return err
+	}
+	// Only a stall needs the time of the last notification
+	records, err = store.Latest()
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	for _, rec := range records {
+		if rec.Time.After(last) {
+			last = rec.Time
+		}
+	}
+
+	if clock.Now().Sub(last) > m.stall {
+		since := "ever"
+		if !last.IsZero() {
+			since = "since " + last.Format(time.RFC3339)
+		}
+		alert("stall", "No URLs submitted %s while %d URLs are waiting", since, backlog)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot settings
+var (
+	snapshotFile = os.Getenv("SNAPSHOT_FILE")
+	autoDelete   = os.Getenv("AUTO_DELETE")
+	// resubmitChanged sends URL_UPDATED again for sent URLs whose lastmod changed since the snapshot
+	resubmitChanged = os.Getenv("RESUBMIT_CHANGED")
+)
+
+// snapshotEntry is a URL of the previously processed sitemap
+type snapshotEntry struct {
+	Url       string
+	FirstSeen time.Time
+	Lastmod   string
+}
+
+// snapshotFilePath returns the path of the snapshot file, which defaults to snapshot.csv next to the sent file
+func snapshotFilePath(sentFile string) string {
+	if snapshotFile != "" {
+		return snapshotFile
+	}
+	return filepath.Join(filepath.Dir(sentFile), "snapshot.csv")
+}
+
+// readSnapshot reads the previous sitemap snapshot, which is empty on the first run
+func readSnapshot(filePath string) (map[string]snapshotEntry, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return map[string]snapshotEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseSnapshot(file)
+}
+
+// parseSnapshot reads url,first_seen,lastmod rows
+func parseSnapshot(r io.Reader) (map[string]snapshotEntry, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := map[string]snapshotEntry{}
+	for _, record := range records {
+		entry := snapshotEntry{Url: normalizeUrl(record[0])}
+		if len(record) > 1 {
+			entry.FirstSeen, _ = time.Parse(time.RFC3339, record[1])
+		}
+		if len(record) > 2 {
+			entry.Lastmod = record[2]
+		}
+		snapshot[entry.Url] = entry
+	}
+	return snapshot, nil
+}
+
+// writeSnapshot replaces the snapshot with the URLs of the current sitemap,
+// keeping the time each URL was first seen. It reports whether URLs were added,
+// removed or got a new lastmod since the previous snapshot.
+func writeSnapshot(filePath string, urls []Url) (bool, error) {
+	prev, err := readSnapshot(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpPath)
+
+	now := clock.Now()
+	changed := false
+	writer := csv.NewWriter(file)
+	written := map[string]struct{}{}
+	for _, url := range urls {
+		// URLs the input marks as deleted aren't part of the site anymore
+		if contains(written, url.Loc) || url.Type == "URL_DELETED" {
+			continue
+		}
+		written[url.Loc] = struct{}{}
+
+		firstSeen := now
+		entry, ok := prev[url.Loc]
+		if ok && !entry.FirstSeen.IsZero() {
+			firstSeen = entry.FirstSeen
+		}
+		if !ok || entry.Lastmod != url.Lastmod {
+			changed = true
+		}
+		writer.Write([]string{url.Loc, firstSeen.Format(time.RFC3339), url.Lastmod})
+	}
+	writer.Flush()
+	err = writer.Error()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	return changed || len(written) != len(prev), os.Rename(tmpPath, filePath)
+}
+
+// removedNotifications returns URL_DELETED notifications for URLs which disappeared
+// from the sitemap since the snapshot and now respond with 404 or 410
+func removedNotifications(snapshot map[string]snapshotEntry, urls []Url, lastSent map[string]time.Time) []notification {
+	current := map[string]struct{}{}
+	for _, url := range urls {
+		current[url.Loc] = struct{}{}
+	}
+
+	var removed []string
+	for url := range snapshot {
+		if _, ok := current[url]; ok {
+			continue
+		}
+		if isDeleted(lastSent, url) {
+			continue
+		}
+		removed = append(removed, url)
+	}
+	sort.Strings(removed)
+
+	var notifications []notification
+	for _, url := range removed {
+		status, err := preflightStatus(url)
+		if err != nil {
+			logURL(severityWarning, url, "Error checking removed URL %s: %v", url, err)
+			continue
+		}
+		if status != http.StatusNotFound && status != http.StatusGone {
+			logURL(severityInfo, url, "URL %s was removed from the sitemap but responds with %d, not deleting", url, status)
+			continue
+		}
+		notifications = append(notifications, notification{
+			Url:    url,
+			Type:   "URL_DELETED",
+			Source: sitemapFile,
+			Reason: "removed from sitemap and responds with " + http.StatusText(status),
+		})
+	}
+	return notifications
+}
+
+// changedNotification returns a URL_UPDATED notification for a sent or indexed URL whose
+// lastmod changed since the snapshot, or is still later than its last submission because
+// the quota ran out before it was resubmitted. lastSent may include the notify times
+// reported by getMetadata, a URL whose lastmod isn't later than its last notification is
+// never resubmitted. It returns false if the URL didn't change.
+func changedNotification(snapshot map[string]snapshotEntry, url Url, indexedUrls map[string]struct{}, lastSent map[string]time.Time) (notification, bool) {
+	entry, ok := snapshot[url.Loc]
+	if !ok || url.Type == "URL_DELETED" || url.Lastmod == "" {
+		return notification{}, false
+	}
+	if isDeleted(lastSent, url.Loc) {
+		return notification{}, false
+	}
+	updatedAt, updated := lastSent[sentKey(url.Loc, "URL_UPDATED")]
+	if !updated && !contains(indexedUrls, url.Loc) {
+		return notification{}, false
+	}
+	t, parsed := parseLastmod(url.Lastmod)
+	newer := updated && parsed && t.After(updatedAt)
+	if entry.Lastmod == url.Lastmod && !newer || updated && parsed && !newer {
+		return notification{}, false
+	}
+
+	n := notification{Url: url.Loc, Type: "URL_UPDATED", Source: url.Source, Lastmod: url.Lastmod,
+		Priority: parsePriority(url.Priority), Images: url.imageCount(), Videos: url.videoCount()}
+	switch {
+	case entry.Lastmod == url.Lastmod:
+		n.Reason = "lastmod " + url.Lastmod + " is later than the last submission"
+	case entry.Lastmod == "":
+		n.Reason = "lastmod " + url.Lastmod + " added"
+	default:
+		n.Reason = "lastmod changed from " + entry.Lastmod + " to " + url.Lastmod
+	}
+	return n, true
+}
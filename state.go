@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// State file settings
+var (
+	stateColumns    = os.Getenv("STATE_COLUMNS")
+	stateDelimiter  = os.Getenv("STATE_DELIMITER")
+	stateTimeFormat = os.Getenv("STATE_TIME_FORMAT")
+	stateLabels     = os.Getenv("STATE_LABELS")
+)
+
+const defaultStateColumns = "url,time,run_id,type,notify_time"
+
+// Columns which can be stored in the sent file, besides label:<name> columns
+var knownStateColumns = map[string]bool{
+	"url":           true,
+	"time":          true,
+	"run_id":        true,
+	"type":          true,
+	"source":        true,
+	"lastmod":       true,
+	"status":        true,
+	"response_time": true,
+	"title":         true,
+	"canonical":     true,
+	"published":     true,
+	"h1":            true,
+	"locale":        true,
+	"key":           true,
+	"images":        true,
+	"videos":        true,
+	"notify_time":   true,
+	"latest_update": true,
+	"latest_remove": true,
+}
+
+// sentRecord is a row of the sent file
+type sentRecord struct {
+	Url          string
+	Time         time.Time
+	RunID        string
+	Type         string
+	Source       string
+	Lastmod      string
+	Status       int
+	ResponseTime time.Duration
+	Title        string
+	Canonical    string
+	Published    string
+	H1           string
+	Locale       string
+	Key          string
+	Images       int
+	Videos       int
+	// NotifyTime is the time Google acknowledged the notification with, LatestUpdate and
+	// LatestRemove are the notify times of the URL's metadata returned by the publish call
+	NotifyTime   string
+	LatestUpdate string
+	LatestRemove string
+}
+
+// stateSchema describes the columns and format of the sent file
+type stateSchema struct {
+	columns    []string
+	comma      rune
+	timeFormat string
+	labels     map[string]string
+}
+
+// schema is the sent file schema in use, set from environment variables on start
+var schema = stateSchema{
+	columns:    strings.Split(defaultStateColumns, ","),
+	comma:      ',',
+	timeFormat: time.RFC3339,
+}
+
+// loadStateSchema reads the sent file schema from environment variables
+func loadStateSchema() (stateSchema, error) {
+	s := stateSchema{comma: ',', timeFormat: time.RFC3339, labels: map[string]string{}}
+
+	columns := stateColumns
+	if columns == "" {
+		columns = defaultStateColumns
+	}
+	seen := map[string]bool{}
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		if !knownStateColumns[column] && !strings.HasPrefix(column, "label:") {
+			return s, fmt.Errorf("unknown state column %q", column)
+		}
+		if seen[column] {
+			return s, fmt.Errorf("duplicate state column %q", column)
+		}
+		seen[column] = true
+		s.columns = append(s.columns, column)
+	}
+	// The type tells URL_UPDATED and URL_DELETED notifications apart for the dedup window
+	if !seen["url"] || !seen["time"] || !seen["type"] {
+		return s, fmt.Errorf("state columns must include url, time and type")
+	}
+
+	if stateDelimiter != "" {
+		if stateDelimiter == `\t` {
+			stateDelimiter = "\t"
+		}
+		r, size := utf8.DecodeRuneInString(stateDelimiter)
+		if size != len(stateDelimiter) || r == '"' || r == '\r' || r == '\n' {
+			return s, fmt.Errorf("invalid state delimiter %q", stateDelimiter)
+		}
+		s.comma = r
+	}
+
+	if stateTimeFormat != "" {
+		s.timeFormat = stateTimeFormat
+	}
+
+	if stateLabels != "" {
+		for _, label := range strings.Split(stateLabels, ",") {
+			name, value, ok := strings.Cut(label, "=")
+			if !ok {
+				return s, fmt.Errorf("invalid state label %q, expected name=value", label)
+			}
+			s.labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	for _, column := range s.columns {
+		name, ok := strings.CutPrefix(column, "label:")
+		if _, found := s.labels[name]; ok && !found {
+			return s, fmt.Errorf("no value for state column %q in STATE_LABELS", column)
+		}
+	}
+
+	return s, nil
+}
+
+// column returns the index of the column, or -1 if it isn't stored
+func (s stateSchema) column(name string) int {
+	for i, column := range s.columns {
+		if column == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// row formats a record as a row of the sent file
+func (s stateSchema) row(rec sentRecord) []string {
+	row := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		switch column {
+		case "url":
+			row[i] = rec.Url
+		case "time":
+			row[i] = rec.Time.Format(s.timeFormat)
+		case "run_id":
+			row[i] = rec.RunID
+		case "type":
+			row[i] = rec.Type
+		case "source":
+			row[i] = rec.Source
+		case "lastmod":
+			row[i] = rec.Lastmod
+		case "status":
+			if rec.Status != 0 {
+				row[i] = strconv.Itoa(rec.Status)
+			}
+		case "response_time":
+			if rec.ResponseTime != 0 {
+				row[i] = strconv.FormatInt(rec.ResponseTime.Milliseconds(), 10)
+			}
+		case "title":
+			row[i] = rec.Title
+		case "canonical":
+			row[i] = rec.Canonical
+		case "published":
+			row[i] = rec.Published
+		case "h1":
+			row[i] = rec.H1
+		case "locale":
+			row[i] = rec.Locale
+		case "key":
+			row[i] = rec.Key
+		case "images":
+			row[i] = strconv.Itoa(rec.Images)
+		case "videos":
+			row[i] = strconv.Itoa(rec.Videos)
+		case "notify_time":
+			row[i] = rec.NotifyTime
+		case "latest_update":
+			row[i] = rec.LatestUpdate
+		case "latest_remove":
+			row[i] = rec.LatestRemove
+		default:
+			row[i] = s.labels[strings.TrimPrefix(column, "label:")]
+		}
+	}
+	return row
+}
+
+// parse reads a record from a row of the sent file, missing columns are left empty
+func (s stateSchema) parse(row []string) sentRecord {
+	var rec sentRecord
+	for i, column := range s.columns {
+		if i >= len(row) {
+			break
+		}
+		value := row[i]
+		switch column {
+		case "url":
+			rec.Url = value
+		case "time":
+			rec.Time = s.parseTime(value)
+		case "run_id":
+			rec.RunID = value
+		case "type":
+			rec.Type = value
+		case "source":
+			rec.Source = value
+		case "lastmod":
+			rec.Lastmod = value
+		case "status":
+			rec.Status, _ = strconv.Atoi(value)
+		case "response_time":
+			ms, _ := strconv.ParseInt(value, 10, 64)
+			rec.ResponseTime = time.Duration(ms) * time.Millisecond
+		case "title":
+			rec.Title = value
+		case "canonical":
+			rec.Canonical = value
+		case "published":
+			rec.Published = value
+		case "h1":
+			rec.H1 = value
+		case "locale":
+			rec.Locale = value
+		case "key":
+			rec.Key = value
+		case "images":
+			rec.Images, _ = strconv.Atoi(value)
+		case "videos":
+			rec.Videos, _ = strconv.Atoi(value)
+		case "notify_time":
+			rec.NotifyTime = value
+		case "latest_update":
+			rec.LatestUpdate = value
+		case "latest_remove":
+			rec.LatestRemove = value
+		}
+	}
+	return rec
+}
+
+// parseTime parses a time in the configured format, falling back to RFC 3339 used by older versions
+func (s stateSchema) parseTime(value string) time.Time {
+	t, err := time.ParseInLocation(s.timeFormat, value, time.Local)
+	if err != nil {
+		t, _ = time.Parse(time.RFC3339, value)
+	}
+	return t
+}
+
+// stateFileVersion is the version of the sent file format. Since version 2 files start with
+// a header row, which names the columns and ends with the version, e.g.
+// url,time,run_id,type,notify_time,#v2. Files without one are version 1.
+const stateFileVersion = 2
+
+// header returns the header row of a sent file with the columns of the schema
+func (s stateSchema) header() []string {
+	return append(slices.Clone(s.columns), "#v"+strconv.Itoa(stateFileVersion))
+}
+
+// parseStateHeader returns the columns of a header row, or false if the row isn't one.
+// Files of newer versions can't be read.
+func parseStateHeader(row []string) ([]string, bool, error) {
+	if len(row) < 2 {
+		return nil, false, nil
+	}
+	marker, ok := strings.CutPrefix(row[len(row)-1], "#v")
+	if !ok {
+		return nil, false, nil
+	}
+	version, err := strconv.Atoi(marker)
+	if err != nil {
+		return nil, false, nil
+	}
+	if version > stateFileVersion {
+		return nil, false, fmt.Errorf("the state file has version %d, this version reads up to %d", version, stateFileVersion)
+	}
+	return row[:len(row)-1], true, nil
+}
+
+// convert maps a row with other columns to the columns of the schema by name, columns
+// which the row doesn't have are left empty
+func (s stateSchema) convert(row []string, columns []string) []string {
+	converted := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		j := slices.Index(columns, column)
+		if j >= 0 && j < len(row) {
+			converted[i] = row[j]
+		}
+	}
+	return converted
+}
+
+// readCsv reads URLs from the first column of a CSV file and returns them as a map
+func readCsv(filePath string) (map[string]struct{}, error) {
+	file, err := readState(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := map[string]struct{}{}
+	for _, record := range records {
+		urls[normalizeUrl(record[0])] = struct{}{}
+	}
+
+	return urls, nil
+}
+
+// readSentRecords reads all records of the sent file, creating the file if it doesn't exist
+func readSentRecords(filePath string) ([]sentRecord, error) {
+	file, err := readState(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := readSentRows(file)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]sentRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, parseSentRow(row))
+	}
+	return records, nil
+}
+
+// readSentRows reads the rows of the sent file or an archived segment with the configured
+// columns. Rows after a header row have the columns it names and are mapped to the configured
+// ones, rows of legacy files without a header already have them.
+func readSentRows(r io.Reader) ([][]string, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.Comma = schema.comma
+	// Rows written by older versions or with another schema have a different number of columns
+	csvReader.FieldsPerRecord = -1
+	// Files edited by hand may have quotes within unquoted fields
+	csvReader.LazyQuotes = true
+
+	var rows [][]string
+	columns := schema.columns
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		header, ok, err := parseStateHeader(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			columns = header
+			continue
+		}
+		if !slices.Equal(columns, schema.columns) {
+			row = schema.convert(row, columns)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parseSentRow reads a record from a row with a normalized URL
+func parseSentRow(row []string) sentRecord {
+	rec := schema.parse(row)
+	rec.Url = normalizeUrl(rec.Url)
+	return rec
+}
+
+// readSent reads the sent URLs, including archived ones, and returns them as a map
+func readSent(filePath string) (map[string]struct{}, error) {
+	records, err := storeFor(filePath).Latest()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := map[string]struct{}{}
+	for _, rec := range records {
+		urls[rec.Url] = struct{}{}
+	}
+	return urls, nil
+}
+
+// sentKey identifies a notification of a URL with a type, rows without a type are URL_UPDATED
+func sentKey(url, typ string) string {
+	if typ == "" {
+		typ = "URL_UPDATED"
+	}
+	return typ + " " + url
+}
+
+// isDeleted checks if the last notification sent for a URL is URL_DELETED
+func isDeleted(lastSent map[string]time.Time, url string) bool {
+	deletedAt, deleted := lastSent[sentKey(url, "URL_DELETED")]
+	return deleted && deletedAt.After(lastSent[sentKey(url, "URL_UPDATED")])
+}
+
+// sentAt returns the time Google acknowledged the notification, or the local time it was sent
+// for rows without it
+func (rec sentRecord) sentAt() time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, rec.NotifyTime); err == nil {
+		return t
+	}
+	return rec.Time
+}
+
+// lastSentTimes reads the time each URL was last sent, keyed by sentKey
+func lastSentTimes(filePath string) (map[string]time.Time, error) {
+	records, err := storeFor(filePath).Latest()
+	if err != nil {
+		return nil, err
+	}
+	return latestTimes(records), nil
+}
+
+// latestTimes returns the time each URL of the records was last sent, keyed by sentKey
+func latestTimes(records []sentRecord) map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, rec := range records {
+		key := sentKey(rec.Url, rec.Type)
+		t := rec.sentAt()
+		if t.After(times[key]) {
+			times[key] = t
+		}
+	}
+	return times
+}
+
+// contains checks if a map contains a given string
+func contains(m map[string]struct{}, str string) bool {
+	_, ok := m[str]
+	return ok
+}
+
+// appendUrlToCsv appends a record to the sent file, which is upgraded first if needed
+func appendUrlToCsv(filePath string, rec sentRecord) error {
+	stateWriteMu.Lock()
+	defer stateWriteMu.Unlock()
+
+	rows := [][]string{schema.row(rec)}
+	first, err := firstCsvRow(filePath, schema.comma)
+	switch {
+	case err != nil:
+		return err
+	case first == nil:
+		rows = append([][]string{schema.header()}, rows...)
+	case !slices.Equal(first, schema.header()):
+		_, err = rewriteCsv(filePath, schema.comma, upgradeSentData)
+		if err != nil {
+			return err
+		}
+	}
+	return appendCsvRows(filePath, schema.comma, rows...)
+}
+
+// upgradeSentFile upgrades a sent file in place, see upgradeSentData, and returns whether
+// it was changed. Empty files get their header with the first record.
+func upgradeSentFile(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) || err == nil && info.Size() == 0 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	stateWriteMu.Lock()
+	defer stateWriteMu.Unlock()
+	return rewriteCsv(filePath, schema.comma, upgradeSentData)
+}
+
+// upgradeSentData returns the content of a sent file starting with the header row of the
+// configured columns. Legacy files without a header and files with other columns are
+// rewritten with the configured columns, unless values of columns which aren't configured
+// would be lost.
+func upgradeSentData(data []byte) ([]byte, error) {
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.Comma = schema.comma
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	first, err := csvReader.Read()
+	if err == nil && slices.Equal(first, schema.header()) {
+		return data, nil
+	}
+
+	lost, err := lostColumns(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(lost) > 0 {
+		return nil, fmt.Errorf("rewriting the sent file with the configured columns would drop the values of %s, add them to STATE_COLUMNS",
+			strings.Join(lost, ", "))
+	}
+
+	rows, err := readSentRows(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return appendRows(nil, schema.comma, append([][]string{schema.header()}, rows...)...)
+}
+
+// lostColumns returns the columns of a sent file which have values but aren't configured,
+// by the names in its header rows, or by their position in legacy rows without one
+func lostColumns(data []byte) ([]string, error) {
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.Comma = schema.comma
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+
+	var lost []string
+	columns := schema.columns
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			return lost, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		header, ok, err := parseStateHeader(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			columns = header
+			continue
+		}
+		for i, value := range row {
+			if value == "" {
+				continue
+			}
+			name := fmt.Sprintf("column %d", i+1)
+			if i < len(columns) {
+				name = columns[i]
+			}
+			if !slices.Contains(schema.columns, name) && !slices.Contains(lost, name) {
+				lost = append(lost, name)
+			}
+		}
+	}
+}
+
+// firstCsvRow reads the first row of a CSV file, nil if it is missing or empty
+func firstCsvRow(filePath string, comma rune) ([]string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.Comma = comma
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	row, err := csvReader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return row, err
+}
+
+// stateWriteMu serializes the writes of state files within the process
+var stateWriteMu sync.Mutex
+
+// appendCsvRow appends a row to a CSV file, creating it if it doesn't exist
+func appendCsvRow(filePath string, comma rune, row []string) error {
+	stateWriteMu.Lock()
+	defer stateWriteMu.Unlock()
+	return appendCsvRows(filePath, comma, row)
+}
+
+// appendCsvRows appends rows to a CSV file and syncs it to disk before returning. A crash
+// while appending can only leave a torn last row, which repairCsvTail removes before the
+// next rows are appended.
+func appendCsvRows(filePath string, comma rune, rows ...[]string) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size, err := repairCsvTail(file, comma)
+	if err != nil {
+		return err
+	}
+	data, err := appendRows(nil, comma, rows...)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, size)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// repairCsvTail handles a last row without a line break, which is left by a crash while
+// appending or by editing the file by hand, and returns the size of the file after. A
+// complete row is terminated, a torn one is removed. A row is torn if it ends within a quoted
+// field or has fewer fields than the row before it. Files which end with a line break are
+// left as they are without reading them.
+func repairCsvTail(file *os.File, comma rune) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, size-1)
+	if err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+
+	data := make([]byte, size)
+	_, err = file.ReadAt(data, 0)
+	if err != nil {
+		return 0, err
+	}
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.Comma = comma
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	var start int64
+	var row, prev []string
+	for {
+		offset := csvReader.InputOffset()
+		next, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("parsing %s: %w", file.Name(), err)
+		}
+		start, prev, row = offset, row, next
+	}
+
+	// Unlike the lenient reader, a strict one fails on a quoted field without its closing quote
+	strict := csv.NewReader(bytes.NewReader(data[start:]))
+	strict.Comma = comma
+	_, err = strict.Read()
+	if errors.Is(err, csv.ErrQuote) || prev != nil && len(row) < len(prev) {
+		return start, file.Truncate(start)
+	}
+	_, err = file.WriteAt([]byte{'\n'}, size)
+	return size + 1, err
+}
+
+// rewriteCsv replaces the content of a CSV file with what update returns for it and
+// returns whether it changed. The file is written to a temporary file which replaces it,
+// so a crash leaves either the old or the new file. The caller holds stateWriteMu.
+func rewriteCsv(filePath string, comma rune, update func(data []byte) ([]byte, error)) (bool, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = repairCsvTail(file, comma)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	// Clipped, so appending doesn't overwrite the current content
+	updated, err := update(slices.Clip(data))
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(updated, data) {
+		return false, nil
+	}
+	return true, writeFileAtomic(filePath, updated)
+}
+
+// appendRows returns data with rows appended. Fields with delimiters, quotes or line breaks
+// are quoted.
+func appendRows(data []byte, comma rune, rows ...[]string) ([]byte, error) {
+	buf := bytes.NewBuffer(data)
+	writer := csv.NewWriter(buf)
+	writer.Comma = comma
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic replaces a file with data, which is synced to disk before the rename, and
+// syncs the directory after it
+func writeFileAtomic(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFile writes content to a file in a temporary directory and returns its path
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(filePath, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpgradeSentFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "v1 without a header",
+			content: "https://example.com/a,2024-06-01T10:00:00Z\nhttps://example.com/b,2024-06-01T11:00:00Z,run1,URL_DELETED\n",
+			want: "url,time,run_id,type,notify_time,#v2\n" +
+				"https://example.com/a,2024-06-01T10:00:00Z\nhttps://example.com/b,2024-06-01T11:00:00Z,run1,URL_DELETED\n",
+		},
+		{
+			name:    "other columns",
+			content: "time,url,type,#v2\n2024-06-01T10:00:00Z,https://example.com/a,URL_UPDATED\n",
+			want:    "url,time,run_id,type,notify_time,#v2\nhttps://example.com/a,2024-06-01T10:00:00Z,,URL_UPDATED,\n",
+		},
+		{
+			name:    "unconfigured columns without values",
+			content: "url,time,type,title,#v2\nhttps://example.com/a,2024-06-01T10:00:00Z,URL_UPDATED,\n",
+			want:    "url,time,run_id,type,notify_time,#v2\nhttps://example.com/a,2024-06-01T10:00:00Z,,URL_UPDATED,\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := writeTestFile(t, "sent.csv", tt.content)
+			changed, err := upgradeSentFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("upgradeSentFile didn't change the file")
+			}
+			if got := readTestFile(t, filePath); got != tt.want {
+				t.Errorf("upgraded file is\n%s\nwant\n%s", got, tt.want)
+			}
+
+			// Upgrading again changes nothing
+			changed, err = upgradeSentFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed {
+				t.Error("upgradeSentFile changed an upgraded file")
+			}
+			if got := readTestFile(t, filePath); got != tt.want {
+				t.Errorf("file upgraded twice is\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeSentFileKeepsCurrentFiles(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"url,time,run_id,type,notify_time,#v2\n",
+		"url,time,run_id,type,notify_time,#v2\nhttps://example.com/a,2024-06-01T10:00:00Z,run1,URL_UPDATED,\n",
+	} {
+		filePath := writeTestFile(t, "sent.csv", content)
+		changed, err := upgradeSentFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, filePath); changed || got != content {
+			t.Errorf("upgradeSentFile changed %q to %q", content, got)
+		}
+	}
+
+	changed, err := upgradeSentFile(filepath.Join(t.TempDir(), "missing.csv"))
+	if err != nil || changed {
+		t.Errorf("upgradeSentFile of a missing file = %v, %v", changed, err)
+	}
+}
+
+func TestUpgradeSentFileRefusesToDropValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lost    string
+	}{
+		{
+			name:    "named column",
+			content: "url,time,type,title,#v2\nhttps://example.com/a,2024-06-01T10:00:00Z,URL_UPDATED,Home\n",
+			lost:    "title",
+		},
+		{
+			name:    "legacy column",
+			content: "https://example.com/a,2024-06-01T10:00:00Z,run1,URL_UPDATED,,extra\n",
+			lost:    "column 6",
+		},
+		{
+			name:    "named column after a legacy row",
+			content: "https://example.com/a,2024-06-01T10:00:00Z\nurl,time,key,#v2\nhttps://example.com/b,2024-06-01T10:00:00Z,k1\n",
+			lost:    "key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := writeTestFile(t, "sent.csv", tt.content)
+			changed, err := upgradeSentFile(filePath)
+			if err == nil || !strings.Contains(err.Error(), tt.lost) {
+				t.Errorf("upgradeSentFile = %v, %v, want an error about %s", changed, err, tt.lost)
+			}
+			if got := readTestFile(t, filePath); got != tt.content {
+				t.Errorf("refused upgrade changed the file to\n%s", got)
+			}
+		})
+	}
+}
+
+func TestUpgradeSentFileRefusesNewerVersions(t *testing.T) {
+	content := "url,time,type,#v3\nhttps://example.com/a,2024-06-01T10:00:00Z,URL_UPDATED\n"
+	filePath := writeTestFile(t, "sent.csv", content)
+	_, err := upgradeSentFile(filePath)
+	if err == nil {
+		t.Error("upgradeSentFile upgraded a file of a newer version")
+	}
+	if got := readTestFile(t, filePath); got != content {
+		t.Errorf("refused upgrade changed the file to\n%s", got)
+	}
+}
+
+func TestRepairCsvTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"intact", "a,b,c\nd,e,f\n", "a,b,c\nd,e,f\n"},
+		{"empty", "", ""},
+		{"no trailing line break", "a,b,c\nd,e,f", "a,b,c\nd,e,f\n"},
+		{"single row without a line break", "a,b,c", "a,b,c\n"},
+		{"torn row", "a,b,c\nd,e,f\ng,h", "a,b,c\nd,e,f\n"},
+		{"torn quoted field", "a,b,c\nd,\"e,\nf", "a,b,c\n"},
+		{"quoted line break", "a,b,c\nd,\"e\nf\",g", "a,b,c\nd,\"e\nf\",g\n"},
+		{"crlf", "a,b,c\r\nd,e,f", "a,b,c\r\nd,e,f\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := writeTestFile(t, "sent.csv", tt.content)
+			file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := repairCsvTail(file, ',')
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readTestFile(t, filePath)
+			if got != tt.want {
+				t.Errorf("repaired file is %q, want %q", got, tt.want)
+			}
+			if size != int64(len(got)) {
+				t.Errorf("repairCsvTail returned size %d, the file has %d bytes", size, len(got))
+			}
+		})
+	}
+}
+
+func TestAppendCsvRowsAfterTornRow(t *testing.T) {
+	filePath := writeTestFile(t, "retry_queue.csv", "a,b,c\nd,e")
+	err := appendCsvRow(filePath, ',', []string{"g", "h", "i"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTestFile(t, filePath), "a,b,c\ng,h,i\n"; got != want {
+		t.Errorf("file is %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// State archive settings
+var (
+	stateRetention  = os.Getenv("STATE_RETENTION")
+	stateArchiveDir = os.Getenv("STATE_ARCHIVE_DIR")
+)
+
+// stateArchivePath returns the archive directory of a sent file, which defaults to state-archive next to it
+func stateArchivePath(filePath string) string {
+	if stateArchiveDir != "" {
+		return stateArchiveDir
+	}
+	return filepath.Join(filepath.Dir(filePath), "state-archive")
+}
+
+// stateSegmentPrefix is the file name prefix of the archived segments of a sent file,
+// so sent files sharing an archive directory don't mix
+func stateSegmentPrefix(filePath string) string {
+	base := filepath.Base(filePath)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// archiveState moves records older than STATE_RETENTION from the sent file into
+// gzipped monthly segments in the archive directory and returns how many were moved.
+// Archived URLs still count as sent.
+func archiveState(filePath string) (int, error) {
+	if stateRetention == "" {
+		return 0, nil
+	}
+	retention, err := time.ParseDuration(stateRetention)
+	if err != nil {
+		return 0, fmt.Errorf("parsing STATE_RETENTION: %w", err)
+	}
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	stateWriteMu.Lock()
+	defer stateWriteMu.Unlock()
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rows, err := readSentRows(file)
+	file.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := clock.Now().Add(-retention)
+	var hot, cold [][]string
+	segments := map[string][][]string{}
+	for _, row := range rows {
+		rec := schema.parse(row)
+		if rec.Time.IsZero() || rec.Time.After(cutoff) {
+			hot = append(hot, row)
+			continue
+		}
+		cold = append(cold, row)
+		month := rec.Time.UTC().Format("2006-01")
+		segments[month] = append(segments[month], row)
+	}
+	if len(cold) == 0 {
+		return 0, nil
+	}
+
+	dir := stateArchivePath(filePath)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	// Segments and the index are written before the sent file is rewritten, so an
+	// interruption can only leave records in both places, never lose them
+	for _, month := range sortedKeys(segments) {
+		path := filepath.Join(dir, stateSegmentPrefix(filePath)+month+".csv.gz")
+		err = appendSegment(path, segments[month])
+		if err != nil {
+			return 0, err
+		}
+	}
+	index, err := readArchiveIndex(filePath)
+	if err != nil {
+		return 0, err
+	}
+	err = writeArchiveIndex(filePath, latestRows(append(index, cold...)))
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := appendRows(nil, schema.comma, append([][]string{schema.header()}, hot...)...)
+	if err != nil {
+		return 0, err
+	}
+	return len(cold), writeFileAtomic(filePath, data)
+}
+
+// archiveIndexPath returns the index of the archived segments of a sent file, which keeps
+// the latest archived row of every URL and notification type, so checking what was sent
+// doesn't read every segment
+func archiveIndexPath(filePath string) string {
+	return filepath.Join(stateArchivePath(filePath), stateSegmentPrefix(filePath)+"index.csv")
+}
+
+// readArchiveIndex reads the rows of the archive index. Archives of older versions without
+// one get it built from their segments, unless in read-only mode.
+func readArchiveIndex(filePath string) ([][]string, error) {
+	file, err := os.Open(archiveIndexPath(filePath))
+	if err == nil {
+		defer file.Close()
+		return readSentRows(file)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	paths, err := archivedSegments(filePath)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	var rows [][]string
+	for _, path := range paths {
+		segment, err := readSegmentRows(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+		}
+		rows = append(rows, segment...)
+	}
+	rows = latestRows(rows)
+	if readOnly != "true" {
+		err = writeArchiveIndex(filePath, rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// writeArchiveIndex replaces the archive index with rows
+func writeArchiveIndex(filePath string, rows [][]string) error {
+	data, err := appendRows(nil, schema.comma, append([][]string{schema.header()}, rows...)...)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(archiveIndexPath(filePath), data)
+}
+
+// latestRows keeps the latest row of every URL and notification type, oldest first
+func latestRows(rows [][]string) [][]string {
+	latest := map[string][]string{}
+	times := map[string]time.Time{}
+	for _, row := range rows {
+		rec := parseSentRow(row)
+		key := sentKey(rec.Url, rec.Type)
+		if t, ok := times[key]; !ok || !rec.sentAt().Before(t) {
+			latest[key], times[key] = row, rec.sentAt()
+		}
+	}
+	keys := sortedKeys(latest)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return times[keys[i]].Before(times[keys[j]])
+	})
+	result := make([][]string, len(keys))
+	for i, key := range keys {
+		result[i] = latest[key]
+	}
+	return result
+}
+
+// appendSegment appends rows to a segment as a new gzip member, which readers see as one stream.
+// Every member starts with a header row, as the columns may have changed since the last one.
+// The segment and its directory are synced before the rows are removed from the sent file.
+func appendSegment(path string, rows [][]string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(file)
+	writer := csv.NewWriter(zw)
+	writer.Comma = schema.comma
+	writer.Write(schema.header())
+	writer.WriteAll(rows)
+	err = writer.Error()
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// segmentMonth returns the month of an archived segment of a sent file, e.g. 2024-06
+func segmentMonth(filePath, path string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), stateSegmentPrefix(filePath)), ".csv.gz")
+}
+
+// archivedSegments returns the paths of the archived segments of a sent file, oldest first
+func archivedSegments(filePath string) ([]string, error) {
+	dir := stateArchivePath(filePath)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := stateSegmentPrefix(filePath)
+	var paths []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) && strings.HasSuffix(f.Name(), ".csv.gz") {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readArchivedRecords reads the records of all archived segments of a sent file, oldest first
+func readArchivedRecords(filePath string) ([]sentRecord, error) {
+	paths, err := archivedSegments(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var records []sentRecord
+	for _, path := range paths {
+		rows, err := readSegmentRows(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+		}
+		for _, row := range rows {
+			records = append(records, parseSentRow(row))
+		}
+	}
+	return records, nil
+}
+
+func readSegmentRows(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readSentRows(zr)
+}
+
+// readSentHistory reads all archived and current records of a sent file, which decompresses
+// every segment, so it is only used by the history, export and reports
+func readSentHistory(filePath string) ([]sentRecord, error) {
+	archived, err := readArchivedRecords(filePath)
+	if err != nil {
+		return nil, err
+	}
+	records, err := storeFor(filePath).Sent()
+	if err != nil {
+		return nil, err
+	}
+	return append(archived, records...), nil
+}
+
+// runHistory prints every notification sent for the given URLs, including archived ones
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatal("Usage: indexapi history <url>...")
+		return
+	}
+
+	var urls []string
+	for _, arg := range fs.Args() {
+		urls = append(urls, normalizeUrl(arg))
+	}
+	found, err := stateStore.Get(urls...)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+	for _, url := range urls {
+		records := recordsOf(found, []string{url})
+		for _, rec := range records {
+			typ := rec.Type
+			if typ == "" {
+				typ = "URL_UPDATED"
+			}
+			fmt.Printf("%s %-12s %-22s %s\n", rec.Time.Format(time.RFC3339), typ, rec.RunID, rec.Url)
+		}
+		if len(records) == 0 {
+			fmt.Printf("%s was never sent\n", url)
+		}
+	}
+}
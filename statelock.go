@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// stateLock is the lock of the state files held by this process. The operating system
+// releases it when the process exits, even when it crashes.
+var stateLock *os.File
+
+// stateLockPath returns the lock file of the state files next to a sent file
+func stateLockPath(sentFile string) string {
+	return sentFile + ".lock"
+}
+
+// lockState takes the lock of the state files until the process exits, so two instances
+// don't append to the same sent file and spend the quota twice. It fails right away if
+// another instance holds it.
+func lockState() error {
+	path := stateLockPath(sentFile)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = lockFile(file)
+	if errors.Is(err, errLocked) {
+		file.Close()
+		return fmt.Errorf("the state files are used by another running instance, %s is locked", path)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("locking %s: %w", path, err)
+	}
+	stateLock = file
+	return nil
+}
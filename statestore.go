@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var dedupWindow = os.Getenv("DEDUP_WINDOW")
+
+// stateBackend is where the sent URLs, the indexed URLs and the failed notifications are
+// kept: CSV files by default, the tables of an SQLite, PostgreSQL or MySQL database, the
+// buckets of a bbolt file or the keys of a Redis server
+var stateBackend = os.Getenv("STATE_BACKEND")
+
+// Queues of failed notifications, the dead letter file and the retry queue of CSV state
+const (
+	queueDeadLetter = "dead_letter"
+	queueRetry      = "retry"
+)
+
+// StateStore keeps the state of the submitted URLs, so backends other than the CSV files
+// and fakes in tests can replace them
+type StateStore interface {
+	// Get returns the records sent for the URLs, oldest first
+	Get(urls ...string) ([]sentRecord, error)
+	// Latest returns the latest record of every URL and notification type
+	Latest() ([]sentRecord, error)
+	// SentSince returns the records sent at or after a time, oldest first
+	SentSince(t time.Time) ([]sentRecord, error)
+	// Sent returns all sent records, oldest first
+	Sent() ([]sentRecord, error)
+	// MarkSent records a notification sent to the Index API
+	MarkSent(rec sentRecord) error
+	// Indexed returns the URLs which are indexed and aren't sent
+	Indexed() (map[string]struct{}, error)
+	// MarkIndexed records that a URL is indexed
+	MarkIndexed(url string) error
+	// Failures returns the failed notifications of a queue, oldest first
+	Failures(queue string) ([]failedNotification, error)
+	// MarkFailed records a failed notification in a queue
+	MarkFailed(queue string, f failedNotification) error
+	// SentToday returns the number of URLs sent today, in total and per service account key
+	SentToday() (int, map[string]int, error)
+}
+
+// stateStore is the StateStore of SENT_FILE and STATE_BACKEND, set up on start
+var stateStore StateStore = csvStore{}
+
+// newStateStore creates the StateStore of STATE_BACKEND
+func newStateStore() (StateStore, error) {
+	switch stateBackend {
+	case "", "csv":
+		return csvStore{sentFile: sentFile}, nil
+	case "sqlite", "postgres", "mysql":
+		return sqlStore{}, nil
+	case "bolt":
+		return boltStore{}, nil
+	case "redis":
+		return redisStore{}, nil
+	}
+	return nil, fmt.Errorf("unknown state backend %q, expected csv, sqlite, postgres, mysql, bolt or redis", stateBackend)
+}
+
+// storeFor returns the StateStore of a sent file. Other sent files than SENT_FILE, such as
+// the copy a simulation works on or the state files of the operator, are CSV files.
+func storeFor(filePath string) StateStore {
+	if filePath == sentFile {
+		return stateStore
+	}
+	return csvStore{sentFile: filePath}
+}
+
+// dedupStore is a StateStore which enforces DEDUP_WINDOW: a URL is never sent with the same
+// type twice within the window, whichever command or source queued it
+type dedupStore struct {
+	StateStore
+	window time.Duration
+
+	mu sync.Mutex
+	// lastSent holds the time each URL was last sent, keyed by sentKey
+	lastSent map[string]time.Time
+}
+
+// newDedupStore creates the dedup store of a sent file
+func newDedupStore(filePath string) (*dedupStore, error) {
+	window, err := parseDurationDefault(dedupWindow, 6*time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DEDUP_WINDOW: %w", err)
+	}
+	// Only the notifications within the window can hold one back
+	store := storeFor(filePath)
+	records, err := store.SentSince(clock.Now().Add(-window))
+	if err != nil {
+		return nil, fmt.Errorf("reading sent URLs: %w", err)
+	}
+	return &dedupStore{StateStore: store, window: window, lastSent: latestTimes(records)}, nil
+}
+
+// due checks if a notification may be sent, and returns when it was last sent if not
+func (d *dedupStore) due(n notification) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.lastSent[sentKey(n.Url, n.Type)]
+	return last, !ok || clock.Now().Sub(last) >= d.window
+}
+
+// MarkSent records a notification, which starts its window
+func (d *dedupStore) MarkSent(rec sentRecord) error {
+	d.mu.Lock()
+	d.lastSent[sentKey(rec.Url, rec.Type)] = rec.Time
+	d.mu.Unlock()
+	return d.StateStore.MarkSent(rec)
+}
+
+// startOfToday returns the local midnight of today
+func startOfToday() time.Time {
+	y, m, d := clock.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// countToday counts the records sent today, in total and per service account key
+func countToday(records []sentRecord) (int, map[string]int) {
+	y, m, d := clock.Now().Date()
+	total, byKey := 0, map[string]int{}
+	for _, rec := range records {
+		ry, rm, rd := rec.Time.In(time.Local).Date()
+		if ry == y && rm == m && rd == d {
+			total++
+			byKey[rec.Key]++
+		}
+	}
+	return total, byKey
+}
+
+// sentToday counts the records of a store sent today
+func sentToday(store StateStore) (int, map[string]int, error) {
+	records, err := store.SentSince(startOfToday())
+	if err != nil {
+		return 0, nil, err
+	}
+	total, byKey := countToday(records)
+	return total, byKey, nil
+}
+
+// urlSet returns the set of the given URLs
+func urlSet(urls []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(urls))
+	for _, url := range urls {
+		set[url] = struct{}{}
+	}
+	return set
+}
+
+// recordsOf returns the records of the URLs
+func recordsOf(records []sentRecord, urls []string) []sentRecord {
+	set := urlSet(urls)
+	var found []sentRecord
+	for _, rec := range records {
+		if contains(set, rec.Url) {
+			found = append(found, rec)
+		}
+	}
+	return found
+}
+
+// latestRecords keeps the latest record of every URL and notification type, oldest first
+func latestRecords(records []sentRecord) []sentRecord {
+	index := map[string]int{}
+	var latest []sentRecord
+	for _, rec := range records {
+		key := sentKey(rec.Url, rec.Type)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(latest)
+			latest = append(latest, rec)
+		} else if !rec.sentAt().Before(latest[i].sentAt()) {
+			latest[i] = rec
+		}
+	}
+	sort.SliceStable(latest, func(i, j int) bool {
+		return latest[i].sentAt().Before(latest[j].sentAt())
+	})
+	return latest
+}
+
+// withIndexedFile adds the URLs of INDEXED_FILE, which database backends still read
+func withIndexedFile(urls map[string]struct{}) (map[string]struct{}, error) {
+	fromFile, err := readCsv(indexedFile)
+	if err != nil {
+		return nil, err
+	}
+	for url := range fromFile {
+		urls[url] = struct{}{}
+	}
+	return urls, nil
+}
+
+// csvStore keeps the state in the sent file, INDEXED_FILE and the dead letter and retry
+// queue files next to the sent file
+type csvStore struct {
+	sentFile string
+}
+
+// Get reads the archived segments one at a time, keeping only the records of the URLs
+func (s csvStore) Get(urls ...string) ([]sentRecord, error) {
+	set := urlSet(urls)
+	return s.matching(time.Time{}, func(rec sentRecord) bool {
+		return contains(set, rec.Url)
+	})
+}
+
+// Latest reads the archive index and the records of the sent file, which only holds the
+// records within STATE_RETENTION once the state is archived
+func (s csvStore) Latest() ([]sentRecord, error) {
+	index, err := readArchiveIndex(s.sentFile)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readSentRecords(s.sentFile)
+	if err != nil {
+		return nil, err
+	}
+	archived := make([]sentRecord, 0, len(index)+len(records))
+	for _, row := range index {
+		archived = append(archived, parseSentRow(row))
+	}
+	return latestRecords(append(archived, records...)), nil
+}
+
+// SentSince only reads the archived segments of the months since t
+func (s csvStore) SentSince(t time.Time) ([]sentRecord, error) {
+	return s.matching(t, func(rec sentRecord) bool {
+		return !rec.Time.Before(t)
+	})
+}
+
+// matching returns the archived and current records which match keep, reading only the
+// segments of the months since a time
+func (s csvStore) matching(since time.Time, keep func(sentRecord) bool) ([]sentRecord, error) {
+	paths, err := archivedSegments(s.sentFile)
+	if err != nil {
+		return nil, err
+	}
+	var found []sentRecord
+	for _, path := range paths {
+		if !since.IsZero() && segmentMonth(s.sentFile, path) < since.UTC().Format("2006-01") {
+			continue
+		}
+		rows, err := readSegmentRows(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+		}
+		for _, row := range rows {
+			if rec := parseSentRow(row); keep(rec) {
+				found = append(found, rec)
+			}
+		}
+	}
+	records, err := readSentRecords(s.sentFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		if keep(rec) {
+			found = append(found, rec)
+		}
+	}
+	return found, nil
+}
+
+func (s csvStore) Sent() ([]sentRecord, error) {
+	return readSentRecords(s.sentFile)
+}
+
+func (s csvStore) MarkSent(rec sentRecord) error {
+	return appendUrlToCsv(s.sentFile, rec)
+}
+
+func (s csvStore) Indexed() (map[string]struct{}, error) {
+	return readCsv(indexedFile)
+}
+
+func (s csvStore) MarkIndexed(url string) error {
+	return appendCsvRow(indexedFile, ',', []string{url})
+}
+
+func (s csvStore) Failures(queue string) ([]failedNotification, error) {
+	return readFailures(s.failuresFile(queue))
+}
+
+func (s csvStore) MarkFailed(queue string, f failedNotification) error {
+	return appendFailure(s.failuresFile(queue), f)
+}
+
+func (s csvStore) SentToday() (int, map[string]int, error) {
+	return sentToday(s)
+}
+
+// failuresFile returns the file of a queue
+func (s csvStore) failuresFile(queue string) string {
+	if queue == queueDeadLetter {
+		return deadLetterFilePath(s.sentFile)
+	}
+	return retryQueueFilePath(s.sentFile)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// memoryStore is a StateStore which keeps the state in memory
+type memoryStore struct {
+	mu       sync.Mutex
+	sent     []sentRecord
+	indexed  map[string]struct{}
+	failures map[string][]failedNotification
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{indexed: map[string]struct{}{}, failures: map[string][]failedNotification{}}
+}
+
+// useMemoryStore makes a memory store the StateStore of a sent file in a temporary
+// directory until the test ends, and returns the path of the sent file
+func useMemoryStore(t *testing.T, store *memoryStore) string {
+	t.Helper()
+	prevStore, prevFile := stateStore, sentFile
+	stateStore, sentFile = store, filepath.Join(t.TempDir(), "sent.csv")
+	t.Cleanup(func() { stateStore, sentFile = prevStore, prevFile })
+	return sentFile
+}
+
+func (s *memoryStore) Get(urls ...string) ([]sentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return recordsOf(s.sent, urls), nil
+}
+
+func (s *memoryStore) Latest() ([]sentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latestRecords(s.sent), nil
+}
+
+func (s *memoryStore) SentSince(t time.Time) ([]sentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []sentRecord
+	for _, rec := range s.sent {
+		if !rec.Time.Before(t) {
+			found = append(found, rec)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStore) Sent() ([]sentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sentRecord(nil), s.sent...), nil
+}
+
+func (s *memoryStore) MarkSent(rec sentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, rec)
+	return nil
+}
+
+func (s *memoryStore) Indexed() (map[string]struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := map[string]struct{}{}
+	for url := range s.indexed {
+		urls[url] = struct{}{}
+	}
+	return urls, nil
+}
+
+func (s *memoryStore) MarkIndexed(url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.indexed[url] = struct{}{}
+	return nil
+}
+
+func (s *memoryStore) Failures(queue string) ([]failedNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]failedNotification(nil), s.failures[queue]...), nil
+}
+
+func (s *memoryStore) MarkFailed(queue string, f failedNotification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[queue] = append(s.failures[queue], f)
+	return nil
+}
+
+func (s *memoryStore) SentToday() (int, map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total, byKey := countToday(s.sent)
+	return total, byKey, nil
+}
+
+func TestSentTodayFollowsTheClock(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	c := useFakeClock(t, now)
+	store := newMemoryStore()
+	store.MarkSent(sentRecord{Url: "https://example.com/a", Time: now.Add(-24 * time.Hour), Key: "k1"})
+	store.MarkSent(sentRecord{Url: "https://example.com/b", Time: now.Add(-time.Hour), Key: "k1"})
+	store.MarkSent(sentRecord{Url: "https://example.com/c", Time: now, Key: "k2"})
+
+	total, byKey, err := store.SentToday()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || byKey["k1"] != 1 || byKey["k2"] != 1 {
+		t.Errorf("SentToday = %d %v, want 2 with 1 per key", total, byKey)
+	}
+
+	c.advance(24 * time.Hour)
+	total, _, err = store.SentToday()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("SentToday on the next day = %d, want 0", total)
+	}
+}
+
+func TestDedupStore(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, now)
+	store := newMemoryStore()
+	store.MarkSent(sentRecord{Url: "https://example.com/a", Time: now.Add(-2 * time.Hour), Type: "URL_UPDATED"})
+	store.MarkSent(sentRecord{Url: "https://example.com/b", Time: now.Add(-30 * time.Minute), Type: "URL_UPDATED"})
+	path := useMemoryStore(t, store)
+	prevWindow := dedupWindow
+	dedupWindow = "1h"
+	t.Cleanup(func() { dedupWindow = prevWindow })
+
+	dedup, err := newDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n    notification
+		want bool
+	}{
+		{notification{Url: "https://example.com/a", Type: "URL_UPDATED"}, true},
+		{notification{Url: "https://example.com/b", Type: "URL_UPDATED"}, false},
+		{notification{Url: "https://example.com/b", Type: "URL_DELETED"}, true},
+		{notification{Url: "https://example.com/c", Type: "URL_UPDATED"}, true},
+	}
+	for _, tt := range tests {
+		if _, got := dedup.due(tt.n); got != tt.want {
+			t.Errorf("due(%s %s) = %v, want %v", tt.n.Type, tt.n.Url, got, tt.want)
+		}
+	}
+
+	// Sending a notification starts its window, in the store and in the dedup check
+	a := notification{Url: "https://example.com/a", Type: "URL_UPDATED"}
+	err = dedup.MarkSent(sentRecord{Url: a.Url, Type: a.Type, Time: c.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, ok := dedup.due(a); ok || !last.Equal(now) {
+		t.Errorf("due after MarkSent = %s %v, want %s false", last, ok, now)
+	}
+	if records, _ := store.Get(a.Url); len(records) != 2 {
+		t.Errorf("store has %d records of %s, want 2", len(records), a.Url)
+	}
+
+	c.advance(time.Hour)
+	if _, ok := dedup.due(a); !ok {
+		t.Errorf("due after the window = false, want true")
+	}
+}
+
+// lookupRecords are sent records for the lookup tests, relative to now
+func lookupRecords(now time.Time) []sentRecord {
+	return []sentRecord{
+		{Url: "https://example.com/a", Time: now.Add(-48 * time.Hour), Type: "URL_UPDATED"},
+		{Url: "https://example.com/b", Time: now.Add(-2 * time.Hour), Type: "URL_UPDATED"},
+		{Url: "https://example.com/a", Time: now.Add(-time.Hour), Type: "URL_DELETED"},
+		{Url: "https://example.com/a", Time: now.Add(-30 * time.Minute), Type: "URL_UPDATED"},
+		{Url: "https://example.com/c", Time: now, Type: "URL_UPDATED"},
+	}
+}
+
+// sentList describes records by their type, URL and time, which every backend stores
+func sentList(records []sentRecord) []string {
+	list := []string{}
+	for _, rec := range records {
+		list = append(list, sentKey(rec.Url, rec.Type)+" "+rec.Time.UTC().Format(time.RFC3339))
+	}
+	return list
+}
+
+// checkStoreLookups checks the keyed lookups of a store holding the lookup records
+func checkStoreLookups(t *testing.T, store StateStore, now time.Time) {
+	t.Helper()
+	all := lookupRecords(now)
+
+	got, err := store.Get("https://example.com/a", "https://example.com/c", "https://example.com/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sentList([]sentRecord{all[0], all[2], all[3], all[4]}); !reflect.DeepEqual(sentList(got), want) {
+		t.Errorf("Get = %v, want %v", sentList(got), want)
+	}
+	got, err = store.Get()
+	if err != nil || len(got) != 0 {
+		t.Errorf("Get without URLs = %v, %v", sentList(got), err)
+	}
+
+	got, err = store.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sentList([]sentRecord{all[1], all[2], all[3], all[4]}); !reflect.DeepEqual(sentList(got), want) {
+		t.Errorf("Latest = %v, want %v", sentList(got), want)
+	}
+
+	got, err = store.SentSince(now.Add(-90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sentList(all[2:]); !reflect.DeepEqual(sentList(got), want) {
+		t.Errorf("SentSince = %v, want %v", sentList(got), want)
+	}
+
+	total, _, err := store.SentToday()
+	if err != nil || total != 4 {
+		t.Errorf("SentToday = %d, %v, want 4", total, err)
+	}
+}
+
+// markAll records sent records in a store
+func markAll(t *testing.T, store StateStore, records []sentRecord) {
+	t.Helper()
+	for _, rec := range records {
+		err := store.MarkSent(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreLookups(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	backends := map[string]func(t *testing.T) StateStore{
+		"memory": func(t *testing.T) StateStore { return newMemoryStore() },
+		"csv": func(t *testing.T) StateStore {
+			return csvStore{sentFile: filepath.Join(t.TempDir(), "sent.csv")}
+		},
+		"sqlite": useSQLiteStore,
+		"bolt":   useBoltStore,
+	}
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			useFakeClock(t, now)
+			store := newStore(t)
+			markAll(t, store, lookupRecords(now))
+			checkStoreLookups(t, store, now)
+		})
+	}
+}
+
+func TestCsvStoreLookupsWithArchive(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+	store := csvStore{sentFile: filepath.Join(t.TempDir(), "sent.csv")}
+	markAll(t, store, lookupRecords(now))
+	prevRetention := stateRetention
+	stateRetention = "24h"
+	t.Cleanup(func() { stateRetention = prevRetention })
+	archived, err := archiveState(store.sentFile)
+	if err != nil || archived != 1 {
+		t.Fatalf("archiveState = %d, %v, want 1 archived record", archived, err)
+	}
+	checkStoreLookups(t, store, now)
+
+	// Lookups of recent records don't read the segments of earlier months
+	paths, err := archivedSegments(store.sentFile)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("archivedSegments = %v, %v, want one segment", paths, err)
+	}
+	err = os.WriteFile(paths[0], []byte("not gzip"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SentSince(now.Add(-time.Hour)); err != nil {
+		t.Errorf("SentSince read an earlier segment: %v", err)
+	}
+	if _, err := store.Latest(); err != nil {
+		t.Errorf("Latest read the segments instead of the archive index: %v", err)
+	}
+	if _, err := store.Get("https://example.com/a"); err == nil {
+		t.Errorf("Get didn't read the archived history")
+	}
+}
+
+// useSQLiteStore makes an SQLite database in a temporary directory the state backend
+func useSQLiteStore(t *testing.T) StateStore {
+	prevBackend, prevFile := stateBackend, sqliteFile
+	stateBackend, sqliteFile = "sqlite", filepath.Join(t.TempDir(), "state.db")
+	sqlOnce, sqlDB, sqlErr = sync.Once{}, nil, nil
+	t.Cleanup(func() {
+		if sqlDB != nil {
+			sqlDB.Close()
+		}
+		stateBackend, sqliteFile = prevBackend, prevFile
+		sqlOnce, sqlDB, sqlErr = sync.Once{}, nil, nil
+	})
+	return sqlStore{}
+}
+
+// useBoltStore makes a bolt file in a temporary directory the state backend
+func useBoltStore(t *testing.T) StateStore {
+	prevFile := boltFile
+	boltFile = filepath.Join(t.TempDir(), "state.bolt")
+	boltOnce, boltDB, boltErr = sync.Once{}, nil, nil
+	t.Cleanup(func() {
+		if boltDB != nil {
+			boltDB.Close()
+		}
+		boltFile = prevFile
+		boltOnce, boltDB, boltErr = sync.Once{}, nil, nil
+	})
+	return boltStore{}
+}
+
+func TestBoltStoreIndexesOlderDatabases(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+	store := useBoltStore(t)
+
+	// A database of an older version only has the sent and latest buckets
+	db, err := bolt.Open(boltFile, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		sent, err := tx.CreateBucket(boltSentBucket)
+		if err != nil {
+			return err
+		}
+		latest, err := tx.CreateBucket(boltLatestBucket)
+		if err != nil {
+			return err
+		}
+		for _, rec := range lookupRecords(now) {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if _, err := boltAppend(sent, data); err != nil {
+				return err
+			}
+			if err := latest.Put([]byte(sentKey(rec.Url, rec.Type)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStoreLookups(t, store, now)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+// stateSyncUrl is where the CSV state files are kept between runs, e.g. gs://bucket/indexapi
+// or s3://bucket/indexapi, so runners without a persistent disk keep their state
+var stateSyncUrl = os.Getenv("STATE_SYNC_URL")
+
+// errStateChanged is returned when a state object was written by someone else since it was loaded
+var errStateChanged = errors.New("the state was changed by another run since it was loaded")
+
+// objectStore keeps state files as objects. Every object has a version, which an upload
+// must match, so concurrent runs can't overwrite each other's state.
+type objectStore interface {
+	// download returns the content and version of an object, os.ErrNotExist if there is none
+	download(name string) ([]byte, string, error)
+	// upload replaces an object if its version still matches, "" if it must not exist yet,
+	// and returns the new version
+	upload(name string, data []byte, version string) (string, error)
+	// list returns the names of the objects starting with prefix
+	list(prefix string) ([]string, error)
+}
+
+// syncedFile is a state file kept as an object
+type syncedFile struct {
+	path    string
+	object  string
+	version string
+	// sum is the checksum of the content last loaded or saved, it is only uploaded if changed
+	sum [sha256.Size]byte
+}
+
+// stateSync loads the state files at start and saves them back
+type stateSync struct {
+	store objectStore
+	url   string
+	// archiveDir holds the segments archived with STATE_RETENTION, which are kept under
+	// archivePrefix, as archived URLs still count as sent
+	archiveDir    string
+	archivePrefix string
+
+	mu    sync.Mutex
+	files []*syncedFile
+}
+
+// stateSyncer syncs the state files if STATE_SYNC_URL is set
+var stateSyncer *stateSync
+
+// newStateSync creates the sync of the CSV state files to STATE_SYNC_URL
+func newStateSync() (*stateSync, error) {
+	if _, ok := stateStore.(csvStore); !ok {
+		return nil, fmt.Errorf("STATE_SYNC_URL keeps CSV state files, it can't be used with STATE_BACKEND=%s", stateBackend)
+	}
+	u, err := url.Parse(stateSyncUrl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing STATE_SYNC_URL: %w", err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s := &stateSync{url: stateSyncUrl}
+	if u.Host == "" {
+		return nil, fmt.Errorf("STATE_SYNC_URL has no bucket")
+	}
+	switch u.Scheme {
+	case "gs":
+		s.store, err = newGCSObjectStore(u.Host)
+	case "s3":
+		s.store, err = newS3ObjectStore(u.Host)
+	default:
+		return nil, fmt.Errorf("STATE_SYNC_URL must be a gs:// or s3:// URL")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.archiveDir = stateArchivePath(sentFile)
+	s.archivePrefix = prefix + "state-archive/"
+
+	seen := map[string]bool{}
+	for _, path := range []string{sentFile, indexedFile, deadLetterFilePath(sentFile), retryQueueFilePath(sentFile)} {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		s.files = append(s.files, &syncedFile{path: path, object: prefix + filepath.Base(path)})
+	}
+	return s, nil
+}
+
+// load replaces the local state files with their objects. Files without an object are kept
+// and uploaded by the next save.
+func (s *stateSync) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments, err := s.store.list(s.archivePrefix + stateSegmentPrefix(sentFile))
+	if err != nil {
+		return fmt.Errorf("listing archived segments: %w", err)
+	}
+	for _, name := range segments {
+		s.track(filepath.Join(s.archiveDir, path.Base(name)), name)
+	}
+
+	for _, f := range s.files {
+		data, version, err := s.store.download(f.object)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("downloading %s: %w", f.object, err)
+		}
+		err = os.MkdirAll(filepath.Dir(f.path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(f.path, data, 0644)
+		if err != nil {
+			return err
+		}
+		f.version = version
+		f.sum = sha256.Sum256(data)
+	}
+	logInfo("Loaded the state from %s", s.url)
+	return nil
+}
+
+// save uploads the state files which changed since they were loaded or last saved, and
+// the archived segments and their index which were added or changed
+func (s *stateSync) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.archiveDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	prefix := stateSegmentPrefix(sentFile)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, prefix) && (strings.HasSuffix(name, ".csv.gz") || name == filepath.Base(archiveIndexPath(sentFile))) {
+			s.track(filepath.Join(s.archiveDir, name), s.archivePrefix+name)
+		}
+	}
+
+	for _, f := range s.files {
+		data, err := os.ReadFile(f.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if sum == f.sum {
+			continue
+		}
+		version, err := s.store.upload(f.object, data, f.version)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", f.object, err)
+		}
+		f.version = version
+		f.sum = sum
+	}
+	return nil
+}
+
+// track adds a file to the synced ones, unless it is synced already
+func (s *stateSync) track(filePath, object string) {
+	for _, f := range s.files {
+		if f.object == object {
+			return
+		}
+	}
+	s.files = append(s.files, &syncedFile{path: filePath, object: object})
+}
+
+// saveState saves the state files if they are synced, e.g. after every run
+func saveState() error {
+	if stateSyncer == nil {
+		return nil
+	}
+	return stateSyncer.save()
+}
+
+// checkpointState saves the state after the URLs of a run were submitted. Failed runs exit
+// before the state would be saved on exit, so it is saved whether the run failed or not.
+func checkpointState() {
+	err := saveState()
+	if err != nil {
+		logError("Error saving the state: %v", err)
+	}
+}
+
+// gcsObjectStore keeps objects in a Cloud Storage bucket, their generation is the version
+type gcsObjectStore struct {
+	service *storage.Service
+	bucket  string
+}
+
+// newGCSObjectStore creates the store of a bucket with the credentials of the indexing client
+func newGCSObjectStore(bucket string) (*gcsObjectStore, error) {
+	opt, err := credentialsOption(storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAuthenticatedClient(nil, opt, option.WithScopes(storage.DevstorageReadWriteScope))
+	if err != nil {
+		return nil, err
+	}
+	service, err := storage.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObjectStore{service: service, bucket: bucket}, nil
+}
+
+func (g *gcsObjectStore) download(name string) ([]byte, string, error) {
+	res, err := g.service.Objects.Get(g.bucket, name).Download()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, "", os.ErrNotExist
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), res.Header.Get("X-Goog-Generation"), nil
+}
+
+func (g *gcsObjectStore) upload(name string, data []byte, version string) (string, error) {
+	// Generation 0 only matches an object which doesn't exist
+	generation := int64(0)
+	if version != "" {
+		var err error
+		generation, err = strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid generation %q", version)
+		}
+	}
+	obj, err := g.service.Objects.Insert(g.bucket, &storage.Object{Name: name}).
+		Media(bytes.NewReader(data)).IfGenerationMatch(generation).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return "", errStateChanged
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(obj.Generation, 10), nil
+}
+
+func (g *gcsObjectStore) list(prefix string) ([]string, error) {
+	var names []string
+	err := g.service.Objects.List(g.bucket).Prefix(prefix).Pages(context.Background(), func(objects *storage.Objects) error {
+		for _, obj := range objects.Items {
+			names = append(names, obj.Name)
+		}
+		return nil
+	})
+	return names, err
+}
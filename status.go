@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var controlSocket = os.Getenv("CONTROL_SOCKET")
+
+// maxStatusErrors is the number of recent errors kept for the status dump
+const maxStatusErrors = 5
+
+// runStatus holds the live status of the process for the status dump
+var runStatus = &status{started: time.Now()}
+
+// status describes what a running process is doing
+type status struct {
+	mu        sync.Mutex
+	started   time.Time
+	runID     string
+	sentToday int
+	recent    []time.Time
+	next      string
+	nextAt    time.Time
+	errors    []statusError
+	// runs are the statuses of runs which keep their own, like the reconciles of the operator
+	runs map[string]*status
+}
+
+type statusError struct {
+	time    time.Time
+	url     string
+	message string
+}
+
+// setRun records the ID of the current run and the URLs sent today before it started
+func (s *status) setRun(runID string, sentToday int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runID = runID
+	s.sentToday = sentToday
+}
+
+// setNext records the next scheduled action, at is zero if it happens right away
+func (s *status) setNext(action string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = action
+	s.nextAt = at
+}
+
+// recordSent counts a sent URL towards today's total and the current rate
+func (s *status) recordSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sentToday++
+	s.recent = append(s.recent, now)
+	for len(s.recent) > 0 && now.Sub(s.recent[0]) > time.Minute {
+		s.recent = s.recent[1:]
+	}
+}
+
+// recordError keeps the last errors
+func (s *status) recordError(url string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, statusError{time: time.Now(), url: url, message: err.Error()})
+	if len(s.errors) > maxStatusErrors {
+		s.errors = s.errors[len(s.errors)-maxStatusErrors:]
+	}
+}
+
+// track adds the status of a run to the dump until untrack is called
+func (s *status) track(name string, run *status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.runs == nil {
+		s.runs = map[string]*status{}
+	}
+	s.runs[name] = run
+}
+
+// untrack removes the status of a run from the dump
+func (s *status) untrack(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, name)
+}
+
+// dump writes a human readable status report
+func (s *status) dump(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	fmt.Fprintf(w, "Process:      pid %d, up %s\n", os.Getpid(), now.Sub(s.started).Round(time.Second))
+	if s.runID != "" {
+		fmt.Fprintf(w, "Run:          %s\n", s.runID)
+	}
+	fmt.Fprintf(w, "Queue depth:  %d\n", runMetrics.pending.Load())
+	fmt.Fprintf(w, "Sent today:   %d (quota remaining %d)\n", s.sentToday, runMetrics.quotaRemaining.Load())
+	fmt.Fprintf(w, "This run:     %d attempted, %d sent, %d failed\n",
+		runMetrics.attempted.Load(), runMetrics.sent.Load(), runMetrics.failed.Load())
+	s.dumpActivity(w, now)
+
+	for _, name := range sortedKeys(s.runs) {
+		run := s.runs[name]
+		run.mu.Lock()
+		fmt.Fprintf(w, "\nResource:     %s\n", name)
+		fmt.Fprintf(w, "Run:          %s\n", run.runID)
+		fmt.Fprintf(w, "Sent today:   %d\n", run.sentToday)
+		run.dumpActivity(w, now)
+		run.mu.Unlock()
+	}
+}
+
+// dumpActivity writes the rate, the next action and the last errors, the caller holds s.mu
+func (s *status) dumpActivity(w io.Writer, now time.Time) {
+	rate := 0
+	for _, t := range s.recent {
+		if now.Sub(t) <= time.Minute {
+			rate++
+		}
+	}
+	fmt.Fprintf(w, "Current rate: %d per minute\n", rate)
+	next := s.next
+	if next == "" {
+		next = "idle"
+	}
+	if !s.nextAt.IsZero() {
+		next += fmt.Sprintf(" at %s (in %s)", s.nextAt.Format(time.RFC3339), s.nextAt.Sub(now).Round(time.Second))
+	}
+	fmt.Fprintf(w, "Next action:  %s\n", next)
+	if len(s.errors) == 0 {
+		fmt.Fprintf(w, "Last errors:  none\n")
+		return
+	}
+	fmt.Fprintf(w, "Last errors:\n")
+	for _, e := range s.errors {
+		fmt.Fprintf(w, "  %s %s: %s\n", e.time.Format(time.RFC3339), e.url, e.message)
+	}
+}
+
+// startControlSocket serves the status on a local unix socket if CONTROL_SOCKET is set,
+// and over mutual TLS on a TCP address if CONTROL_ADDR is set.
+// Connections send one command per line, "status" or "tail".
+func startControlSocket() (func(), error) {
+	var listeners []net.Listener
+	stop := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	if controlSocket != "" {
+		// A socket file left behind by a crashed process would make Listen fail
+		if conn, err := net.Dial("unix", controlSocket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another process", controlSocket)
+		}
+		os.Remove(controlSocket)
+
+		listener, err := listenControlSocket(controlSocket)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if controlAddr != "" {
+		config, err := controlTLSConfig(true)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listener, err := tls.Listen("tcp", controlAddr, config)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		logInfo("Serving the control endpoint on %s with mutual TLS", listener.Addr())
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go serveControl(conn)
+			}
+		}(listener)
+	}
+	return stop, nil
+}
+
+// dialControl connects to the control endpoint of a running process, preferring the unix socket
+func dialControl() (net.Conn, error) {
+	if controlSocket != "" {
+		return net.Dial("unix", controlSocket)
+	}
+	if controlAddr == "" {
+		return nil, fmt.Errorf("CONTROL_SOCKET or CONTROL_ADDR must be set")
+	}
+	config, err := controlTLSConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", controlAddr, config)
+}
+
+// serveControl answers the commands of a control socket connection
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		switch command := strings.TrimSpace(scanner.Text()); command {
+		case "":
+			continue
+		case "status":
+			runStatus.dump(conn)
+		case "tail":
+			streamEvents(conn)
+		default:
+			fmt.Fprintf(conn, "unknown command %q\n", command)
+		}
+		return
+	}
+}
+
+// runInspect prints the status of a running process through its control socket
+func runInspect(args []string) {
+	conn, err := dialControl()
+	if err != nil {
+		log.Fatal("Error connecting to the control socket:", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, "status")
+	io.Copy(os.Stdout, conn)
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/indexing/v3"
+)
+
+// rateLimits describes the API quota to respect while submitting
+type rateLimits struct {
+	perDay    int
+	perMinute int
+	// waitForNextDay sleeps for 24 hours when the daily quota is used up instead of stopping
+	waitForNextDay bool
+	// planned notifications come from a plan, which is sent as it was reviewed, so their
+	// metadata isn't checked
+	planned bool
+	// concurrency is the number of notifications published at once
+	concurrency int
+	// key identifies the service account key whose quota is used
+	key string
+	// accounts are the service accounts of CREDENTIALS_POOL, whose quotas are used in turn,
+	// and of SITE_CREDENTIALS
+	accounts []quotaAccount
+}
+
+// notification is a single URL notification to send to Google Index API
+type notification struct {
+	Url     string
+	Type    string
+	Source  string
+	Lastmod string
+	// Priority is the sitemap priority of the URL, 0.5 if it has none
+	Priority float64
+	// Reason explains why the notification is sent
+	Reason string
+	// Locale is the language section of the site the URL belongs to
+	Locale string
+	// Images and Videos count the image and video sitemap entries of the URL
+	Images int
+	Videos int
+}
+
+// pendingNotifications returns the notifications of the sitemap URLs which need one, see pendingNotification
+func pendingNotifications(urls []Url, source string, indexedUrls map[string]struct{}, lastSent map[string]time.Time) []notification {
+	var notifications []notification
+	seen := map[string]struct{}{}
+	for _, url := range urls {
+		if contains(seen, url.Loc) {
+			continue
+		}
+		n, ok := pendingNotification(url, source, indexedUrls, lastSent)
+		if !ok {
+			continue
+		}
+		seen[url.Loc] = struct{}{}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+// pendingNotification returns a URL_UPDATED notification for a sitemap URL which is neither indexed nor sent yet,
+// is due for resubmission by its changefreq or came back after being deleted, or a URL_DELETED notification
+// for a URL the input marks as deleted which wasn't deleted yet. It returns false if the URL needs none.
+func pendingNotification(url Url, source string, indexedUrls map[string]struct{}, lastSent map[string]time.Time) (notification, bool) {
+	updatedAt, updated := lastSent[sentKey(url.Loc, "URL_UPDATED")]
+	deleted := isDeleted(lastSent, url.Loc)
+	n := notification{Url: url.Loc, Type: "URL_UPDATED", Source: source, Lastmod: url.Lastmod, Priority: parsePriority(url.Priority),
+		Images: url.imageCount(), Videos: url.videoCount()}
+	if url.Source != "" {
+		n.Source = url.Source
+	}
+	if url.Type == "URL_DELETED" {
+		if deleted {
+			return n, false
+		}
+		n.Type = url.Type
+		n.Reason = "marked as deleted in the input, not deleted yet"
+	} else if updated && !deleted && resubmitDue(url.Changefreq, updatedAt) {
+		n.Reason = "changefreq " + url.Changefreq + ", last sent " + updatedAt.Format(time.RFC3339)
+	} else if deleted {
+		n.Reason = "back in sitemap after being deleted"
+	} else {
+		if contains(indexedUrls, url.Loc) || updated {
+			return n, false
+		}
+		n.Reason = "in sitemap, not indexed and not sent yet"
+	}
+	return n, true
+}
+
+// runStats counts the outcomes of a run
+type runStats struct {
+	Attempted int
+	Sent      int
+	Failed    int
+	// Locales counts the outcomes per locale
+	Locales map[string]*localeStats
+}
+
+// localeStats counts the outcomes of a run for one locale
+type localeStats struct {
+	Sent   int
+	Failed int
+}
+
+// locale returns the stats of a locale, creating them on first use
+func (s *runStats) locale(name string) *localeStats {
+	if s.Locales == nil {
+		s.Locales = map[string]*localeStats{}
+	}
+	if s.Locales[name] == nil {
+		s.Locales[name] = &localeStats{}
+	}
+	return s.Locales[name]
+}
+
+// submitUrls sends notifications to Google Index API and appends the sent URLs
+// with the run ID to sentFile
+func submitUrls(ctx context.Context, client *indexingClient, notifications []notification, sentFile, runID string, limits rateLimits) (runStats, error) {
+	var stats runStats
+	state := runStateOf(ctx)
+	// The store skips the notifications sent within the dedup window
+	store, err := newDedupStore(sentFile)
+	if err != nil {
+		return stats, err
+	}
+	policy, err := loadRetryPolicy()
+	if err != nil {
+		return stats, err
+	}
+	breaker, err := newCircuitBreaker()
+	if err != nil {
+		return stats, err
+	}
+	streak, err := newFailureStreak()
+	if err != nil {
+		return stats, err
+	}
+	slo, err := newSloMonitor()
+	if err != nil {
+		return stats, err
+	}
+	err = slo.checkStall(sentFile, len(notifications))
+	if err != nil {
+		return stats, fmt.Errorf("checking for stalled submissions: %w", err)
+	}
+
+	// Notifications from plans and the operator don't have a locale yet
+	locales, err := newLocaleDetector(nil)
+	if err != nil {
+		return stats, err
+	}
+
+	batchSize, err := loadBatchSize(limits.perMinute)
+	if err != nil {
+		return stats, err
+	}
+	publishLimiter := newLimiter(limits.perMinute, limits.concurrency)
+	state.log.info("Publish rate: %d per minute, concurrency: %d, batch size: %d", limits.perMinute, cap(publishLimiter.slots), batchSize)
+
+	pool, todayAlreadySent, err := newAccountPool(client, limits, sentFile)
+	if err != nil {
+		return stats, fmt.Errorf("reading today's sent URLs: %w", err)
+	}
+
+	// Correct day limit
+	todayLimit := pool.remaining()
+
+	state.log.info("Today's limit: %d", todayLimit)
+	if len(pool.accounts) > 1 {
+		for _, account := range pool.accounts {
+			sites := ""
+			if len(account.hosts) > 0 {
+				sites = " (" + strings.Join(account.hosts, ", ") + ")"
+			}
+			state.log.info("Today's limit of %s%s: %d", account.key, sites, max(account.remaining, 0))
+		}
+	}
+
+	// due checks if a notification is out of the dedup window
+	due := func(n notification) bool {
+		_, ok := store.due(n)
+		return ok
+	}
+
+	// Metadata is only checked for the notifications which fit in today's quota, the ones
+	// after are checked when the next day's quota is used
+	if !limits.planned {
+		notifications, err = skipNotified(ctx, client, notifications, sentFile, todayLimit, due)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	requests := len(notifications)
+	if requests > todayLimit && !limits.waitForNextDay {
+		requests = todayLimit
+	}
+	retries := newRetryLimiter(policy, requests)
+	state.log.info("Retry budget: %s", retries)
+	state.status.setRun(runID, todayAlreadySent)
+
+	runMetrics.pending.Store(int64(len(notifications)))
+	runMetrics.quotaRemaining.Store(int64(todayLimit))
+
+	// mu guards stats, the sent file and abortErr while notifications are published concurrently
+	var mu sync.Mutex
+	var abortErr error
+
+	// finish records the outcome of publishing a notification
+	finish := func(n notification, account *accountQuota, page pageMetadata, res *indexing.PublishUrlNotificationResponse, responseTime time.Duration, category errorCategory, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			stats.Failed++
+			stats.locale(n.Locale).Failed++
+			runMetrics.failed.Add(1)
+			state.log.url(severityError, n.Url, "Error sending URL to Index API (%s): %v", category, err)
+			state.status.recordError(n.Url, err)
+			publishEvent("failed", n, err)
+
+			if streakErr := streak.record(category, err); streakErr != nil && abortErr == nil {
+				abortErr = streakErr
+			}
+			switch {
+			case category == errAuth:
+				abortErr = fmt.Errorf("aborting run, the credentials were rejected: %w", err)
+			case category.permanent():
+				dlErr := store.MarkFailed(queueDeadLetter, failure(n, category, runID, err))
+				if dlErr != nil {
+					state.log.url(severityError, n.Url, "Error appending URL to the dead letter file: %v", dlErr)
+				}
+			default:
+				rqErr := store.MarkFailed(queueRetry, failure(n, category, runID, err))
+				if rqErr != nil {
+					state.log.url(severityError, n.Url, "Error appending URL to the retry queue: %v", rqErr)
+				}
+			}
+			return
+		}
+
+		// If status is not 200, log the error
+		if res.HTTPStatusCode != 200 {
+			statusErr := &googleapi.Error{Code: res.HTTPStatusCode, Message: fmt.Sprintf("status code %d", res.HTTPStatusCode)}
+			if streakErr := streak.record(classifyError(statusErr), statusErr); streakErr != nil && abortErr == nil {
+				abortErr = streakErr
+			}
+			stats.Failed++
+			stats.locale(n.Locale).Failed++
+			runMetrics.failed.Add(1)
+			state.log.url(severityError, n.Url, "Status code: %d", res.HTTPStatusCode)
+			state.status.recordError(n.Url, statusErr)
+			publishEvent("failed", n, statusErr)
+			return
+		}
+		streak.record("", nil)
+		stats.Sent++
+		stats.locale(n.Locale).Sent++
+		runMetrics.sent.Add(1)
+		state.status.recordSent()
+		publishEvent("sent", n, nil)
+
+		// Append the sent URL to sent.csv
+		latestUpdate, latestRemove := notifyTimes(res)
+		notifyTime := latestUpdate
+		if n.Type == "URL_DELETED" {
+			notifyTime = latestRemove
+		}
+		err = store.MarkSent(sentRecord{
+			Url:          n.Url,
+			Time:         clock.Now(),
+			RunID:        runID,
+			Type:         n.Type,
+			Source:       n.Source,
+			Lastmod:      n.Lastmod,
+			Status:       res.HTTPStatusCode,
+			ResponseTime: responseTime,
+			Title:        page.Title,
+			Canonical:    page.Canonical,
+			Published:    page.Published,
+			H1:           page.H1,
+			Locale:       n.Locale,
+			Key:          account.key,
+			Images:       n.Images,
+			Videos:       n.Videos,
+			NotifyTime:   notifyTime,
+			LatestUpdate: latestUpdate,
+			LatestRemove: latestRemove,
+		})
+		if err != nil {
+			state.log.url(severityError, n.Url, "Error recording the sent URL: %v", err)
+		}
+	}
+
+	// publish sends a batch of notifications in one request, the notifications which fail
+	// with a retryable error are sent again together
+	publish := func(batch []notification, account *accountQuota) {
+		pages := make([]pageMetadata, len(batch))
+		if preflight == "true" {
+			for i, n := range batch {
+				if n.Type != "URL_UPDATED" {
+					continue
+				}
+				page, err := preflightPage(n.Url)
+				if err != nil {
+					state.log.url(severityWarning, n.Url, "Error fetching %s during preflight: %v", n.Url, err)
+				} else if page.Status != http.StatusOK {
+					state.log.url(severityWarning, n.Url, "Page %s responds with %d", n.Url, page.Status)
+				}
+				pages[i] = page
+			}
+		}
+
+		attempts := make([]int, len(batch))
+		pending := make([]int, len(batch))
+		for i := range pending {
+			pending[i] = i
+		}
+		for len(pending) > 0 {
+			// An interrupted wait makes the publish below fail without another retry
+			breaker.wait(ctx)
+			publishLimiter.waitN(ctx, len(pending))
+			items := make([]indexing.UrlNotification, len(pending))
+			for j, i := range pending {
+				items[j] = indexing.UrlNotification{Type: batch[i].Type, Url: batch[i].Url}
+			}
+			start := time.Now()
+			outcomes, batchErr := publishBatch(ctx, account.client, items)
+			responseTime := time.Since(start)
+			if batchErr != nil {
+				// The whole request failed, which counts as a single failure for the breaker
+				breaker.record(batchErr)
+				outcomes = make([]publishOutcome, len(items))
+				for j := range outcomes {
+					outcomes[j].err = batchErr
+				}
+			}
+
+			var retry []int
+			var delay time.Duration
+			for j, i := range pending {
+				n, outcome := batch[i], outcomes[j]
+				if batchErr == nil {
+					breaker.record(outcome.err)
+				}
+				if outcome.err == nil {
+					publishLimiter.restore()
+					slo.record(true)
+					finish(n, account, pages[i], outcome.res, responseTime, "", nil)
+					continue
+				}
+
+				category := classifyError(outcome.err)
+				mu.Lock()
+				aborted := abortErr != nil
+				mu.Unlock()
+				if (category != errRetryable && category != errQuota) || attempts[i] >= policy.maxRetries || ctx.Err() != nil || aborted || !retries.take() {
+					slo.record(false)
+					finish(n, account, pages[i], nil, responseTime, category, outcome.err)
+					continue
+				}
+				retryDelay := policy.delay(category, attempts[i])
+				if wait, ok := retryAfter(outcome.err); ok {
+					retryDelay = wait
+				}
+				attempts[i]++
+				if breaker.isOpen() {
+					// Failed probes count towards aborting the run, so an outage can't keep
+					// the run probing until the retries are used up
+					mu.Lock()
+					if streakErr := streak.record(category, outcome.err); streakErr != nil && abortErr == nil {
+						abortErr = streakErr
+					}
+					mu.Unlock()
+				}
+				if category == errQuota {
+					// Quota errors pause every publish, not only the retries of this batch
+					publishLimiter.throttle(retryDelay)
+					state.status.setNext("continue after the quota pause", clock.Now().Add(retryDelay))
+				} else if retryDelay > delay {
+					delay = retryDelay
+				}
+				state.status.recordError(n.Url, outcome.err)
+				publishEvent("retry", n, outcome.err)
+				state.log.url(severityWarning, n.Url, "Error sending URL to Index API (%s), retrying in %s: %v", category, retryDelay.Round(time.Millisecond), outcome.err)
+				retry = append(retry, i)
+			}
+			pending = retry
+			if len(pending) > 0 && delay > 0 {
+				state.status.setNext(fmt.Sprintf("retry %d URLs", len(pending)), clock.Now().Add(delay))
+				// An interrupted sleep makes the pending notifications fail without another retry
+				sleepContext(ctx, delay)
+			}
+		}
+	}
+
+	// Workers publish the batches concurrently, the limiter spaces out their requests
+	// to stay within the per minute rate
+	type publishJob struct {
+		batch   []notification
+		account *accountQuota
+	}
+	jobs := make(chan publishJob)
+	var workers sync.WaitGroup
+	for i := 0; i < cap(publishLimiter.slots); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				// Batches queued before an interrupt are dropped, they weren't attempted
+				if ctx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				stats.Attempted += len(job.batch)
+				mu.Unlock()
+				for _, n := range job.batch {
+					runMetrics.attempted.Add(1)
+					state.log.url(severityInfo, n.Url, "%s %s %s", clock.Now().Format(time.RFC3339), n.Type, n.Url)
+				}
+				state.status.setNext(fmt.Sprintf("publish %d URLs", len(job.batch)), time.Time{})
+				publish(job.batch, job.account)
+			}
+		}()
+	}
+
+	// batches are the queued notifications of every account
+	batches := map[*accountQuota][]notification{}
+	// flush hands the queued batch of an account to the next free worker
+	flush := func(account *accountQuota) {
+		batch := batches[account]
+		if len(batch) == 0 {
+			return
+		}
+		delete(batches, account)
+		select {
+		case jobs <- publishJob{batch: batch, account: account}:
+		case <-ctx.Done():
+		}
+	}
+	flushAll := func() {
+		for _, account := range pool.accounts {
+			flush(account)
+		}
+	}
+	// limitReached holds the accounts whose used up quota was logged, nil for the pooled ones
+	limitReached := map[*accountQuota]bool{}
+
+	// Send URLs to Google Index API
+	for i := 0; i < len(notifications); i++ {
+		n := notifications[i]
+		if n.Locale == "" {
+			n.Locale = locales.detect(n.Url)
+		}
+		mu.Lock()
+		aborted := abortErr != nil
+		mu.Unlock()
+		if aborted || ctx.Err() != nil {
+			clear(batches)
+			break
+		}
+		if last, ok := store.due(n); !ok {
+			runMetrics.pending.Add(-1)
+			state.log.url(severityInfo, n.Url, "Skipping %s %s, already sent at %s", n.Type, n.Url, last.Format(time.RFC3339))
+			publishEvent("skipped", n, nil)
+			continue
+		}
+
+		account := pool.forUrl(n.Url)
+		if account == nil || account.remaining <= 0 {
+			if pool.remaining() > 0 {
+				// Other accounts have quota left for the URLs of other sites
+				if !limitReached[account] {
+					limitReached[account] = true
+					if account == nil {
+						state.log.info("Today's limit reached, skipping the URLs of sites without credentials of their own")
+					} else {
+						state.log.info("Today's limit of %s reached, skipping the URLs of %s", account.key, strings.Join(account.hosts, ", "))
+					}
+				}
+				continue
+			}
+			flushAll()
+			if !limits.waitForNextDay {
+				state.log.info("Today's limit reached")
+				break
+			}
+			// Sleep for a day
+			state.log.info("Sleeping for a 24 hours...")
+			state.status.setNext("continue with the next day's quota", clock.Now().Add(24*time.Hour))
+			if sleepContext(ctx, 24*time.Hour) != nil {
+				break
+			}
+			pool.reset(limits.perDay)
+			clear(limitReached)
+			rest, err := skipNotified(ctx, client, notifications[i:], sentFile, pool.remaining(), due)
+			if err != nil {
+				state.log.error("Error checking metadata: %v", err)
+			} else if len(rest) < len(notifications[i:]) {
+				runMetrics.pending.Add(-int64(len(notifications[i:]) - len(rest)))
+				notifications = append(notifications[:i:i], rest...)
+				// The notification may have been skipped, start over with the next one left
+				i--
+				continue
+			}
+			account = pool.forUrl(n.Url)
+			if account == nil || account.remaining <= 0 {
+				break
+			}
+		}
+		account.remaining--
+		runMetrics.pending.Add(-1)
+		runMetrics.quotaRemaining.Store(int64(pool.remaining()))
+
+		batches[account] = append(batches[account], n)
+		if len(batches[account]) == batchSize {
+			flush(account)
+			pool.rotate(account)
+		}
+	}
+	flushAll()
+	close(jobs)
+	workers.Wait()
+	state.status.setNext("", time.Time{})
+	if abortErr == nil && ctx.Err() != nil {
+		return stats, fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	return stats, abortErr
+}
+
+// notifyTimes returns the notify times of the latest URL_UPDATED and URL_DELETED notifications
+// in the metadata Google returns for a published URL
+func notifyTimes(res *indexing.PublishUrlNotificationResponse) (latestUpdate, latestRemove string) {
+	meta := res.UrlNotificationMetadata
+	if meta == nil {
+		return "", ""
+	}
+	if meta.LatestUpdate != nil {
+		latestUpdate = meta.LatestUpdate.NotifyTime
+	}
+	if meta.LatestRemove != nil {
+		latestRemove = meta.LatestRemove.NotifyTime
+	}
+	return latestUpdate, latestRemove
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+)
+
+// runSync fetches what Google last received for every sitemap URL with getMetadata
+// and stores it in the metadata file. Metadata calls have their own, much larger
+// quota, so they use METADATA_RATE_LIMIT_PER_MINUTE and METADATA_CONCURRENCY.
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fromSent := fs.Bool("sent", false, "Sync the URLs of the sent file instead of the sitemap")
+	force := fs.Bool("force", false, "Call getMetadata even for URLs fetched within METADATA_CACHE_TTL")
+	fs.Parse(args)
+
+	client, err := newIndexingService()
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+	ctx := interruptContext()
+
+	perMinute, err := parseIntDefault(metadataRateLimit, 180)
+	if err != nil {
+		log.Fatal("Error converting metadata rate limit per minute to integer:", err)
+		return
+	}
+	concurrency, err := parseIntDefault(metadataConcurrency, 10)
+	if err != nil {
+		log.Fatal("Error converting metadata concurrency to integer:", err)
+		return
+	}
+
+	var urls []string
+	if *fromSent {
+		sent, err := readSent(sentFile)
+		if err != nil {
+			log.Fatal("Error reading sent URLs:", err)
+			return
+		}
+		urls = sortedKeys(sent)
+	} else {
+		sitemapUrls, err := parseSitemap(sitemapFile)
+		if err != nil {
+			log.Fatal("Error parsing sitemap:", err)
+			return
+		}
+		seen := map[string]struct{}{}
+		for _, u := range sitemapUrls {
+			if !contains(seen, u.Loc) {
+				seen[u.Loc] = struct{}{}
+				urls = append(urls, u.Loc)
+			}
+		}
+	}
+
+	cache, err := newMetadataCache(sentFile)
+	if err != nil {
+		log.Fatal("Error reading metadata file:", err)
+		return
+	}
+
+	logInfo("Syncing metadata of %d URLs, rate: %d per minute, concurrency: %d", len(urls), perMinute, concurrency)
+	metadataLimiter := newLimiter(perMinute, concurrency)
+	var mu sync.Mutex
+	failed := 0
+	for _, url := range urls {
+		metadataLimiter.acquire()
+		go func(url string) {
+			defer metadataLimiter.release()
+			_, err := cache.lookup(ctx, client, metadataLimiter, url, *force)
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				logURL(severityError, url, "Error getting metadata of %s: %v", url, err)
+			}
+		}(url)
+	}
+	metadataLimiter.drain()
+
+	err = cache.save()
+	if err != nil {
+		log.Fatal("Error writing metadata file:", err)
+		return
+	}
+	logInfo("Finish. Synced metadata of %d URLs, %d from cache, %d failed", len(urls)-failed, cache.hits, failed)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// submissionEvent is a submission outcome streamed to tail clients
+type submissionEvent struct {
+	Time time.Time `json:"time"`
+	Url  string    `json:"url"`
+	Type string    `json:"type"`
+	// Status is one of sent, failed, retry or skipped
+	Status  string `json:"status"`
+	Site    string `json:"site"`
+	Message string `json:"message,omitempty"`
+}
+
+// eventSubscribers are the channels of connected tail clients
+var eventSubscribers = struct {
+	mu    sync.Mutex
+	chans map[chan submissionEvent]struct{}
+}{chans: map[chan submissionEvent]struct{}{}}
+
+// publishEvent sends an event to all tail clients. Slow clients miss events
+// rather than holding up submissions.
+func publishEvent(status string, n notification, err error) {
+	e := submissionEvent{Time: clock.Now(), Url: n.Url, Type: n.Type, Status: status, Site: logSite}
+	if e.Site == "" {
+		if u, parseErr := url.Parse(n.Url); parseErr == nil {
+			e.Site = u.Hostname()
+		}
+	}
+	if err != nil {
+		e.Message = err.Error()
+	}
+
+	eventSubscribers.mu.Lock()
+	defer eventSubscribers.mu.Unlock()
+	for ch := range eventSubscribers.chans {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// streamEvents writes events as JSON lines to a control connection until the client disconnects
+func streamEvents(conn net.Conn) {
+	ch := make(chan submissionEvent, 100)
+	eventSubscribers.mu.Lock()
+	eventSubscribers.chans[ch] = struct{}{}
+	eventSubscribers.mu.Unlock()
+	defer func() {
+		eventSubscribers.mu.Lock()
+		delete(eventSubscribers.chans, ch)
+		eventSubscribers.mu.Unlock()
+	}()
+
+	// The client never sends anything else, so a read returns when it disconnects
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-ch:
+			if encoder.Encode(e) != nil {
+				return
+			}
+		}
+	}
+}
+
+// runTail attaches to a running process through its control socket and prints submissions as they happen
+func runTail(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	status := fs.String("status", "", "Only show events with this status: sent, failed, retry or skipped")
+	site := fs.String("site", "", "Only show events of this site, the LOG_SITE label or the URL's host")
+	asJSON := fs.Bool("json", false, "Print events as JSON lines")
+	fs.Parse(args)
+
+	conn, err := dialControl()
+	if err != nil {
+		log.Fatal("Error connecting to the control socket:", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "tail")
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var e submissionEvent
+		err := decoder.Decode(&e)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal("Error reading events:", err)
+			return
+		}
+		if (*status != "" && e.Status != *status) || (*site != "" && e.Site != *site) {
+			continue
+		}
+		if *asJSON {
+			json.NewEncoder(os.Stdout).Encode(e)
+			continue
+		}
+		fmt.Printf("%s %-7s %-12s %s %s\n", e.Time.Format(time.RFC3339), e.Status, e.Type, e.Url, e.Message)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Telemetry settings, telemetry is off unless TELEMETRY is set
+var (
+	telemetry    = os.Getenv("TELEMETRY")
+	telemetryURL = os.Getenv("TELEMETRY_URL")
+)
+
+// telemetryFeatures are the settings whose use is reported, by the variable each
+// setting is read into. Only whether a setting is set is sent, never its value.
+var telemetryFeatures = map[string]*string{
+	"ABORT_AFTER_FAILURES":           &abortAfter,
+	"ALERT_ERROR_RATE":               &alertErrorRate,
+	"ALERT_ERROR_WINDOW":             &alertErrorWindow,
+	"ALERT_MIN_REQUESTS":             &alertMinRequests,
+	"ALERT_REPEAT_INTERVAL":          &alertRepeatInterval,
+	"ALERT_STALL":                    &alertStall,
+	"ALERT_WEBHOOK_URLS":             &alertWebhookUrls,
+	"API_CA_BUNDLE":                  &apiCABundle,
+	"API_DEBUG":                      &apiDebug,
+	"API_DIAL_TIMEOUT":               &apiDialTimeout,
+	"API_ENDPOINT":                   &apiEndpoint,
+	"API_HTTP2":                      &apiHTTP2,
+	"API_IDLE_CONN_TIMEOUT":          &apiIdleConnTimeout,
+	"API_KEEP_ALIVE":                 &apiKeepAlive,
+	"API_MAX_IDLE_CONNS":             &apiMaxIdleConns,
+	"API_PROXY":                      &apiProxy,
+	"API_RECORD_DIR":                 &apiRecordDir,
+	"API_REPLAY_DIR":                 &apiReplayDir,
+	"API_TIMEOUT":                    &apiTimeout,
+	"AUTO_DELETE":                    &autoDelete,
+	"BOLT_FILE":                      &boltFile,
+	"BREAKER_COOLDOWN":               &breakerCooldown,
+	"BREAKER_THRESHOLD":              &breakerThreshold,
+	"CANARY_URL":                     &canaryUrl,
+	"CHANGEFREQ_RESUBMIT":            &changefreqResubmit,
+	"CLOUD_LOGGING":                  &cloudLogging,
+	"CLOUD_MONITORING":               &cloudMonitoring,
+	"CONTROL_ADDR":                   &controlAddr,
+	"CONTROL_SOCKET":                 &controlSocket,
+	"CONTROL_TLS_CA":                 &controlTLSCA,
+	"CONTROL_TLS_CERT":               &controlTLSCert,
+	"CONTROL_TLS_KEY":                &controlTLSKey,
+	"CRAWL_DELAY":                    &crawlDelay,
+	"CRAWL_MAX_DEPTH":                &crawlMaxDepth,
+	"CRAWL_MAX_PAGES":                &crawlMaxPages,
+	"CREDENTIALS_POOL":               &credentialsPool,
+	"DATABASE_URL":                   &databaseUrl,
+	"DEAD_LETTER_FILE":               &deadLetterFile,
+	"DECAY_FILE":                     &decayFile,
+	"DECAY_HORIZON":                  &decayHorizon,
+	"DEDUP_WINDOW":                   &dedupWindow,
+	"GOOGLE_APPLICATION_CREDENTIALS": &credentialsFile,
+	"GOOGLE_CLOUD_PROJECT":           &gcpProject,
+	"GOOGLE_CREDENTIALS_JSON":        &credentialsJSON,
+	"HREFLANG_GROUP":                 &hreflangGroup,
+	"IMPERSONATE_DELEGATES":          &impersonateDelegates,
+	"IMPERSONATE_SERVICE_ACCOUNT":    &impersonateServiceAccount,
+	"INDEXED_FILE":                   &indexedFile,
+	"INFLUX_MEASUREMENT":             &influxMeasurement,
+	"INFLUX_TOKEN":                   &influxToken,
+	"INFLUX_URL":                     &influxURL,
+	"LEADER_ELECTION":                &leaderElection,
+	"LEADER_ELECTION_LEASE":          &leaderElectionLease,
+	"LEADER_ELECTION_LEASE_DURATION": &leaderElectionDuration,
+	"LEADER_ELECTION_NAMESPACE":      &leaderElectionNs,
+	"LOCALE_DEFAULT":                 &localeDefault,
+	"LOCALE_PATTERN":                 &localePattern,
+	"LOCALE_QUOTAS":                  &localeQuotas,
+	"LOG_SITE":                       &logSite,
+	"MAX_RETRIES":                    &maxRetries,
+	"METADATA_CACHE_TTL":             &metadataCacheTTL,
+	"METADATA_CONCURRENCY":           &metadataConcurrency,
+	"METADATA_FILE":                  &metadataFile,
+	"METADATA_RATE_LIMIT_PER_MINUTE": &metadataRateLimit,
+	"METADATA_SKIP_WINDOW":           &metadataSkipWindow,
+	"METRICS_PUSH_INTERVAL":          &metricsPushInterval,
+	"MOVED_FILE":                     &movedFile,
+	"OAUTH_CLIENT_FILE":              &oauthClientFile,
+	"OAUTH_TOKEN_FILE":               &oauthTokenFile,
+	"OPERATOR_NAMESPACE":             &operatorNamespace,
+	"OPERATOR_RESYNC_INTERVAL":       &operatorResync,
+	"OPERATOR_STATE_DIR":             &operatorStateDir,
+	"PREFLIGHT":                      &preflight,
+	"PUBLISH_BATCH_SIZE":             &publishBatchSize,
+	"PUBLISH_CONCURRENCY":            &publishConcurrency,
+	"QUEUE_ORDER":                    &queueOrder,
+	"QUOTA_PAUSE":                    &quotaPause,
+	"RATE_LIMIT_PER_DAY":             &rateLimitDay,
+	"RATE_LIMIT_PER_MINUTE":          &rateLimitMinute,
+	"READ_ONLY":                      &readOnly,
+	"REDIS_PREFIX":                   &redisPrefix,
+	"REDIS_URL":                      &redisUrl,
+	"RESUBMIT_CHANGED":               &resubmitChanged,
+	"RETRY_BACKOFF":                  &retryBackoff,
+	"RETRY_BUDGET":                   &retryBudget,
+	"RETRY_DELAY":                    &retryDelay,
+	"RETRY_JITTER":                   &retryJitter,
+	"RETRY_MAX_DELAY":                &retryMaxDelay,
+	"RETRY_QUEUE_FILE":               &retryQueueFile,
+	"RUNS_FILE":                      &runsFile,
+	"S3_ENDPOINT":                    &s3Endpoint,
+	"SEARCH_CONSOLE_PROPERTY":        &searchConsoleProperty,
+	"SENT_FILE":                      &sentFile,
+	"SITEMAP_CACHE":                  &sitemapCache,
+	"SITEMAP_CACHE_DIR":              &sitemapCacheDir,
+	"SITEMAP_FETCH_TIMEOUT":          &sitemapFetchTimeout,
+	"SITEMAP_FILE":                   &sitemapFile,
+	"SITEMAP_MAX_SIZE":               &sitemapMaxSize,
+	"SITEMAP_MAX_URLS":               &sitemapMaxUrls,
+	"SITEMAP_PING_URLS":              &sitemapPingUrls,
+	"SITEMAP_PUBLIC_URL":             &sitemapPublicUrl,
+	"SITE_CREDENTIALS":               &siteCredentials,
+	"SITE_ROOT":                      &siteRoot,
+	"SLA_TARGET":                     &slaTarget,
+	"SNAPSHOT_ARCHIVE_DIR":           &snapshotArchiveDir,
+	"SNAPSHOT_FILE":                  &snapshotFile,
+	"SNAPSHOT_RETENTION":             &snapshotRetention,
+	"SQLITE_FILE":                    &sqliteFile,
+	"STATE_ARCHIVE_DIR":              &stateArchiveDir,
+	"STATE_BACKEND":                  &stateBackend,
+	"STATE_COLUMNS":                  &stateColumns,
+	"STATE_DELIMITER":                &stateDelimiter,
+	"STATE_LABELS":                   &stateLabels,
+	"STATE_RETENTION":                &stateRetention,
+	"STATE_SYNC_URL":                 &stateSyncUrl,
+	"STATE_TIME_FORMAT":              &stateTimeFormat,
+	"STATSD_ADDR":                    &statsdAddr,
+	"STATSD_PREFIX":                  &statsdPrefix,
+	"URL_EXCLUDE":                    &urlExclude,
+	"URL_INCLUDE":                    &urlInclude,
+	"URL_REWRITE":                    &urlRewrite,
+	"URL_REWRITE_HOSTS":              &urlRewriteHosts,
+	"URL_STRIP_PARAMS":               &urlStripParams,
+	"URL_TRAILING_SLASH":             &trailingSlash,
+	"URL_TYPES_FILE":                 &urlTypesFile,
+}
+
+// telemetryReport is the anonymous usage report of a run. It has no URLs, hosts,
+// credentials or identifiers.
+type telemetryReport struct {
+	Version  string   `json:"version"`
+	OS       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	Command  string   `json:"command"`
+	Backend  string   `json:"state_backend"`
+	Features []string `json:"features"`
+	RunSize  string   `json:"run_size"`
+	Sent     string   `json:"sent"`
+	Failed   string   `json:"failed"`
+}
+
+// sizeBucket rounds a count to a coarse bucket so runs can't be told apart by their exact size
+func sizeBucket(n int) string {
+	switch {
+	case n == 0:
+		return "0"
+	case n <= 10:
+		return "1-10"
+	case n <= 100:
+		return "11-100"
+	case n <= 1000:
+		return "101-1000"
+	default:
+		return ">1000"
+	}
+}
+
+// usedFeatures returns the sorted names of the settings in telemetryFeatures which are set
+func usedFeatures() []string {
+	features := []string{}
+	for name, value := range telemetryFeatures {
+		if *value != "" {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// reportTelemetry sends the anonymous usage report of a run if telemetry is enabled.
+// TELEMETRY=true sends it to TELEMETRY_URL, TELEMETRY=print only prints it.
+func reportTelemetry(command string, stats runStats) {
+	if telemetry != "true" && telemetry != "print" {
+		return
+	}
+
+	report := telemetryReport{
+		Version:  "(devel)",
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Command:  command,
+		Backend:  stateBackend,
+		Features: usedFeatures(),
+		RunSize:  sizeBucket(stats.Attempted),
+		Sent:     sizeBucket(stats.Sent),
+		Failed:   sizeBucket(stats.Failed),
+	}
+	if report.Backend == "" {
+		report.Backend = "csv"
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		report.Version = info.Main.Version
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	if telemetry == "print" {
+		fmt.Println("Telemetry report:", string(data))
+		return
+	}
+	if telemetryURL == "" {
+		logWarning("TELEMETRY is enabled but TELEMETRY_URL is not set, no usage report sent")
+		return
+	}
+
+	// Telemetry must never slow down or break a run
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Post(telemetryURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
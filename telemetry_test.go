@@ -0,0 +1,141 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// unreportedSettings are the environment variables read by the code which aren't in
+// telemetryFeatures, with the reason why
+var unreportedSettings = map[string]string{
+	"TELEMETRY":               "telemetry itself",
+	"TELEMETRY_URL":           "telemetry itself",
+	"AWS_ACCESS_KEY_ID":       "standard AWS variable",
+	"AWS_SECRET_ACCESS_KEY":   "standard AWS variable",
+	"AWS_SESSION_TOKEN":       "standard AWS variable",
+	"AWS_REGION":              "standard AWS variable",
+	"AWS_DEFAULT_REGION":      "standard AWS variable",
+	"VAULT_ADDR":              "standard Vault variable",
+	"VAULT_TOKEN":             "standard Vault variable",
+	"VAULT_NAMESPACE":         "standard Vault variable",
+	"KUBERNETES_SERVICE_HOST": "set by Kubernetes",
+	"KUBERNETES_SERVICE_PORT": "set by Kubernetes",
+	"POD_NAME":                "set by the deployment",
+}
+
+// getenvName returns the name of the variable of an os.Getenv call with a constant name
+func getenvName(expr ast.Expr) (string, bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return "", false
+	}
+	fun, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || fun.Sel.Name != "Getenv" {
+		return "", false
+	}
+	if pkg, ok := fun.X.(*ast.Ident); !ok || pkg.Name != "os" {
+		return "", false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	name, err := strconv.Unquote(lit.Value)
+	return name, err == nil
+}
+
+// TestTelemetryFeaturesMatchSettings checks that every setting the code reads is
+// reported by the variable it is read into, or is listed in unreportedSettings
+func TestTelemetryFeaturesMatchSettings(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read are the variables read anywhere, settings the package variables they are read into
+	read := map[string]bool{}
+	settings := map[string]string{}
+	// reported are the variables of the telemetryFeatures entries
+	reported := map[string]string{}
+	for _, file := range pkgs["main"].Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			if expr, ok := n.(ast.Expr); ok {
+				if name, ok := getenvName(expr); ok {
+					read[name] = true
+				}
+			}
+			return true
+		})
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				for i, value := range spec.Values {
+					if name, ok := getenvName(value); ok {
+						settings[name] = spec.Names[i].Name
+					}
+					lit, ok := value.(*ast.CompositeLit)
+					if !ok || spec.Names[i].Name != "telemetryFeatures" {
+						continue
+					}
+					for _, elt := range lit.Elts {
+						kv := elt.(*ast.KeyValueExpr)
+						name, _ := strconv.Unquote(kv.Key.(*ast.BasicLit).Value)
+						reported[name] = kv.Value.(*ast.UnaryExpr).X.(*ast.Ident).Name
+					}
+				}
+			}
+		}
+	}
+	if len(reported) != len(telemetryFeatures) {
+		t.Fatalf("found %d telemetryFeatures entries in the source, want %d", len(reported), len(telemetryFeatures))
+	}
+
+	for name := range read {
+		_, unreported := unreportedSettings[name]
+		if _, ok := telemetryFeatures[name]; !ok && !unreported {
+			t.Errorf("%s is read but neither in telemetryFeatures nor in unreportedSettings", name)
+		}
+		if _, ok := telemetryFeatures[name]; ok && unreported {
+			t.Errorf("%s is both in telemetryFeatures and in unreportedSettings", name)
+		}
+	}
+	for name, variable := range reported {
+		if !read[name] {
+			t.Errorf("%s is in telemetryFeatures but isn't read", name)
+		} else if settings[name] != variable {
+			t.Errorf("%s is reported by %s, but read into %q", name, variable, settings[name])
+		}
+	}
+	for name := range unreportedSettings {
+		if !read[name] {
+			t.Errorf("%s is in unreportedSettings but isn't read", name)
+		}
+	}
+}
+
+func TestUsedFeatures(t *testing.T) {
+	prevRedis, prevNamespace := redisUrl, operatorNamespace
+	redisUrl, operatorNamespace = "redis://localhost", "indexing"
+	t.Cleanup(func() { redisUrl, operatorNamespace = prevRedis, prevNamespace })
+
+	features := usedFeatures()
+	if !slices.Contains(features, "REDIS_URL") || !slices.Contains(features, "OPERATOR_NAMESPACE") {
+		t.Errorf("used features %v miss REDIS_URL or OPERATOR_NAMESPACE", features)
+	}
+	if !slices.IsSorted(features) {
+		t.Errorf("used features %v aren't sorted", features)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Connection settings of the transport shared by the API clients
+var (
+	apiHTTP2           = os.Getenv("API_HTTP2")
+	apiMaxIdleConns    = os.Getenv("API_MAX_IDLE_CONNS")
+	apiIdleConnTimeout = os.Getenv("API_IDLE_CONN_TIMEOUT")
+	apiKeepAlive       = os.Getenv("API_KEEP_ALIVE")
+	apiDialTimeout     = os.Getenv("API_DIAL_TIMEOUT")
+)
+
+var (
+	apiTransportOnce sync.Once
+	sharedTransport  *http.Transport
+	apiTransportErr  error
+)
+
+// apiTransport returns the transport shared by all API clients, so high volume runs reuse
+// connections instead of setting up one per client or request
+func apiTransport() (*http.Transport, error) {
+	apiTransportOnce.Do(func() {
+		sharedTransport, apiTransportErr = newAPITransport()
+	})
+	return sharedTransport, apiTransportErr
+}
+
+// tunedTransport creates a transport with the connection settings. Unlike the default
+// transport it keeps as many idle connections per host as in total, as all API calls go
+// to a few hosts.
+func tunedTransport() (*http.Transport, error) {
+	maxIdle, err := parseIntDefault(apiMaxIdleConns, 100)
+	if err != nil {
+		return nil, fmt.Errorf("parsing API_MAX_IDLE_CONNS: %w", err)
+	}
+	idleTimeout, err := parseDurationDefault(apiIdleConnTimeout, 90*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("parsing API_IDLE_CONN_TIMEOUT: %w", err)
+	}
+	keepAlive, err := parseDurationDefault(apiKeepAlive, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("parsing API_KEEP_ALIVE: %w", err)
+	}
+	dialTimeout, err := parseDurationDefault(apiDialTimeout, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("parsing API_DIAL_TIMEOUT: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}).DialContext
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdle
+	transport.IdleConnTimeout = idleTimeout
+	if apiHTTP2 == "false" {
+		// A non-nil empty map keeps the transport from upgrading to HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
+
+// newAuthenticatedClient creates an HTTP client authenticated by the options, which calls
+// the API through base, or the shared transport if nil. Token requests always use the
+// shared transport.
+func newAuthenticatedClient(base http.RoundTripper, opts ...option.ClientOption) (*http.Client, error) {
+	shared, err := apiTransport()
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		base = shared
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: shared})
+	transport, err := htransport.NewTransport(ctx, base, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
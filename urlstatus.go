@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// runUrlStatus prints the latest URL_UPDATED and URL_DELETED notify times Google has for
+// the URLs given as arguments, next to when they were last sent according to the sent file
+func runUrlStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatal("Usage: indexapi status <url>...")
+		return
+	}
+
+	client, err := newIndexingService()
+	if err != nil {
+		log.Fatal("Error creating indexing service:", err)
+		return
+	}
+	ctx := interruptContext()
+	lastSent, err := lastSentTimes(sentFile)
+	if err != nil {
+		log.Fatal("Error reading sent URLs:", err)
+		return
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	failed := 0
+	for _, arg := range fs.Args() {
+		url := normalizeUrl(arg)
+		rec, err := fetchMetadata(ctx, client, url)
+		if err != nil {
+			failed++
+			logURL(severityError, url, "Error getting metadata of %s: %v", url, err)
+			continue
+		}
+		fmt.Fprintln(out, url)
+		fmt.Fprintf(out, "  URL_UPDATED  received %-25s sent %s\n", orNever(rec.LatestUpdate), sentTime(lastSent, url, "URL_UPDATED"))
+		fmt.Fprintf(out, "  URL_DELETED  received %-25s sent %s\n", orNever(rec.LatestRemove), sentTime(lastSent, url, "URL_DELETED"))
+	}
+	out.Flush()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// orNever returns the notify time, or "never" if Google has no notification of the type
+func orNever(notifyTime string) string {
+	if notifyTime == "" {
+		return "never"
+	}
+	return notifyTime
+}
+
+// sentTime returns when a URL was last sent with a notification type, or "never"
+func sentTime(lastSent map[string]time.Time, url, notificationType string) string {
+	t, ok := lastSent[sentKey(url, notificationType)]
+	if !ok {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
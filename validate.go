@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sitemapProtocolMaxUrls is the number of URLs a sitemap file may have by the sitemap protocol
+const sitemapProtocolMaxUrls = 50000
+
+// sitemapValidator checks sitemaps against the sitemap protocol and reports the problems it finds
+type sitemapValidator struct {
+	out      *bufio.Writer
+	issues   int
+	urls     int
+	sitemaps int
+	// seen holds the location and line where every URL was first found
+	seen map[string]string
+	// host is the host of the first URL, which local sitemaps are checked against
+	host string
+}
+
+// runValidate checks the sitemap without submitting anything
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	list := sitemapFile
+	if fs.NArg() > 0 {
+		list = strings.Join(fs.Args(), ",")
+	}
+	locations, err := resolveSitemaps(list)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	v := &sitemapValidator{out: bufio.NewWriter(os.Stdout), seen: map[string]string{}}
+	for _, location := range locations {
+		v.validateLocation(location, 0)
+	}
+	fmt.Fprintf(v.out, "Checked %d URLs in %d sitemaps, found %d issues\n", v.urls, v.sitemaps, v.issues)
+	v.out.Flush()
+	if v.issues > 0 {
+		os.Exit(1)
+	}
+}
+
+// report prints an issue at a line of a sitemap, line 0 is the sitemap as a whole
+func (v *sitemapValidator) report(location string, line int, format string, args ...interface{}) {
+	v.issues++
+	if line > 0 {
+		location += ":" + strconv.Itoa(line)
+	}
+	fmt.Fprintf(v.out, "%s: %s\n", location, fmt.Sprintf(format, args...))
+}
+
+// validateLocation reads a sitemap and checks its entries, following sitemap indexes
+func (v *sitemapValidator) validateLocation(location string, depth int) {
+	if strings.HasPrefix(location, crawlPrefix) {
+		v.report(location, 0, "crawled sites have no sitemap to validate")
+		return
+	}
+	v.sitemaps++
+
+	data, err := v.read(location)
+	if err != nil {
+		v.report(location, 0, "%v", err)
+		return
+	}
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if !bytes.HasPrefix(trimmed, []byte("<")) {
+		// Feeds, JSON and text lists have no protocol to check besides their URLs
+		err := parseInput(location, bytes.NewReader(data), depth, func(u Url) error {
+			v.checkUrl(location, 0, u)
+			return nil
+		})
+		if err != nil {
+			v.report(location, 0, "%v", err)
+		}
+		return
+	}
+	v.validateXML(location, trimmed, depth)
+}
+
+// read fetches a sitemap and decompresses it, failing if it is larger than SITEMAP_MAX_SIZE
+func (v *sitemapValidator) read(location string) ([]byte, error) {
+	limits, err := loadInputLimits()
+	if err != nil {
+		return nil, err
+	}
+	file, err := openSource(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := readLimited(file, limits.maxSize, location)
+	for layers := 0; err == nil && bytes.HasPrefix(data, []byte{0x1f, 0x8b}); layers++ {
+		if layers == maxGzipLayers {
+			return nil, fmt.Errorf("compressed more than %d times", maxGzipLayers)
+		}
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing: %w", err)
+		}
+		data, err = readLimited(zr, limits.maxSize, location)
+	}
+	return data, err
+}
+
+// validateXML checks the entries of a urlset or sitemap index
+func (v *sitemapValidator) validateXML(location string, data []byte, depth int) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	tokens := xml.NewTokenDecoder(&checkedTokens{decoder: decoder})
+	line := func() int {
+		l, _ := decoder.InputPos()
+		return l
+	}
+
+	var root xml.StartElement
+	for {
+		token, err := tokens.Token()
+		if err != nil {
+			v.report(location, line(), "%v", err)
+			return
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	if root.Name.Local != "urlset" && root.Name.Local != "sitemapindex" {
+		err := parseInput(location, bytes.NewReader(data), depth, func(u Url) error {
+			v.checkUrl(location, 0, u)
+			return nil
+		})
+		if err != nil {
+			v.report(location, 0, "%v", err)
+		}
+		return
+	}
+
+	count := 0
+	var children []string
+	for {
+		token, err := tokens.Token()
+		if err != nil {
+			v.report(location, line(), "%v", err)
+			break
+		}
+		if _, ok := token.(xml.EndElement); ok {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		at := line()
+
+		switch {
+		case root.Name.Local == "urlset" && start.Name.Local == "url":
+			var u Url
+			err = tokens.DecodeElement(&u, &start)
+			if err == nil {
+				count++
+				v.checkUrl(location, at, u)
+			}
+		case root.Name.Local == "sitemapindex" && start.Name.Local == "sitemap":
+			var sitemap struct {
+				Loc string `xml:"loc"`
+			}
+			err = tokens.DecodeElement(&sitemap, &start)
+			if err == nil {
+				count++
+				loc := strings.TrimSpace(sitemap.Loc)
+				if loc == "" {
+					v.report(location, at, "sitemap without loc")
+				} else {
+					children = append(children, resolveLocation(location, loc))
+				}
+			}
+		default:
+			v.report(location, at, "unexpected element <%s> in <%s>", start.Name.Local, root.Name.Local)
+			err = tokens.Skip()
+		}
+		if err != nil {
+			v.report(location, line(), "%v", err)
+			break
+		}
+	}
+
+	if count > sitemapProtocolMaxUrls {
+		v.report(location, 0, "%d entries, more than the %d allowed per sitemap", count, sitemapProtocolMaxUrls)
+	}
+	if len(children) > 0 && depth+1 >= maxIndexDepth {
+		v.report(location, 0, "sitemap index is nested too deep")
+		return
+	}
+	for _, child := range children {
+		v.validateLocation(child, depth+1)
+	}
+}
+
+// checkUrl reports an entry which isn't an absolute http(s) URL, is a duplicate,
+// is on another host than the sitemap or has an invalid lastmod, priority or changefreq
+func (v *sitemapValidator) checkUrl(location string, line int, u Url) {
+	v.urls++
+	loc := strings.TrimSpace(u.Loc)
+	if loc == "" {
+		v.report(location, line, "url without loc")
+		return
+	}
+	parsed, err := url.Parse(loc)
+	if err != nil {
+		v.report(location, line, "malformed URL %s: %v", loc, err)
+		return
+	}
+	if !parsed.IsAbs() || parsed.Host == "" {
+		v.report(location, line, "URL %s is not absolute", loc)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		v.report(location, line, "URL %s is not http(s)", loc)
+		return
+	}
+
+	host := v.host
+	if isRemote(location) {
+		if sitemapUrl, err := url.Parse(location); err == nil {
+			host = sitemapUrl.Host
+		}
+	} else if host == "" {
+		v.host, host = parsed.Host, parsed.Host
+	}
+	if !strings.EqualFold(parsed.Host, host) {
+		v.report(location, line, "URL %s is on host %s, not %s", loc, parsed.Host, host)
+	}
+
+	normalized := normalizeUrl(loc)
+	where := location
+	if line > 0 {
+		where += ":" + strconv.Itoa(line)
+	}
+	if first, ok := v.seen[normalized]; ok {
+		v.report(location, line, "URL %s is a duplicate of %s", loc, first)
+	} else {
+		v.seen[normalized] = where
+	}
+
+	if u.Lastmod != "" {
+		if _, ok := parseLastmod(u.Lastmod); !ok {
+			v.report(location, line, "invalid lastmod %q of %s", u.Lastmod, loc)
+		}
+	}
+	if u.Priority != "" {
+		p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64)
+		if err != nil || p < 0 || p > 1 {
+			v.report(location, line, "invalid priority %q of %s, must be between 0.0 and 1.0", u.Priority, loc)
+		}
+	}
+	if u.Changefreq != "" {
+		changefreq := strings.ToLower(strings.TrimSpace(u.Changefreq))
+		if _, ok := changefreqIntervals[changefreq]; !ok && changefreq != "never" {
+			v.report(location, line, "invalid changefreq %q of %s", u.Changefreq, loc)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+// runWatch polls the sitemap, e.g. an RSS or Atom feed which announces new content
+// before the sitemap is regenerated, and submits newly appearing URLs on every poll
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	every := fs.Duration("every", 15*time.Minute, "Interval between polls")
+	fs.Parse(args)
+
+	if *every <= 0 {
+		log.Fatal("The interval between polls must be positive")
+		return
+	}
+
+	client, limits, cleanup, err := setupSubmission()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	defer cleanup()
+
+	// URLs beyond the daily quota wait for a later poll instead of blocking it for a day
+	limits.waitForNextDay = false
+	logInfo("Polling %s every %s", sitemapFile, *every)
+	ctx := interruptContext()
+	for {
+		err := submitOnce(ctx, client, limits)
+		if err != nil {
+			logError("%v", err)
+		}
+		runStatus.setNext("poll the sitemap", clock.Now().Add(*every))
+		if sleepContext(ctx, *every) != nil {
+			return
+		}
+	}
+}